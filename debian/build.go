@@ -1,16 +1,38 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"text/template"
+	"text/template/parse"
 	"time"
 
 	"github.com/blang/semver"
@@ -30,6 +52,13 @@ const (
 	latestkubeadmconf  = "post-1.10/10-kubeadm.conf"
 )
 
+type packageFormat string
+
+const (
+	formatDeb packageFormat = "deb"
+	formatAPK packageFormat = "apk"
+)
+
 type work struct {
 	src, dst string
 	t        *template.Template
@@ -40,6 +69,23 @@ type build struct {
 	Package  string
 	Distros  []string
 	Versions []version
+	// Binaries are the programs the package ships, the package name if
+	// empty.
+	Binaries []string
+	// ArchIndependent is set for packages of Architecture all, which are
+	// built once per channel and distro rather than per architecture.
+	ArchIndependent bool
+	// TemplateData holds package specific values that are made available to
+	// the templates of the package next to the fields of cfg.
+	TemplateData map[string]interface{}
+}
+
+// binaries returns the programs shipped by the package of b.
+func (b build) binaries() []string {
+	if len(b.Binaries) == 0 {
+		return []string{b.Package}
+	}
+	return b.Binaries
 }
 
 type version struct {
@@ -49,11 +95,58 @@ type version struct {
 	GetDownloadLinkBase                 func(v version) (string, error)
 	KubeadmKubeletConfigFile            string
 	KubeletCNIVersion                   string
+	// CNIVersion is the version of kubernetes-cni built in the same run.
+	CNIVersion string
 }
 
 type cfg struct {
 	version
-	DistroName, Arch, DebArch, Package string
+	DistroName, OS, Arch, DebArch, Package string
+	ApkArch, ApkVersion, ApkRelease        string
+	// Binaries are the programs the package ships, for the templates to
+	// range over.
+	Binaries []string
+	// Homepage is the URL of the project the package belongs to.
+	Homepage string
+	// Description is the synopsis of the package, LongDescription the rest
+	// of its description formatted for the control file.
+	Description, LongDescription string
+	// GitCommit is the commit of the package definitions, if known.
+	GitCommit string
+	// PackageName is the name of the built package, which differs from
+	// Package with --channel-suffix.
+	PackageName string
+	// DebVersion is the full version of the package, including the epoch
+	// set with --epoch.
+	DebVersion string
+	// WithDbgsym is set with --with-dbgsym to build debug symbol packages.
+	WithDbgsym bool
+	// StandardsVersion is the Debian policy version set with
+	// --standards-version.
+	StandardsVersion string
+	// DistroVersion is the release number of DistroName, e.g. 16.04 for
+	// xenial, if known.
+	DistroVersion string
+	// Urgency and Distribution are the changelog fields of the channel.
+	Urgency, Distribution string
+
+	// messages collects the warnings and errors of dpkg-buildpackage, if
+	// not nil.
+	messages *[]dpkgMessage
+
+	templateData map[string]interface{}
+	// clock tells the time to the date template function.
+	clock Clock
+	// relationOverrides moves dependencies to another relation field.
+	relationOverrides map[string]relationType
+	// downloads caches the binaries of all builds of the run with
+	// --download-cache-dir.
+	downloads *binaryCache
+	// packageVersions are the Debian versions of the other packages built
+	// in the same channel, by package, which the meta-package depends on.
+	packageVersions map[string]string
+	// started is when the build started.
+	started time.Time
 }
 
 type stringList []string
@@ -62,56 +155,204 @@ func (ss *stringList) String() string {
 	return strings.Join(*ss, ",")
 }
 func (ss *stringList) Set(v string) error {
-	*ss = strings.Split(v, ",")
+	// Drop empty elements so that e.g. --arch "" or --arch "amd64," don't
+	// produce builds for an empty architecture.
+	*ss = nil
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); len(s) != 0 {
+			*ss = append(*ss, s)
+		}
+	}
+	return nil
+}
+
+// requireNonEmpty returns an error if a list flag was set to an effectively
+// empty value.
+func requireNonEmpty(what string, ss stringList) error {
+	if len(ss) == 0 {
+		return fmt.Errorf("at least one %s must be specified", what)
+	}
 	return nil
 }
 
 var (
-	architectures = stringList{"amd64", "arm", "arm64", "ppc64le", "s390x"}
-	serverDistros = stringList{"xenial"}
-	allDistros    = stringList{"xenial", "jessie", "precise", "sid", "stretch", "trusty", "utopic", "vivid", "wheezy", "wily", "yakkety"}
-	kubeVersion   = ""
+	operatingSystems = stringList{"linux"}
+	architectures    = stringList{"amd64", "arm", "arm64", "ppc64le", "s390x"}
+	serverDistros    = stringList{"xenial"}
+	allDistros       = stringList{"xenial", "jessie", "precise", "sid", "stretch", "trusty", "utopic", "vivid", "wheezy", "wily", "yakkety"}
+	kubeVersion      = ""
+	packages         = stringList{}
+	relationSpecs    = stringList{}
+	descriptionSpecs = stringList{}
+	changed          = stringList{}
 
-	builtins = map[string]interface{}{
-		"date": func() string {
-			return time.Now().Format(time.RFC1123Z)
-		},
-	}
+	keepTmp                 = flag.Bool("keep-tmp", false, "keep tmp dir after build")
+	quiet                   = flag.Bool("quiet", false, "Only print errors, to stderr, including the output of the commands that failed.")
+	nativeOnly              = flag.Bool("native-only", false, "Only build for the architecture of the host, out of the architectures given by --arch.")
+	skipBinfmtCheck         = flag.Bool("skip-binfmt-check", false, "Don't check that qemu-user-static binfmt_misc handlers are registered for the architectures that differ from the host.")
+	releaseDownloadLinkBase = flag.String("release-download-link-base", "https://dl.k8s.io", "Base URL of the Kubernetes releases, under which the binaries of every version are in v<version>/bin.")
+	ciDownloadLinkBase      = flag.String("ci-download-link-base", "https://dl.k8s.io/ci-cross", "Base URL of the Kubernetes CI builds, under which the binaries of every build are in v<version>/bin.")
+	allowInsecureDownloads  = flag.Bool("allow-insecure-downloads", false, "Accept http:// download base URLs.")
+	maxRedirects            = flag.Int("max-redirects", 10, "Maximum number of HTTP redirects to follow when downloading versions, checksums and binaries.")
+	crossHostRedirects      = flag.Bool("cross-host-redirects", true, "Follow HTTP redirects to a host other than the one of the original request.")
+	format                  = flag.String("format", string(formatDeb), "Package format to build: deb or apk.")
 
-	keepTmp = flag.Bool("keep-tmp", false, "keep tmp dir after build")
+	channelSuffix        = flag.Bool("channel-suffix", false, "Append the channel to the names of packages outside the stable channel, e.g. kubectl-nightly.")
+	withDbgsym           = flag.Bool("with-dbgsym", false, "Also build the -dbgsym debug symbol packages and write them next to the packages.")
+	standardsVersion     = flag.String("standards-version", "4.7.0", "Debian policy version the packages declare to comply with in Standards-Version.")
+	homepage             = flag.String("homepage", "https://kubernetes.io", "Homepage of the packages.")
+	revision             = flag.String("revision", "00", "Debian revision of all packages.")
+	versionMetadata      = flag.String("version-metadata", "", "Build metadata, e.g. a CI job ID, to append to the versions of all packages as +<metadata>. Pre-releases are then separated with ~ to keep them sorting before releases.")
+	epoch                = flag.Int("epoch", 0, "Debian epoch to prefix the versions of all packages with, e.g. 1 for 1:1.11.0-00. 0 means no epoch.")
+	compatLevel          = flag.Int("compat-level", 0, "Override the debhelper compat level of all package definitions. 0 keeps the level of each definition.")
+	installedSize        = flag.Bool("installed-size", false, "Set the Installed-Size of the built packages to the size of their files in KiB, including the payload their debian/rules download.")
+	changelogHistoryDir  = flag.String("changelog-history-dir", "", "Directory of previous changelog entries, <distro>/<channel>/<package>.changelog, to carry into the changelogs of the packages. Updated after every build.")
+	downloadCacheDir     = flag.String("download-cache-dir", "", "Directory in which to cache downloaded Kubernetes binaries across builds and runs.")
+	binariesManifestFile = flag.String("binaries-manifest", "", "JSON file listing the binaries and archives fetched ahead of the build, as {\"package\", \"binary\" (for the archives of cri-tools, e.g. crictl), \"version\" (optional), \"os\", \"arch\", \"path\", \"sha256\"} objects. The packages are built from them, verifying their checksums, without downloading or looking anything up: the packages the manifest lists are built unless --packages is set, at the versions of their entries unless --kube-version is set.")
+
+	component              = flag.String("component", "", "APT repository component (e.g. main) to insert into the output path: bin/<channel>/<component>/<distro>.")
+	perArchDirs            = flag.Bool("per-arch-dirs", false, "Write the packages of every architecture to their own directory: bin/<channel>/<distro>/<arch>. Packages of Architecture all are written to the directory of every architecture.")
+	smokeTest              = flag.Bool("smoke-test", false, "After building, install the packages built for the host architecture in a container of their distro.")
+	containerRuntime       = flag.String("container-runtime", "", "Container runtime used by --smoke-test: docker or podman. Detected if empty.")
+	smokeTestImageTemplate = flag.String("smoke-test-image-template", "", "Template of the container image --smoke-test installs the packages of a distro in, e.g. registry.example.com/ubuntu:{{ .DistroVersion }}, with the .DistroName and .DistroVersion of the distro. The official image of the distro if empty.")
+	versionParallelism     = flag.Int("version-parallelism", 4, "Number of versions to look up concurrently before building.")
+	githubToken            = flag.String("github-token", "", "GitHub API token used to resolve the cri-tools and CNI plugins versions from their GitHub releases.")
+	versionAuthToken       = flag.String("version-auth-token", "", "Bearer token sent with the requests for the published Kubernetes versions.")
+	versionAuthBasic       = flag.String("version-auth-basic", "", "user:password sent as basic authentication with the requests for the published Kubernetes versions.")
+	netrcFile              = flag.String("netrc", "", "netrc file with the credentials of the requests for the published Kubernetes versions, used without --version-auth-token and --version-auth-basic. $HOME/.netrc if empty.")
+	pushOCI                = flag.String("push-oci", "", "Push every built .deb and its checksum as an OCI artifact to this repository (without tag), using oras.")
+	sbom                   = flag.Bool("sbom", false, "Write an SPDX JSON SBOM next to every built .deb, with the published checksums of the upstream artifacts it is built from.")
+	provenance             = flag.Bool("provenance", false, "Write the SLSA provenance of every built .deb next to it, as an in-toto statement.")
+	xzThreads              = flag.Int("xz-threads", 0, "Number of threads used for xz compression of the packages. 0 means auto-detect.")
+	aptIndex               = flag.Bool("apt-index", false, "After building, write Packages, Packages.gz and Release files to every output directory, making it a flat APT repository.")
+	aptIndexIncremental    = flag.Bool("apt-index-incremental", false, "With --apt-index, add every package to the Packages index of its output directory as soon as it is built, rather than after all builds.")
+	manifestFile           = flag.String("manifest", "", "File to write the list of the packages built to, with their checksums, or - for stdout, which only the manifest is written to with --quiet.")
+	manifestFormat         = flag.String("manifest-format", "json", "Format of --manifest: json, list (one package path per line, as reprepro includedeb takes them) or csv.")
+	compareManifest        = flag.String("compare-manifest", "", "Print what changed between the packages of --manifest and those of this previous json manifest, and exit with 4 if anything did.")
+	aptOrigin              = flag.String("apt-origin", "Kubernetes", "Origin field of the Release files written with --apt-index.")
+	aptLabel               = flag.String("apt-label", "Kubernetes", "Label field of the Release files written with --apt-index.")
+	signKey                = flag.String("sign-key", "", "GPG key to sign the Release files written with --apt-index with, producing Release.gpg and InRelease.")
+	pruneKeep              = flag.Int("prune-keep", 0, "After building, delete all but this many of the newest revisions of every package version in bin/. 0 disables pruning.")
+	nextPatch              = flag.Bool("next-patch", false, "Build the packages for the patch release following the current stable version.")
+	stripPrerelease        = flag.Bool("strip-prerelease", false, "With --next-patch, drop a pre-release suffix from the stable version instead of failing.")
+	warningsAsErrors       = flag.Bool("warnings-as-errors", false, "Fail builds for which dpkg-buildpackage or debhelper printed warnings.")
+	strict                 = flag.Bool("strict", false, "Fail builds with a file of their definition that renders to nothing but whitespace, rather than warn.")
+	filter                 = flag.String("filter", "", `Only build what matches this expression over package, distro, os, arch, channel and version, e.g. "channel==stable && arch==arm64 && distro!=trusty".`)
+	keepGoing              = flag.Bool("keep-going", false, "Continue with the remaining builds when one fails. The run then exits with 2 if some builds failed and 3 if all did.")
+	jobs                   = flag.Int("jobs", 1, "Number of packages to build in parallel.")
+	perArchJobs            = flag.Int("per-arch-jobs", 0, "Number of packages to build in parallel for the same architecture, out of --jobs. Unlimited if 0.")
+	minFreeSpace           = flag.String("min-free-space", "", "Free space, e.g. 10G, the output and temporary directories must have for the build to start. Estimated from the packages to build if empty, not checked if 0.")
+	stateFile              = flag.String("state-file", "", "Record the builds that completed in this file, to be skipped with --resume.")
+	resume                 = flag.Bool("resume", false, "Skip the builds that --state-file records as completed at the same Debian version. Their packages are still listed in --manifest and indexed with --apt-index.")
+	timeoutPerBuild        = flag.Duration("timeout-per-build", 0, "Abort a single package build if it takes longer than this. 0 means no limit.")
+	versionCacheFile       = flag.String("version-cache-file", "", "Cache the versions fetched from dl.k8s.io in this file across runs. The latest CI build is always fetched.")
+	versionCacheTTL        = flag.Duration("version-cache-ttl", 0, "Reuse the versions cached in --version-cache-file for this long instead of fetching them again. 0 always fetches them.")
+	refreshVersions        = flag.Bool("refresh-versions", false, "Fetch the versions again even if --version-cache-file has fresh ones, and update the cache.")
 )
 
 func init() {
+	flag.Var(&operatingSystems, "os", "Operating systems whose binaries to package.")
 	flag.Var(&architectures, "arch", "Architectures to build for.")
 	flag.Var(&serverDistros, "server-distros", "Server distros to build for.")
 	flag.Var(&allDistros, "distros", "Distros to build for.")
 	flag.StringVar(&kubeVersion, "kube-version", "", "Distros to build for.")
+	flag.Var(&packages, "packages", "Packages to build. All known packages if empty.")
+	flag.Var(&changed, "changed", "Packages that changed, e.g. kubernetes-cni after a version bump. Only they and the packages depending on them are built.")
+	flag.Var(&descriptionSpecs, "description", "Overrides the synopsis of a package, the first line of its description, as <package>=<synopsis>. Can be repeated.")
+	flag.Var(&relationSpecs, "relation", "Moves a dependency of a package to another relation field of its control file, as <package>:<dependency>=<depends|recommends|suggests>, e.g. kubeadm:cri-tools=recommends. Can be repeated.")
 }
 
-func runCommand(pwd string, command string, cmdArgs ...string) error {
-	cmd := exec.Command(command, cmdArgs...)
+// runCommand runs command in pwd, killing it when ctx is done. The output
+// of the command is also copied to out, if not nil. It is a variable so
+// tests can replace it with a fake.
+var runCommand = func(ctx context.Context, pwd string, env []string, out io.Writer, command string, cmdArgs ...string) error {
+	cmd := exec.CommandContext(ctx, command, cmdArgs...)
 	if len(pwd) != 0 {
 		cmd.Dir = pwd
 	}
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if len(env) != 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	var captured bytes.Buffer
+	if *quiet {
+		// The output is only shown if the command fails.
+		w := &lockedWriter{w: &captured}
+		stdout, stderr = w, w
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if out != nil {
+		// Stdout and stderr are copied concurrently.
+		out = &lockedWriter{w: out}
+		cmd.Stdout = io.MultiWriter(stdout, out)
+		cmd.Stderr = io.MultiWriter(stderr, out)
+	}
 	if err := cmd.Run(); err != nil {
+		os.Stderr.Write(captured.Bytes())
 		return err
 	}
 	return nil
 }
 
-func (c cfg) run() error {
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// buildTimeoutError is returned for builds that were killed because they
+// exceeded --timeout-per-build.
+type buildTimeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *buildTimeoutError) Error() string {
+	return fmt.Sprintf("build timed out after %v: %v", e.timeout, e.err)
+}
+
+// runWithTimeout calls f with a context that expires after timeout, so that
+// a single hung build can't consume the time budget of the whole run. A zero
+// timeout disables the deadline.
+func runWithTimeout(timeout time.Duration, f func(ctx context.Context) error) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := f(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return &buildTimeoutError{timeout: timeout, err: err}
+	}
+	return err
+}
+
+func (c cfg) run(ctx context.Context) error {
 	log.Printf("!!!!!!!!! doing: %#v", c)
+	c.started = c.now()
 	var w []work
 
 	srcdir := filepath.Join(c.DistroName, c.Package)
-	dstdir, err := ioutil.TempDir(os.TempDir(), "debs")
+	// dpkg-buildpackage writes the packages next to dstdir, in a directory
+	// of the build's own so that parallel builds don't mix them up.
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "debs")
 	if err != nil {
 		return err
 	}
 	if !*keepTmp {
-		defer os.RemoveAll(dstdir)
+		defer os.RemoveAll(tmpdir)
+	}
+	dstdir := filepath.Join(tmpdir, c.Package)
+	if err := os.Mkdir(dstdir, 0755); err != nil {
+		return err
 	}
 
 	// allow base package dir to by a symlink so we can reuse packages
@@ -130,12 +371,12 @@ func (c cfg) run() error {
 			return nil
 		}
 		if f.IsDir() {
-			log.Printf(dstfile)
+			log.Print(dstfile)
 			return os.Mkdir(dstfile, f.Mode())
 		}
 		t, err := template.
 			New("").
-			Funcs(builtins).
+			Funcs(c.templateFuncs()).
 			Option("missingkey=error").
 			ParseFiles(srcfile)
 		if err != nil {
@@ -153,392 +394,5292 @@ func (c cfg) run() error {
 		return err
 	}
 
-	for _, w := range w {
-		log.Printf("w: %#v", w)
-		if err := func() error {
-			f, err := os.OpenFile(w.dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
+	if err := renderWork(w, c); err != nil {
+		return err
+	}
 
-			if err := w.t.Execute(f, c); err != nil {
-				return err
-			}
-			if err := os.Chmod(w.dst, w.info.Mode()); err != nil {
-				return err
-			}
-			return nil
-		}(); err != nil {
+	if packageFormat(*format) == formatAPK {
+		return c.buildAPK(ctx, dstdir)
+	}
+
+	// The definition is rendered once, above, so that nothing writes its
+	// own compat level back over the override.
+	if *compatLevel != 0 {
+		if err := overrideCompatLevel(dstdir, *compatLevel); err != nil {
 			return err
 		}
 	}
 
-	err = runCommand(dstdir, "dpkg-buildpackage", "-us", "-uc", "-b", "-a"+c.DebArch)
-	if err != nil {
-		return err
+	if c.PackageName != c.Package {
+		if err := renamePackageFiles(filepath.Join(dstdir, "debian"), c.Package, c.PackageName); err != nil {
+			return err
+		}
 	}
 
-	dstParts := []string{"bin", string(c.Channel), c.DistroName}
+	switch {
+	case binaries != nil:
+		if err := c.stageManifestBinary(binaries, dstdir); err != nil {
+			return err
+		}
+	case c.downloads != nil:
+		if err := c.stageBinary(ctx, c.downloads, dstdir); err != nil {
+			return err
+		}
+	}
 
-	dstPath := filepath.Join(dstParts...)
-	os.MkdirAll(dstPath, 0777)
+	var rendered string
+	if len(*changelogHistoryDir) != 0 {
+		if rendered, err = c.applyChangelogHistory(dstdir, *changelogHistoryDir); err != nil {
+			return err
+		}
+	}
 
-	fileName := fmt.Sprintf("%s_%s-%s_%s.deb", c.Package, c.Version, c.Revision, c.DebArch)
-	err = runCommand("", "mv", filepath.Join("/tmp", fileName), dstPath)
+	// Right before building, so that nothing written to the definition
+	// above brings leftovers back.
+	removed, err := cleanBuildLeftovers(dstdir)
 	if err != nil {
 		return err
 	}
+	for _, f := range removed {
+		log.Printf("removed build leftover %s from the definition of %s", f, c.Package)
+	}
 
-	return nil
+	if err := c.buildDeb(ctx, dstdir); err != nil {
+		return err
+	}
+	if len(*changelogHistoryDir) == 0 {
+		return nil
+	}
+	return c.saveChangelogHistory(*changelogHistoryDir, rendered)
 }
 
-func walkBuilds(builds []build, f func(pkg, distro, arch string, v version) error) error {
-	for _, a := range architectures {
-		for _, b := range builds {
-			for _, d := range b.Distros {
-				for _, v := range b.Versions {
-					// Populate the version if it doesn't exist
-					if len(v.Version) == 0 && v.GetVersion != nil {
-						var err error
-						v.Version, err = v.GetVersion()
-						if err != nil {
-							return err
-						}
-					}
-
-					// Populate the version if it doesn't exist
-					if len(v.DownloadLinkBase) == 0 && v.GetDownloadLinkBase != nil {
-						var err error
-						v.DownloadLinkBase, err = v.GetDownloadLinkBase(v)
-						if err != nil {
-							return err
-						}
-					}
+// buildLeftovers are the patterns of files in debian/ that a previous,
+// possibly killed, dpkg-buildpackage run in a definition directory may have
+// left behind and that confuse the next build.
+var buildLeftovers = []string{
+	"files",
+	"*.substvars",
+	"*.debhelper",
+	"*.debhelper.log",
+	"debhelper-build-stamp",
+	".debhelper",
+	"tmp",
+}
 
-					if err := f(b.Package, d, a, v); err != nil {
-						return err
-					}
-				}
+// cleanBuildLeftovers removes buildLeftovers from the copied definition in
+// dir and returns the paths it removed, relative to dir.
+func cleanBuildLeftovers(dir string) ([]string, error) {
+	var removed []string
+	for _, pattern := range buildLeftovers {
+		matches, err := filepath.Glob(filepath.Join(dir, "debian", pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if err := os.RemoveAll(m); err != nil {
+				return nil, err
+			}
+			rel, err := filepath.Rel(dir, m)
+			if err != nil {
+				return nil, err
 			}
+			removed = append(removed, rel)
 		}
 	}
+	return removed, nil
+}
+
+// The debhelper compat levels accepted by --compat-level.
+const (
+	minCompatLevel = 5
+	maxCompatLevel = 13
+)
+
+func validateCompatLevel(level int) error {
+	if level != 0 && (level < minCompatLevel || level > maxCompatLevel) {
+		return fmt.Errorf("unsupported debhelper compat level %d, must be between %d and %d", level, minCompatLevel, maxCompatLevel)
+	}
 	return nil
 }
 
-func fetchVersion(url string) (string, error) {
-	res, err := http.Get(url)
+var debhelperCompatDependency = regexp.MustCompile(`debhelper-compat \(= *\d+\)`)
+
+// overrideCompatLevel sets the debhelper compat level of the definition
+// copied to dir. Definitions either declare it in debian/compat or with a
+// debhelper-compat build dependency, and debhelper rejects having both.
+func overrideCompatLevel(dir string, level int) error {
+	controlFile := filepath.Join(dir, "debian", "control")
+	control, err := ioutil.ReadFile(controlFile)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	versionBytes, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
-	if err != nil {
-		return "", err
+	if debhelperCompatDependency.Match(control) {
+		control = debhelperCompatDependency.ReplaceAll(control, []byte(fmt.Sprintf("debhelper-compat (= %d)", level)))
+		return ioutil.WriteFile(controlFile, control, 0644)
 	}
-	// Remove a newline and the v prefix from the string
-	return strings.Replace(strings.Replace(string(versionBytes), "v", "", 1), "\n", "", 1), nil
+	return ioutil.WriteFile(filepath.Join(dir, "debian", "compat"), []byte(fmt.Sprintf("%d\n", level)), 0644)
 }
 
-func getStableKubeVersion() (string, error) {
-	return fetchVersion("https://dl.k8s.io/release/stable.txt")
+// templateFuncs returns the functions available to the templates of c.
+func (c cfg) templateFuncs() template.FuncMap {
+	funcs := template.FuncMap{
+		// packageName returns the name a sibling package is built under in
+		// the same channel, for use in dependencies.
+		"packageName": func(pkg string) string {
+			return packageName(pkg, c.Channel)
+		},
+		// apkDepends returns the dependencies of the package for the
+		// depends of an APKBUILD.
+		"apkDepends": c.apkDepends,
+	}
+	for name, f := range builtins(c.clock) {
+		funcs[name] = f
+	}
+	return funcs
 }
 
-func getLatestKubeVersion() (string, error) {
-	return fetchVersion("https://dl.k8s.io/release/latest.txt")
+// now returns the time of c.clock, or of systemClock if nil, like the date
+// template function does.
+func (c cfg) now() time.Time {
+	if c.clock == nil {
+		return systemClock.Now()
+	}
+	return c.clock.Now()
 }
 
-func getLatestCIVersion() (string, error) {
-	latestVersion, err := getLatestKubeCIBuild()
-	if err != nil {
-		return "", err
+// Clock tells the time. It is replaced in tests to render reproducibly.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// systemClock is the Clock of builds that don't set one.
+var systemClock Clock = realClock{}
+
+// builtins returns the functions available to all templates, telling the
+// time with clock, or with systemClock if nil.
+func builtins(clock Clock) template.FuncMap {
+	if clock == nil {
+		clock = systemClock
+	}
+	return template.FuncMap{
+		"date": func() string {
+			return clock.Now().Format(time.RFC1123Z)
+		},
+		"join": strings.Join,
 	}
+}
 
-	// Replace the "+" with a "-" to make it semver-compliant
-	return strings.Replace(latestVersion, "+", "-", 1), nil
+// packageName returns the name pkg is built under in channel. With
+// --channel-suffix, packages outside the stable channel are suffixed with
+// the channel so that they can be published side by side. Installing one
+// replaces the package of another channel, see templateContext.
+func packageName(pkg string, channel ChannelType) string {
+	if !*channelSuffix || channel == ChannelStable {
+		return pkg
+	}
+	return fmt.Sprintf("%s-%s", pkg, channel)
 }
 
-func getCRIToolsLatestVersion() (string, error) {
-	return criToolsVersion, nil
+// renamePackageFiles renames the debhelper files named after package from,
+// e.g. kubectl.install, to be named after package to.
+func renamePackageFiles(debianDir, from, to string) error {
+	files, err := filepath.Glob(filepath.Join(debianDir, from+".*"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		renamed := filepath.Join(debianDir, to+strings.TrimPrefix(filepath.Base(f), from))
+		if err := os.Rename(f, renamed); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func getLatestKubeCIBuild() (string, error) {
-	return fetchVersion("https://dl.k8s.io/ci-cross/latest.txt")
+// channelUrgency is the changelog urgency of the packages of a channel.
+func channelUrgency(channel ChannelType) string {
+	if channel == ChannelStable {
+		return "medium"
+	}
+	return "low"
 }
 
-func getCIBuildsDownloadLinkBase(_ version) (string, error) {
-	latestCiVersion, err := getLatestKubeCIBuild()
-	if err != nil {
-		return "", err
+// channelDistribution is the changelog distribution of the packages of a
+// channel built for distro.
+func channelDistribution(distro string, channel ChannelType) string {
+	if channel == ChannelStable {
+		return distro
 	}
+	return fmt.Sprintf("%s-%s", distro, channel)
+}
 
-	return fmt.Sprintf("https://dl.k8s.io/ci-cross/v%s", latestCiVersion), nil
+// changelogEntry is a single entry of a Debian changelog, from its header
+// line to its trailer line.
+type changelogEntry struct {
+	version string
+	text    string
 }
 
-func getReleaseDownloadLinkBase(v version) (string, error) {
-	return fmt.Sprintf("https://dl.k8s.io/v%s", v.Version), nil
+var changelogHeader = regexp.MustCompile(`^\S+ \(([^)]+)\) [^;]+;`)
+
+// parseChangelog splits a Debian changelog into its entries.
+func parseChangelog(data string) ([]changelogEntry, error) {
+	var entries []changelogEntry
+	var lines []string
+	flush := func() {
+		if len(entries) == 0 {
+			return
+		}
+		entries[len(entries)-1].text = strings.TrimRight(strings.Join(lines, "\n"), "\n \t")
+	}
+	for i, line := range strings.Split(data, "\n") {
+		if len(line) == 0 || line[0] == ' ' || line[0] == '\t' {
+			if len(entries) == 0 && len(strings.TrimSpace(line)) != 0 {
+				return nil, fmt.Errorf("line %d: text before the first changelog entry", i+1)
+			}
+			lines = append(lines, line)
+			continue
+		}
+		m := changelogHeader.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("line %d: malformed changelog entry header %q", i+1, line)
+		}
+		flush()
+		entries = append(entries, changelogEntry{version: m[1]})
+		lines = []string{line}
+	}
+	flush()
+	return entries, nil
 }
 
-// The version of this file to use changed in 1.8 and 1.11 so use the target build
-// version to figure out which copy of it to include in the deb.
-func getKubeadmKubeletConfigFile(v version) (string, error) {
-	sv, err := semver.Make(v.Version)
-	if err != nil {
-		return "", err
+func formatChangelog(entries []changelogEntry) string {
+	texts := make([]string, len(entries))
+	for i, e := range entries {
+		texts[i] = e.text
 	}
+	return strings.Join(texts, "\n\n") + "\n"
+}
 
-	v180, err := semver.Make("1.8.0-alpha.0")
+type byDebianVersionDesc []changelogEntry
+
+func (e byDebianVersionDesc) Len() int      { return len(e) }
+func (e byDebianVersionDesc) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e byDebianVersionDesc) Less(i, j int) bool {
+	return compareDebianVersions(e[i].version, e[j].version) > 0
+}
+
+// mergeChangelog prepends the single entry of the rendered changelog to
+// history. It returns the changelog of the package, which only keeps the
+// history older than the new entry, and the updated history, which keeps
+// every version. Both are ordered newest first; a previous entry for the
+// version of the new one is replaced.
+func mergeChangelog(rendered, history string) (changelog, updated string, err error) {
+	current, err := parseChangelog(rendered)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	v1110, err := semver.Make("1.11.0-alpha.0")
+	if len(current) != 1 {
+		return "", "", fmt.Errorf("rendered changelog has %d entries, expected 1", len(current))
+	}
+	previous, err := parseChangelog(history)
 	if err != nil {
-		return "", err
+		return "", "", fmt.Errorf("changelog history: %v", err)
 	}
 
-	if sv.LT(v1110) {
-		if sv.LT(v180) {
-			return pre180kubeadmconf, nil
+	all := []changelogEntry{current[0]}
+	older := []changelogEntry{current[0]}
+	for _, e := range previous {
+		switch cmp := compareDebianVersions(e.version, current[0].version); {
+		case cmp == 0:
+			continue
+		case cmp < 0:
+			older = append(older, e)
 		}
-		return pre1110kubeadmconf, nil
+		all = append(all, e)
 	}
-	return latestkubeadmconf, nil
+	sort.Stable(byDebianVersionDesc(older))
+	sort.Stable(byDebianVersionDesc(all))
+	return formatChangelog(older), formatChangelog(all), nil
 }
 
-// CNI get bumped in 1.9, which is incompatible for kubelet<1.9.
-// So we need to restrict the CNI version when install kubelet.
-func getKubeletCNIVersion(v version) (string, error) {
-	sv, err := semver.Make(v.Version)
+// changelogHistoryFile is where the changelog history of c is kept within
+// dir. It is per distro and channel, as the distribution is part of every
+// entry.
+func (c cfg) changelogHistoryFile(dir string) string {
+	return filepath.Join(dir, c.DistroName, string(c.Channel), c.PackageName+".changelog")
+}
+
+// changelogHistoryLocks serializes the updates of each changelog history
+// file by the builds of a run, e.g. those of several architectures.
+var changelogHistoryLocks keyedLocks
+
+// applyChangelogHistory replaces the rendered changelog in dstdir with one
+// that also carries the previous entries from the history in dir. It
+// returns the rendered changelog, to be saved to the history once the
+// package is built.
+func (c cfg) applyChangelogHistory(dstdir, dir string) (string, error) {
+	changelogFile := filepath.Join(dstdir, "debian", "changelog")
+	rendered, err := ioutil.ReadFile(changelogFile)
 	if err != nil {
 		return "", err
 	}
-
-	v190, err := semver.Make("1.9.0-alpha.0")
+	file := c.changelogHistoryFile(dir)
+	unlock := changelogHistoryLocks.lock(file)
+	history, err := ioutil.ReadFile(file)
+	unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	changelog, _, err := mergeChangelog(string(rendered), string(history))
 	if err != nil {
+		return "", fmt.Errorf("%s: %v", file, err)
+	}
+	if err := ioutil.WriteFile(changelogFile, []byte(changelog), 0644); err != nil {
 		return "", err
 	}
+	return string(rendered), nil
+}
 
-	if sv.GTE(v190) {
-		return fmt.Sprintf("= %s", cniVersion), nil
+// saveChangelogHistory adds the entry of the rendered changelog to the
+// history in dir. The history is read again, as other builds may have
+// updated it meanwhile.
+func (c cfg) saveChangelogHistory(dir, rendered string) error {
+	file := c.changelogHistoryFile(dir)
+	defer changelogHistoryLocks.lock(file)()
+	history, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
-	return fmt.Sprint("= 0.5.1"), nil
+	_, updated, err := mergeChangelog(rendered, string(history))
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(updated), 0644)
 }
 
-func main() {
-	flag.Parse()
+// compareDebianVersions compares two Debian package versions the way dpkg
+// does and returns -1, 0 or 1.
+func compareDebianVersions(a, b string) int {
+	epochA, upstreamA, revisionA := splitDebianVersion(a)
+	epochB, upstreamB, revisionB := splitDebianVersion(b)
+	if epochA != epochB {
+		if epochA < epochB {
+			return -1
+		}
+		return 1
+	}
+	if cmp := compareDebianVersionPart(upstreamA, upstreamB); cmp != 0 {
+		return cmp
+	}
+	return compareDebianVersionPart(revisionA, revisionB)
+}
 
-	builds := []build{
-		{
-			Package: "kubectl",
-			Distros: allDistros,
-			Versions: []version{
-				{
-					GetVersion:          getStableKubeVersion,
-					Revision:            "00",
-					Channel:             ChannelStable,
-					GetDownloadLinkBase: getReleaseDownloadLinkBase,
-				},
-				{
-					GetVersion:          getLatestKubeVersion,
-					Revision:            "00",
-					Channel:             ChannelUnstable,
-					GetDownloadLinkBase: getReleaseDownloadLinkBase,
-				},
-				{
-					GetVersion:          getLatestCIVersion,
-					Revision:            "00",
-					Channel:             ChannelNightly,
-					GetDownloadLinkBase: getCIBuildsDownloadLinkBase,
-				},
-			},
-		},
-		{
-			Package: "kubelet",
-			Distros: serverDistros,
-			Versions: []version{
-				{
-					GetVersion:          getStableKubeVersion,
-					Revision:            "00",
-					Channel:             ChannelStable,
-					GetDownloadLinkBase: getReleaseDownloadLinkBase,
-				},
-				{
-					GetVersion:          getLatestKubeVersion,
-					Revision:            "00",
-					Channel:             ChannelUnstable,
-					GetDownloadLinkBase: getReleaseDownloadLinkBase,
-				},
-				{
-					GetVersion:          getLatestCIVersion,
-					Revision:            "00",
-					Channel:             ChannelNightly,
-					GetDownloadLinkBase: getCIBuildsDownloadLinkBase,
-				},
-			},
-		},
-		{
-			Package: "kubernetes-cni",
-			Distros: serverDistros,
-			Versions: []version{
-				{
-					Version:  cniVersion,
-					Revision: "00",
-					Channel:  ChannelStable,
-				},
-				{
-					Version:  cniVersion,
-					Revision: "00",
-					Channel:  ChannelUnstable,
-				},
-				{
-					Version:  cniVersion,
-					Revision: "00",
-					Channel:  ChannelNightly,
-				},
-			},
-		},
-		{
-			Package: "kubeadm",
-			Distros: serverDistros,
-			Versions: []version{
-				{
-					GetVersion:          getStableKubeVersion,
-					Revision:            "00",
-					Channel:             ChannelStable,
-					GetDownloadLinkBase: getReleaseDownloadLinkBase,
-				},
-				{
-					GetVersion:          getLatestKubeVersion,
-					Revision:            "00",
-					Channel:             ChannelUnstable,
-					GetDownloadLinkBase: getReleaseDownloadLinkBase,
-				},
-				{
-					GetVersion:          getLatestCIVersion,
-					Revision:            "00",
-					Channel:             ChannelNightly,
-					GetDownloadLinkBase: getCIBuildsDownloadLinkBase,
-				},
-			},
-		},
-		{
-			Package: "cri-tools",
-			Distros: serverDistros,
-			Versions: []version{
-				{
-					GetVersion: getCRIToolsLatestVersion,
-					Revision:   "00",
-					Channel:    ChannelStable,
-				},
-				{
-					GetVersion: getCRIToolsLatestVersion,
-					Revision:   "00",
-					Channel:    ChannelUnstable,
-				},
-				{
-					GetVersion: getCRIToolsLatestVersion,
-					Revision:   "00",
-					Channel:    ChannelNightly,
-				},
-			},
-		},
+func splitDebianVersion(v string) (epoch int, upstream, revision string) {
+	if i := strings.Index(v, ":"); i >= 0 {
+		epoch, _ = strconv.Atoi(v[:i])
+		v = v[i+1:]
 	}
+	if i := strings.LastIndex(v, "-"); i >= 0 {
+		return epoch, v[:i], v[i+1:]
+	}
+	return epoch, v, ""
+}
 
-	if kubeVersion != "" {
-		getSpecifiedVersion := func() (string, error) {
-			return kubeVersion, nil
-		}
-		builds = []build{
-			{
-				Package: "kubectl",
-				Distros: allDistros,
-				Versions: []version{
-					{
-						GetVersion:          getSpecifiedVersion,
-						Revision:            "00",
-						Channel:             ChannelStable,
-						GetDownloadLinkBase: getReleaseDownloadLinkBase,
-					},
-				},
-			},
-			{
-				Package: "kubelet",
-				Distros: serverDistros,
-				Versions: []version{
-					{
-						GetVersion:          getSpecifiedVersion,
-						Revision:            "00",
-						Channel:             ChannelStable,
-						GetDownloadLinkBase: getReleaseDownloadLinkBase,
-					},
-				},
-			},
-			{
-				Package: "kubernetes-cni",
-				Distros: serverDistros,
-				Versions: []version{
-					{
-						Version:  cniVersion,
-						Revision: "00",
-						Channel:  ChannelStable,
-					},
-				},
-			},
-			{
-				Package: "kubeadm",
-				Distros: serverDistros,
-				Versions: []version{
-					{
-						GetVersion:          getSpecifiedVersion,
-						Revision:            "00",
-						Channel:             ChannelStable,
-						GetDownloadLinkBase: getReleaseDownloadLinkBase,
-					},
-				},
-			},
-			{
-				Package: "cri-tools",
-				Distros: serverDistros,
-				Versions: []version{
-					{
-						GetVersion: getCRIToolsLatestVersion,
-						Revision:   "00",
-						Channel:    ChannelStable,
-					},
-				},
-			},
-		}
+// debianCharOrder is the sort weight of a character in the non-digit parts
+// of a version: ~ sorts before everything, even the end of the part, and
+// letters sort before other characters.
+func debianCharOrder(s string, i int) int {
+	if i >= len(s) {
+		return 0
 	}
+	switch c := s[i]; {
+	case c == '~':
+		return -1
+	case c >= '0' && c <= '9':
+		return 0
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
 
-	if err := walkBuilds(builds, func(pkg, distro, arch string, v version) error {
-		c := cfg{
-			Package:    pkg,
-			version:    v,
-			DistroName: distro,
-			Arch:       arch,
+func compareDebianVersionPart(a, b string) int {
+	isDigit := func(s string, i int) bool { return i < len(s) && s[i] >= '0' && s[i] <= '9' }
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isDigit(a, i)) || (j < len(b) && !isDigit(b, j)) {
+			ca, cb := debianCharOrder(a, i), debianCharOrder(b, j)
+			if ca != cb {
+				if ca < cb {
+					return -1
+				}
+				return 1
+			}
+			i++
+			j++
 		}
-		if c.Arch == "arm" {
-			c.DebArch = "armhf"
-		} else if c.Arch == "ppc64le" {
-			c.DebArch = "ppc64el"
-		} else {
-			c.DebArch = c.Arch
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		cmp := 0
+		for isDigit(a, i) && isDigit(b, j) {
+			if cmp == 0 && a[i] != b[j] {
+				cmp = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if isDigit(a, i) {
+			return 1
+		}
+		if isDigit(b, j) {
+			return -1
+		}
+		if cmp < 0 {
+			return -1
+		}
+		if cmp > 0 {
+			return 1
 		}
+	}
+	return 0
+}
 
-		var err error
-		c.KubeadmKubeletConfigFile, err = getKubeadmKubeletConfigFile(v)
-		if err != nil {
-			log.Fatalf("error getting kubeadm config: %v", err)
+// templateContext returns the values the templates of c are rendered with:
+// the exported fields of cfg, including the embedded version, merged with
+// the package's TemplateData.
+func (c cfg) templateContext() (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+	addStructFields(data, reflect.ValueOf(c))
+
+	relations, err := c.relations()
+	if err != nil {
+		return nil, err
+	}
+	data["Depends"] = relations[relationDepends]
+	data["Recommends"] = relations[relationRecommends]
+	data["Suggests"] = relations[relationSuggests]
+
+	// The packages of all channels ship the same files, so those suffixed
+	// with their channel take the place of any other.
+	var conflicts, provides []string
+	if c.PackageName != c.Package {
+		conflicts = []string{c.Package}
+		provides = []string{fmt.Sprintf("%s (= %s)", c.Package, c.DebVersion)}
+	}
+	data["Conflicts"] = conflicts
+	data["Provides"] = provides
+
+	for k, v := range c.templateData {
+		if _, ok := data[k]; ok {
+			return nil, fmt.Errorf("template data %q of %s collides with a field of the same name", k, c.Package)
 		}
+		data[k] = v
+	}
+	return data, nil
+}
 
-		c.KubeletCNIVersion, err = getKubeletCNIVersion(v)
-		if err != nil {
-			log.Fatalf("error getting kubelet config: %v", err)
+// relationType is a field of a Debian control file relating a package to
+// others.
+type relationType string
+
+const (
+	relationDepends    relationType = "depends"
+	relationRecommends relationType = "recommends"
+	relationSuggests   relationType = "suggests"
+)
+
+// dependency is a package another package relates to: one of KnownPackages,
+// renamed along with the package in a channel, or a package of the distro.
+type dependency struct {
+	Name string
+	// Constraint restricts the versions of the dependency, e.g. ">= 1.6.0".
+	Constraint string
+	Relation   relationType
+}
+
+// dependencies returns the packages the package of c relates to, by
+// default.
+func (c cfg) dependencies() []dependency {
+	switch c.Package {
+	case "kubelet":
+		return []dependency{
+			{"iptables", ">= 1.4.21", relationDepends},
+			{"kubernetes-cni", c.KubeletCNIVersion, relationDepends},
+			{"iproute2", "", relationDepends},
+			{"socat", "", relationDepends},
+			{"util-linux", "", relationDepends},
+			{"mount", "", relationDepends},
+			{"ebtables", "", relationDepends},
+			{"ethtool", "", relationDepends},
+		}
+	case "kubeadm":
+		return []dependency{
+			{"kubelet", ">= 1.6.0", relationDepends},
+			{"kubectl", ">= 1.6.0", relationDepends},
+			{"kubernetes-cni", ">= " + c.CNIVersion, relationDepends},
+			{"cri-tools", ">=1.11.0", relationDepends},
 		}
+	case metaPackage:
+		var deps []dependency
+		for _, pkg := range KnownPackages() {
+			if pkg == metaPackage {
+				continue
+			}
+			d := dependency{Name: pkg, Relation: relationDepends}
+			if v, ok := c.packageVersions[pkg]; ok {
+				d.Constraint = "= " + v
+			}
+			deps = append(deps, d)
+		}
+		return deps
+	}
+	return nil
+}
 
-		return c.run()
-	}); err != nil {
-		log.Fatalf("err: %v", err)
+// relations returns the dependencies of c, formatted for the control file,
+// by the field they belong to: the default one or the one --relation moved
+// them to.
+func (c cfg) relations() (map[relationType][]string, error) {
+	relations := map[relationType][]string{}
+	for _, d := range c.dependencies() {
+		if r, ok := c.relationOverrides[d.Name]; ok {
+			d.Relation = r
+		}
+		name := d.Name
+		for _, pkg := range KnownPackages() {
+			if name == pkg {
+				name = packageName(name, c.Channel)
+				break
+			}
+		}
+		if len(d.Constraint) != 0 {
+			name += " (" + d.Constraint + ")"
+		}
+		relations[d.Relation] = append(relations[d.Relation], name)
+	}
+	for name := range c.relationOverrides {
+		if !c.dependsOn(name) {
+			return nil, fmt.Errorf("%s has no dependency %s", c.Package, name)
+		}
+	}
+	return relations, nil
+}
+
+// apkDependencyNames maps dependencies to the Alpine packages providing
+// them. Dependencies missing here have the same name on Alpine, those
+// mapped to none are part of another package there.
+var apkDependencyNames = map[string][]string{
+	"iptables":       {"iptables", "ip6tables"},
+	"kubernetes-cni": {"cni-plugins"},
+	"mount":          nil,
+}
+
+// apkOperators maps the version relations of Debian to those of apk.
+var apkOperators = []struct{ deb, apk string }{
+	{">=", ">="},
+	{"<=", "<="},
+	{">>", ">"},
+	{"<<", "<"},
+	{"=", "="},
+}
+
+// apkDepends returns the dependencies of c that it depends on, after
+// --relation, in the syntax of apk, e.g. kubelet>=1.6.0. apk has no
+// weaker relations to put the others in.
+func (c cfg) apkDepends() ([]string, error) {
+	var depends []string
+	for _, d := range c.dependencies() {
+		if r, ok := c.relationOverrides[d.Name]; ok {
+			d.Relation = r
+		}
+		if d.Relation != relationDepends {
+			continue
+		}
+		constraint, err := apkConstraint(d.Constraint)
+		if err != nil {
+			return nil, fmt.Errorf("dependency of %s on %s: %v", c.Package, d.Name, err)
+		}
+		names, ok := apkDependencyNames[d.Name]
+		if !ok {
+			names = []string{d.Name}
+		}
+		for _, name := range names {
+			depends = append(depends, name+constraint)
+		}
+	}
+	return depends, nil
+}
+
+// apkConstraint converts the version constraint of a Debian dependency,
+// e.g. ">= 1.6.0", to apk syntax, e.g. ">=1.6.0".
+func apkConstraint(constraint string) (string, error) {
+	constraint = strings.TrimSpace(constraint)
+	if len(constraint) == 0 {
+		return "", nil
+	}
+	for _, op := range apkOperators {
+		if !strings.HasPrefix(constraint, op.deb) {
+			continue
+		}
+		v, err := getApkVersion(strings.TrimSpace(strings.TrimPrefix(constraint, op.deb)))
+		if err != nil {
+			return "", err
+		}
+		return op.apk + v, nil
+	}
+	return "", fmt.Errorf("unsupported version constraint %q", constraint)
+}
+
+func (c cfg) dependsOn(name string) bool {
+	for _, d := range c.dependencies() {
+		if d.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRelationOverrides parses --relation values of the form
+// <package>:<dependency>=<depends|recommends|suggests> into the relations of
+// the dependencies by package.
+func parseRelationOverrides(specs []string) (map[string]map[string]relationType, error) {
+	overrides := map[string]map[string]relationType{}
+	for _, spec := range specs {
+		i := strings.Index(spec, ":")
+		j := strings.LastIndex(spec, "=")
+		if i <= 0 || j <= i+1 {
+			return nil, fmt.Errorf("%q is not of the form <package>:<dependency>=<relation>", spec)
+		}
+		pkg, name, r := spec[:i], spec[i+1:j], relationType(spec[j+1:])
+		switch r {
+		case relationDepends, relationRecommends, relationSuggests:
+		default:
+			return nil, fmt.Errorf("unknown relation %q in %q, must be one of %s, %s or %s", r, spec, relationDepends, relationRecommends, relationSuggests)
+		}
+		if err := validatePackages([]string{pkg}); err != nil {
+			return nil, err
+		}
+		if !(cfg{Package: pkg}).dependsOn(name) {
+			return nil, fmt.Errorf("%s has no dependency %s", pkg, name)
+		}
+		if overrides[pkg] == nil {
+			overrides[pkg] = map[string]relationType{}
+		}
+		overrides[pkg][name] = r
+	}
+	return overrides, nil
+}
+
+func addStructFields(data map[string]interface{}, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			addStructFields(data, v.Field(i))
+			continue
+		}
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		data[f.Name] = v.Field(i).Interface()
+	}
+}
+
+func renderWork(w []work, c cfg) error {
+	data, err := c.templateContext()
+	if err != nil {
+		return err
+	}
+
+	for _, w := range w {
+		log.Printf("w: %#v", w)
+		if len(c.DistroVersion) == 0 && templateUsesField(w.t.Tree.Root, "DistroVersion") {
+			return fmt.Errorf("%s uses .DistroVersion, but the version of distro %q is unknown", w.src, c.DistroName)
+		}
+		var buf bytes.Buffer
+		if err := w.t.Execute(&buf, data); err != nil {
+			return err
+		}
+		// An empty file of a definition is most likely a mistake, like an
+		// unfinished template or a condition that matches nothing.
+		if len(bytes.TrimSpace(buf.Bytes())) == 0 {
+			if *strict {
+				return fmt.Errorf("%s renders to an empty file", w.src)
+			}
+			log.Printf("warning: %s renders to an empty file", w.src)
+		}
+		if err := ioutil.WriteFile(w.dst, buf.Bytes(), w.info.Mode()); err != nil {
+			return err
+		}
+		if err := os.Chmod(w.dst, w.info.Mode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateUsesField reports whether the template below node references
+// .field of its data, e.g. {{ .field }} or {{ if eq .field "x" }}.
+func templateUsesField(node parse.Node, field string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if templateUsesField(c, field) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return templateUsesField(n.Pipe, field)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Cmds {
+			if templateUsesField(c, field) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if templateUsesField(arg, field) {
+				return true
+			}
+		}
+	case *parse.FieldNode:
+		return len(n.Ident) != 0 && n.Ident[0] == field
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == field
+	case *parse.IfNode:
+		return templateUsesField(n.Pipe, field) || templateUsesField(n.List, field) || templateUsesField(n.ElseList, field)
+	case *parse.RangeNode:
+		return templateUsesField(n.Pipe, field) || templateUsesField(n.List, field) || templateUsesField(n.ElseList, field)
+	case *parse.WithNode:
+		return templateUsesField(n.Pipe, field) || templateUsesField(n.List, field) || templateUsesField(n.ElseList, field)
+	case *parse.TemplateNode:
+		return templateUsesField(n.Pipe, field)
+	}
+	return false
+}
+
+// installedSizeKiB returns the Installed-Size of the package extracted to
+// root, excluding the DEBIAN/ control directory. Like dpkg-gencontrol it
+// rounds every file up to a whole KiB.
+func installedSizeKiB(root string) (int64, error) {
+	var size int64
+	err := filepath.Walk(root, func(file string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() && file == filepath.Join(root, "DEBIAN") {
+			return filepath.SkipDir
+		}
+		if f.Mode().IsRegular() {
+			size += (f.Size() + 1023) / 1024
+		}
+		return nil
+	})
+	return size, err
+}
+
+// setInstalledSize measures the files of the built package deb and sets the
+// Installed-Size field of its control file to their size, repacking it. The
+// size covers everything the build put into the package, including what the
+// debian/rules templates download.
+func setInstalledSize(ctx context.Context, deb string) error {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "installed-size")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	root := filepath.Join(tmpdir, "package")
+	if err := runCommand(ctx, "", nil, nil, "dpkg-deb", "--raw-extract", deb, root); err != nil {
+		return err
+	}
+	size, err := installedSizeKiB(root)
+	if err != nil {
+		return err
+	}
+	control := filepath.Join(root, "DEBIAN", "control")
+	data, err := ioutil.ReadFile(control)
+	if err != nil {
+		return err
+	}
+	patched := setControlField(string(data), "Installed-Size", strconv.FormatInt(size, 10))
+	if err := ioutil.WriteFile(control, []byte(patched), 0644); err != nil {
+		return err
+	}
+	return runCommand(ctx, "", nil, nil, "dpkg-deb", "--root-owner-group", "--build", root, deb)
+}
+
+// setControlField sets field of the binary package control file control to
+// value, replacing the field if it exists and adding it before the
+// Description otherwise.
+func setControlField(control, field, value string) string {
+	lines := strings.SplitAfter(control, "\n")
+	line := field + ": " + value + "\n"
+	for i, l := range lines {
+		if strings.HasPrefix(l, field+":") {
+			lines[i] = line
+			return strings.Join(lines, "")
+		}
+	}
+	for i, l := range lines {
+		if strings.HasPrefix(l, "Description:") {
+			lines = append(lines[:i], append([]string{line}, lines[i:]...)...)
+			return strings.Join(lines, "")
+		}
+	}
+	if len(control) != 0 && !strings.HasSuffix(control, "\n") {
+		control += "\n"
+	}
+	return control + line
+}
+
+// stageBinary places the Kubernetes binary the package wraps into dstdir,
+// fetching it through the cache. The debian/rules templates only download
+// the binary themselves if it hasn't been staged.
+func (c cfg) stageBinary(ctx context.Context, bc *binaryCache, dstdir string) error {
+	if !stagesBinary(c.Package) {
+		return nil
+	}
+
+	url := c.binaryURL()
+	cached, err := bc.fetch(ctx, url, filepath.Join(c.Version, c.OS, c.Arch, path.Base(url)))
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(dstdir, "usr", "bin", c.Package)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return copyFile(cached, dst, 0755)
+}
+
+// stagesBinary tells whether the binary of pkg can be staged rather than
+// downloaded by its debian/rules.
+func stagesBinary(pkg string) bool {
+	switch pkg {
+	case "kubectl", "kubelet", "kubeadm":
+		return true
+	}
+	return false
+}
+
+// stageManifestBinary places the upstream artifacts of the package into
+// dstdir from the local copies listed in m, where debian/rules skips
+// downloading them.
+func (c cfg) stageManifestBinary(m *binariesManifest, dstdir string) error {
+	for _, s := range c.sources() {
+		src, err := m.lookup(c.Package, s.binary, c.Version, c.OS, c.Arch)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dstdir, s.path)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(src, dst, s.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// binaries lists the binaries fetched ahead of the build with
+// --binaries-manifest.
+var binaries *binariesManifest
+
+// binariesManifest is a JSON list of binaryEntry, for hermetic builds that
+// must not download anything.
+type binariesManifest struct {
+	// dir is the directory relative paths are relative to, the one of the
+	// manifest.
+	dir     string
+	entries []binaryEntry
+}
+
+// binaryEntry is a binary, or the archive of one, of a package for an
+// os/arch. Entries without a version apply to all versions.
+type binaryEntry struct {
+	Package string `json:"package"`
+	// Binary tells apart the archives of a package shipping several
+	// programs, e.g. crictl and critest of cri-tools.
+	Binary  string `json:"binary,omitempty"`
+	Version string `json:"version,omitempty"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	Path    string `json:"path"`
+	SHA256  string `json:"sha256"`
+}
+
+func loadBinariesManifest(path string) (*binariesManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &binariesManifest{dir: filepath.Dir(path)}
+	if err := json.Unmarshal(data, &m.entries); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for _, e := range m.entries {
+		if len(e.Package) == 0 || len(e.OS) == 0 || len(e.Arch) == 0 || len(e.Path) == 0 || len(e.SHA256) == 0 {
+			return nil, fmt.Errorf("%s: entry %+v lacks one of package, os, arch, path and sha256", path, e)
+		}
+	}
+	return m, nil
+}
+
+// packages returns the KnownPackages m has binaries for, along with the
+// meta-package if it has them for all the packages it depends on.
+func (m *binariesManifest) packages() []string {
+	var pkgs []string
+	for _, pkg := range KnownPackages() {
+		if pkg == metaPackage {
+			if len(pkgs) == len(KnownPackages())-1 {
+				pkgs = append(pkgs, pkg)
+			}
+			continue
+		}
+		for _, e := range m.entries {
+			if e.Package == pkg {
+				pkgs = append(pkgs, pkg)
+				break
+			}
+		}
+	}
+	return pkgs
+}
+
+// version returns the version the entries of pkgs in m are listed with,
+// which must be the same for all of them.
+func (m *binariesManifest) version(pkgs ...string) (string, error) {
+	var version string
+	for _, e := range m.entries {
+		listed := false
+		for _, pkg := range pkgs {
+			listed = listed || e.Package == pkg
+		}
+		switch {
+		case !listed || len(e.Version) == 0:
+		case len(version) == 0:
+			version = e.Version
+		case e.Version != version:
+			return "", fmt.Errorf("the binaries manifest lists both versions %s and %s", version, e.Version)
+		}
+	}
+	if len(version) == 0 {
+		return "", fmt.Errorf("the binaries manifest lists no version of %s", strings.Join(pkgs, ", "))
+	}
+	return version, nil
+}
+
+// lookup returns the path of the binary of pkg, or of its program binary
+// if it ships several, for os/arch, after checking that it matches its
+// checksum. An entry of the version is preferred to one for all versions.
+func (m *binariesManifest) lookup(pkg, binary, version, os, arch string) (string, error) {
+	var found *binaryEntry
+	for i, e := range m.entries {
+		if e.Package != pkg || e.Binary != binary || e.OS != os || e.Arch != arch {
+			continue
+		}
+		if e.Version == version {
+			found = &m.entries[i]
+			break
+		}
+		if len(e.Version) == 0 && found == nil {
+			found = &m.entries[i]
+		}
+	}
+	if found == nil {
+		name := pkg
+		if len(binary) != 0 {
+			name += " " + binary
+		}
+		return "", fmt.Errorf("the binaries manifest has no entry for %s %s on %s/%s", name, version, os, arch)
+	}
+
+	path := found.Path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(m.dir, path)
+	}
+	sum, err := sha256File(path)
+	if err != nil {
+		return "", err
+	}
+	if sum != strings.ToLower(found.SHA256) {
+		return "", fmt.Errorf("checksum mismatch for %s: got %s, expected %s", path, sum, found.SHA256)
+	}
+	return path, nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// binaryCache stores downloaded binaries under dir, keyed by
+// <version>/<os>/<arch>/<name>. Every entry has a .sha256 sidecar holding the
+// checksum it was verified against when it was downloaded.
+type binaryCache struct {
+	dir string
+	// keys serializes the fetches of each key by builds running in
+	// parallel.
+	keys keyedLocks
+}
+
+// keyedLocks is a mutex per key.
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock locks key and returns the function unlocking it.
+func (k *keyedLocks) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = map[string]*sync.Mutex{}
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		k.locks[key] = l
+	}
+	k.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// fetch returns the path of the cached copy of url, downloading it if it is
+// missing or doesn't match the checksum published next to it.
+func (bc *binaryCache) fetch(ctx context.Context, url, key string) (string, error) {
+	defer bc.keys.lock(key)()
+
+	cached := filepath.Join(bc.dir, key)
+
+	// Not every bucket publishes checksums (CI builds don't), in which case
+	// we fall back to the checksum recorded when the entry was cached.
+	want, err := fetchChecksum(ctx, url+".sha256")
+	if err != nil {
+		log.Printf("no published checksum for %s, relying on the cached one: %v", url, err)
+		if recorded, err := ioutil.ReadFile(cached + ".sha256"); err == nil {
+			want = strings.TrimSpace(string(recorded))
+		}
+	}
+
+	if len(want) != 0 {
+		if got, err := sha256File(cached); err == nil {
+			if got == want {
+				return cached, nil
+			}
+			log.Printf("cached %s has checksum %s, expected %s; downloading it again", cached, got, want)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		return "", err
+	}
+	if err := download(ctx, url, cached); err != nil {
+		return "", err
+	}
+
+	got, err := sha256File(cached)
+	if err != nil {
+		return "", err
+	}
+	if len(want) != 0 && got != want {
+		os.Remove(cached)
+		return "", fmt.Errorf("checksum mismatch for %s: got %s, expected %s", url, got, want)
+	}
+	if err := ioutil.WriteFile(cached+".sha256", []byte(got+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return cached, nil
+}
+
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return res, nil
+}
+
+// fetchChecksum returns the first field of a published .sha256 file.
+func fetchChecksum(ctx context.Context, url string) (string, error) {
+	res, err := httpGet(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum file %s", url)
+	}
+	return fields[0], nil
+}
+
+// download writes url to dst, replacing it atomically.
+func download(ctx context.Context, url, dst string) error {
+	res, err := httpGet(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// A temporary file of its own, so that concurrent downloads to dst
+	// don't write into each other.
+	f, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := io.Copy(f, res.Body); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// compressionEnv returns the environment that makes xz, and dpkg-deb which
+// links liblzma directly, compress with the given number of threads.
+func compressionEnv(threads int) ([]string, error) {
+	if threads < 0 {
+		return nil, fmt.Errorf("xz thread count must not be negative, got %d", threads)
+	}
+	env := []string{fmt.Sprintf("XZ_OPT=-T%d", threads)}
+	if threads > 0 {
+		env = append(env, fmt.Sprintf("DPKG_DEB_THREADS_MAX=%d", threads))
+	}
+	return env, nil
+}
+
+func (c cfg) buildDeb(ctx context.Context, dstdir string) error {
+	env, err := compressionEnv(*xzThreads)
+	if err != nil {
+		return err
+	}
+	if c.WithDbgsym {
+		env = append(env, "DEB_BUILD_OPTIONS="+dbgsymBuildOptions(os.Getenv("DEB_BUILD_OPTIONS")))
+	}
+
+	var output bytes.Buffer
+	args := []string{"-us", "-uc", "-b"}
+	// Architecture independent packages are built for the build machine.
+	if c.DebArch != "all" {
+		args = append(args, "-a"+c.DebArch)
+	}
+	err = runCommand(ctx, dstdir, env, &output, "dpkg-buildpackage", args...)
+	messages := parseDpkgMessages(output.String())
+	if c.messages != nil {
+		*c.messages = append(*c.messages, messages...)
+	}
+	if err != nil {
+		return err
+	}
+	if *warningsAsErrors && len(messages) != 0 {
+		return &dpkgWarningsError{messages: messages}
+	}
+
+	// dpkg-buildpackage writes the packages next to the source directory.
+	artifactDir := filepath.Dir(dstdir)
+	fileName := c.debFileName()
+	if *installedSize {
+		if err := setInstalledSize(ctx, filepath.Join(artifactDir, fileName)); err != nil {
+			return fmt.Errorf("error setting the Installed-Size of %s: %v", fileName, err)
+		}
+	}
+
+	dstPath := c.outputDir()
+	os.MkdirAll(dstPath, 0777)
+
+	err = runCommand(ctx, "", nil, nil, "mv", filepath.Join(artifactDir, fileName), dstPath)
+	if err != nil {
+		return err
+	}
+	if c.WithDbgsym {
+		dbgsyms, err := c.dbgsymFiles(artifactDir)
+		if err != nil {
+			return err
+		}
+		for _, f := range dbgsyms {
+			if err := runCommand(ctx, "", nil, nil, "mv", f, dstPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	debPath := filepath.Join(dstPath, fileName)
+	if *sbom {
+		if err := c.writeSBOM(ctx, debPath); err != nil {
+			return err
+		}
+	}
+	if *provenance {
+		if err := c.writeProvenance(debPath, c.now()); err != nil {
+			return err
+		}
+	}
+	if len(*pushOCI) != 0 {
+		if err := writeChecksum(debPath); err != nil {
+			return err
+		}
+		if err := c.pushOCIArtifact(ctx, *pushOCI, debPath); err != nil {
+			return &pushError{ref: *pushOCI, err: err}
+		}
+	}
+
+	// The other directories get copies of the package and of the files
+	// written next to it.
+	files, err := filepath.Glob(debPath + "*")
+	if err != nil {
+		return err
+	}
+	dbgsyms, err := c.dbgsymFiles(dstPath)
+	if err != nil {
+		return err
+	}
+	files = append(files, dbgsyms...)
+	for _, dir := range c.publishedDirs()[1:] {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err := copyFile(f, filepath.Join(dir, filepath.Base(f)), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dbgsymBuildOptions returns the DEB_BUILD_OPTIONS of a build with
+// automatic debug symbol packages, keeping the options in current that
+// don't prevent them.
+func dbgsymBuildOptions(current string) string {
+	var options []string
+	for _, o := range strings.Fields(current) {
+		if o != "nostrip" && o != "noautodbgsym" {
+			options = append(options, o)
+		}
+	}
+	return strings.Join(options, " ")
+}
+
+// dbgsymFiles returns the debug symbol packages built next to the package
+// in dir. Debian names them <package>-dbgsym_<version>_<arch>.deb, Ubuntu
+// uses the .ddeb extension.
+func (c cfg) dbgsymFiles(dir string) ([]string, error) {
+	base := strings.TrimSuffix(c.debFileName(), ".deb")
+	base = strings.Replace(base, c.PackageName+"_", c.PackageName+"-dbgsym_", 1)
+
+	var files []string
+	for _, ext := range []string{".deb", ".ddeb"} {
+		matches, err := filepath.Glob(filepath.Join(dir, base+ext))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// addToIndex adds the packages of the build to the Packages indexes of the
+// directories they are published to.
+func (c cfg) addToIndex(ctx context.Context, index *packagesIndex) error {
+	for _, dir := range c.publishedDirs() {
+		debs := []string{filepath.Join(dir, c.debFileName())}
+		if c.WithDbgsym {
+			files, err := c.dbgsymFiles(dir)
+			if err != nil {
+				return err
+			}
+			// Like dpkg-scanpackages, leave out .ddeb files.
+			for _, f := range files {
+				if strings.HasSuffix(f, ".deb") {
+					debs = append(debs, f)
+				}
+			}
+		}
+		for _, deb := range debs {
+			if err := index.add(ctx, deb); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dpkgMessage is a warning or error that dpkg-buildpackage or one of the
+// tools it runs printed during a build.
+type dpkgMessage struct {
+	Tool     string `json:"tool"`
+	Severity string `json:"severity"`
+	Text     string `json:"text"`
+}
+
+func (m dpkgMessage) String() string {
+	return fmt.Sprintf("%s: %s: %s", m.Tool, m.Severity, m.Text)
+}
+
+// dpkgMessageLine matches the "tool: warning: text" lines of dpkg and
+// debhelper, and the "W: package: tag" lines of lintian.
+var (
+	dpkgMessageLine    = regexp.MustCompile(`^([A-Za-z][\w.+-]*)(?: \([^)]*\))?: (warning|error): (.*)$`)
+	lintianMessageLine = regexp.MustCompile(`^([WE]): (\S+): (.*)$`)
+)
+
+// parseDpkgMessages extracts the warnings and errors from the output of
+// dpkg-buildpackage. Indented lines following a message continue it.
+func parseDpkgMessages(output string) []dpkgMessage {
+	var messages []dpkgMessage
+	continued := false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := dpkgMessageLine.FindStringSubmatch(line); m != nil {
+			messages = append(messages, dpkgMessage{Tool: m[1], Severity: m[2], Text: strings.TrimSpace(m[3])})
+			continued = true
+			continue
+		}
+		if m := lintianMessageLine.FindStringSubmatch(line); m != nil {
+			severity := "warning"
+			if m[1] == "E" {
+				severity = "error"
+			}
+			messages = append(messages, dpkgMessage{Tool: "lintian", Severity: severity, Text: m[2] + ": " + m[3]})
+			continued = true
+			continue
+		}
+		if continued && len(line) != 0 && (line[0] == ' ' || line[0] == '\t') {
+			last := &messages[len(messages)-1]
+			last.Text += " " + strings.TrimSpace(line)
+			continue
+		}
+		continued = false
+	}
+	return messages
+}
+
+// Exit codes of runs with --keep-going in which builds failed. Other fatal
+// errors exit with 1.
+const (
+	exitSomeBuildsFailed = 2
+	exitAllBuildsFailed  = 3
+)
+
+// runSummary counts the outcomes of the builds of a run.
+type runSummary struct {
+	mu             sync.Mutex
+	built, skipped int
+	failed         []string
+	// pushFailed are the builds whose package was built but not pushed.
+	pushFailed []string
+}
+
+// record counts the outcome of the build called name. With keepGoing,
+// failures are only recorded, and nil is returned to continue with the next
+// build.
+func (s *runSummary) record(name string, skipped bool, err error, keepGoing bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case err != nil:
+		what := "build"
+		if _, ok := err.(*pushError); ok {
+			what = "push"
+			s.pushFailed = append(s.pushFailed, fmt.Sprintf("%s: %v", name, err))
+		} else {
+			s.failed = append(s.failed, fmt.Sprintf("%s: %v", name, err))
+		}
+		if keepGoing {
+			errorLog.Printf("%s of %s failed, continuing: %v", what, name, err)
+			return nil
+		}
+		return err
+	case skipped:
+		s.skipped++
+	default:
+		s.built++
+	}
+	return nil
+}
+
+func (s *runSummary) String() string {
+	msg := fmt.Sprintf("built %d, failed %d, skipped %d", s.built, len(s.failed), s.skipped)
+	if len(s.pushFailed) != 0 {
+		msg += fmt.Sprintf(", built but not pushed %d", len(s.pushFailed))
+	}
+	for _, f := range s.failed {
+		msg += "\n  failed: " + f
+	}
+	for _, f := range s.pushFailed {
+		msg += "\n  push failed: " + f
+	}
+	return msg
+}
+
+// failures returns the number of builds that failed, including those whose
+// push failed.
+func (s *runSummary) failures() int {
+	return len(s.failed) + len(s.pushFailed)
+}
+
+// exitCode is 0 if no build failed, exitAllBuildsFailed if no build
+// succeeded, and exitSomeBuildsFailed otherwise. Skipped builds count as
+// succeeded, builds whose push failed as failed.
+func (s *runSummary) exitCode() int {
+	switch {
+	case s.failures() == 0:
+		return 0
+	case s.built+s.skipped == 0:
+		return exitAllBuildsFailed
+	default:
+		return exitSomeBuildsFailed
+	}
+}
+
+// buildReport records what a build printed that deserves attention.
+type buildReport struct {
+	Package  string        `json:"package"`
+	Messages []dpkgMessage `json:"messages"`
+}
+
+// manifest describes the packages built by a run, for --manifest.
+type manifest struct {
+	// GitCommit is the commit of the package definitions.
+	GitCommit string          `json:"gitCommit,omitempty"`
+	Packages  []manifestEntry `json:"packages"`
+}
+
+type manifestEntry struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	Distro  string `json:"distro"`
+	Channel string `json:"channel"`
+	Arch    string `json:"arch"`
+	// Path is relative to the working directory.
+	Path     string        `json:"path"`
+	SHA256   string        `json:"sha256"`
+	Warnings []dpkgMessage `json:"warnings,omitempty"`
+}
+
+type byPath []manifestEntry
+
+func (p byPath) Len() int           { return len(p) }
+func (p byPath) Less(i, j int) bool { return p[i].Path < p[j].Path }
+func (p byPath) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// manifestFormats are the formats --manifest can be written in.
+var manifestFormats = []string{"json", "list", "csv"}
+
+func validateManifestFormat(format string) error {
+	for _, f := range manifestFormats {
+		if format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown manifest format %q, must be one of %s", format, strings.Join(manifestFormats, ", "))
+}
+
+// manifestEntries returns the entries of the packages of the build.
+func (c cfg) manifestEntries() ([]manifestEntry, error) {
+	dir := c.outputDir()
+	debs := []string{filepath.Join(dir, c.debFileName())}
+	if c.WithDbgsym {
+		files, err := c.dbgsymFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		debs = append(debs, files...)
+	}
+
+	var entries []manifestEntry
+	for _, deb := range debs {
+		sum, err := sha256File(deb)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, manifestEntry{
+			Package:  c.PackageName,
+			Version:  c.DebVersion,
+			Distro:   c.DistroName,
+			Channel:  string(c.Channel),
+			Arch:     c.DebArch,
+			Path:     filepath.ToSlash(deb),
+			SHA256:   sum,
+			Warnings: *c.messages,
+		})
+	}
+	return entries, nil
+}
+
+// write writes m in format: json, list with the path of one package per
+// line, as reprepro includedeb takes them, or csv with a header.
+func (m manifest) write(w io.Writer, format string) error {
+	sort.Sort(byPath(m.Packages))
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	case "list":
+		for _, e := range m.Packages {
+			if _, err := fmt.Fprintln(w, e.Path); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"package", "version", "distro", "channel", "arch", "path", "sha256"})
+		for _, e := range m.Packages {
+			cw.Write([]string{e.Package, e.Version, e.Distro, e.Channel, e.Arch, e.Path, e.SHA256})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return validateManifestFormat(format)
+}
+
+// loadManifest reads a manifest written in the json format.
+func loadManifest(path string) (manifest, error) {
+	var m manifest
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("%s is not a json manifest: %v", path, err)
+	}
+	return m, nil
+}
+
+// exitManifestChanged is the exit code of successful runs with
+// --compare-manifest whose packages differ from the previous manifest.
+const exitManifestChanged = 4
+
+// manifestDiff is what changed between the packages of two manifests.
+type manifestDiff struct {
+	Added, Removed []manifestEntry
+	// VersionChanges are packages built at another upstream version or
+	// epoch, RevisionBumps those built at the same one with another
+	// revision.
+	VersionChanges, RevisionBumps []manifestChange
+}
+
+type manifestChange struct {
+	From, To manifestEntry
+}
+
+// manifestKey identifies a package file of a manifest across versions: the
+// name in its file name, which differs from Package for debug symbols, and
+// where it was built for.
+type manifestKey struct {
+	name, distro, channel, arch string
+}
+
+func (e manifestEntry) key() manifestKey {
+	name := strings.SplitN(path.Base(e.Path), "_", 2)[0]
+	return manifestKey{name, e.Distro, e.Channel, e.Arch}
+}
+
+// diffManifests compares the packages of cur to those of prev.
+func diffManifests(prev, cur manifest) manifestDiff {
+	previous := map[manifestKey]manifestEntry{}
+	for _, e := range prev.Packages {
+		previous[e.key()] = e
+	}
+
+	var d manifestDiff
+	for _, e := range cur.Packages {
+		p, ok := previous[e.key()]
+		if !ok {
+			d.Added = append(d.Added, e)
+			continue
+		}
+		delete(previous, e.key())
+		if p.Version == e.Version {
+			continue
+		}
+		pEpoch, pUpstream, _ := splitDebianVersion(p.Version)
+		epoch, upstream, _ := splitDebianVersion(e.Version)
+		if pEpoch != epoch || pUpstream != upstream {
+			d.VersionChanges = append(d.VersionChanges, manifestChange{p, e})
+		} else {
+			d.RevisionBumps = append(d.RevisionBumps, manifestChange{p, e})
+		}
+	}
+	for _, e := range previous {
+		d.Removed = append(d.Removed, e)
+	}
+
+	sort.Sort(byPath(d.Added))
+	sort.Sort(byPath(d.Removed))
+	sort.Sort(byNewPath(d.VersionChanges))
+	sort.Sort(byNewPath(d.RevisionBumps))
+	return d
+}
+
+type byNewPath []manifestChange
+
+func (c byNewPath) Len() int           { return len(c) }
+func (c byNewPath) Less(i, j int) bool { return c[i].To.Path < c[j].To.Path }
+func (c byNewPath) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+func (d manifestDiff) empty() bool {
+	return len(d.Added)+len(d.Removed)+len(d.VersionChanges)+len(d.RevisionBumps) == 0
+}
+
+// write writes d for humans, one section per kind of change.
+func (d manifestDiff) write(w io.Writer) error {
+	var buf bytes.Buffer
+	if d.empty() {
+		buf.WriteString("no changes\n")
+	}
+	for _, s := range []struct {
+		title   string
+		entries []manifestEntry
+	}{
+		{"added", d.Added},
+		{"removed", d.Removed},
+	} {
+		if len(s.entries) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s:\n", s.title)
+		for _, e := range s.entries {
+			k := e.key()
+			fmt.Fprintf(&buf, "  %s %s (%s/%s/%s)\n", k.name, e.Version, k.channel, k.distro, k.arch)
+		}
+	}
+	for _, s := range []struct {
+		title   string
+		changes []manifestChange
+	}{
+		{"version changes", d.VersionChanges},
+		{"revision bumps", d.RevisionBumps},
+	} {
+		if len(s.changes) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s:\n", s.title)
+		for _, c := range s.changes {
+			k := c.To.key()
+			fmt.Fprintf(&buf, "  %s %s -> %s (%s/%s/%s)\n", k.name, c.From.Version, c.To.Version, k.channel, k.distro, k.arch)
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// dpkgWarningsError fails builds that printed warnings with
+// --warnings-as-errors.
+type dpkgWarningsError struct {
+	messages []dpkgMessage
+}
+
+func (e *dpkgWarningsError) Error() string {
+	lines := make([]string, len(e.messages))
+	for i, m := range e.messages {
+		lines[i] = m.String()
+	}
+	return fmt.Sprintf("dpkg-buildpackage printed %d warnings:\n%s", len(e.messages), strings.Join(lines, "\n"))
+}
+
+// debVersion is the version of a Debian package:
+// [epoch:]upstream-revision, where upstream is v.Version with the build
+// metadata set with --version-metadata.
+func debVersion(epoch int, v version, metadata string) (string, error) {
+	upstream, err := debianUpstreamVersion(v.Version, metadata)
+	if err != nil {
+		return "", err
+	}
+	if epoch > 0 {
+		return fmt.Sprintf("%d:%s-%s", epoch, upstream, v.Revision), nil
+	}
+	return fmt.Sprintf("%s-%s", upstream, v.Revision), nil
+}
+
+// debianUpstreamVersion appends metadata to the semver version v as build
+// metadata. As dpkg sorts "1.12.0-beta.0+job" after "1.12.0+job", the
+// pre-release is then separated with a "~", which sorts before anything,
+// e.g. 1.12.0~beta.0+job. Versions without metadata are kept as they are.
+func debianUpstreamVersion(v, metadata string) (string, error) {
+	if len(metadata) == 0 {
+		return v, nil
+	}
+	sv, err := semver.Parse(v)
+	if err != nil {
+		return "", fmt.Errorf("can't add metadata to version %q: %v", v, err)
+	}
+
+	upstream := fmt.Sprintf("%d.%d.%d", sv.Major, sv.Minor, sv.Patch)
+	if len(sv.Pre) != 0 {
+		pre := make([]string, len(sv.Pre))
+		for i, p := range sv.Pre {
+			pre[i] = p.String()
+		}
+		upstream += "~" + strings.Join(pre, ".")
+	}
+	return upstream + "+" + strings.Join(append(sv.Build, metadata), "."), nil
+}
+
+// validVersionMetadata is the character set of semver build metadata.
+var validVersionMetadata = regexp.MustCompile(`^[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*$`)
+
+func validateVersionMetadata(metadata string) error {
+	if len(metadata) != 0 && !validVersionMetadata.MatchString(metadata) {
+		return fmt.Errorf("invalid --version-metadata %q: must be dot-separated identifiers of alphanumerics and hyphens", metadata)
+	}
+	return nil
+}
+
+// validRevision is the character set Debian allows in the revision part of
+// a version; a hyphen or colon would change how dpkg splits the version.
+var validRevision = regexp.MustCompile(`^[A-Za-z0-9+.~]+$`)
+
+func validateRevision(revision string) error {
+	if !validRevision.MatchString(revision) {
+		return fmt.Errorf("invalid --revision %q: Debian revisions may only contain alphanumerics and the characters + . ~", revision)
+	}
+	return nil
+}
+
+// validStandardsVersion matches Debian policy versions, e.g. 4.7.0 or
+// 3.9.8.0.
+var validStandardsVersion = regexp.MustCompile(`^\d+\.\d+\.\d+(\.\d+)?$`)
+
+func validateStandardsVersion(v string) error {
+	if !validStandardsVersion.MatchString(v) {
+		return fmt.Errorf("invalid --standards-version %q: must be a Debian policy version like 4.7.0", v)
+	}
+	return nil
+}
+
+func validateEpoch(epoch int) error {
+	if epoch < 0 {
+		return fmt.Errorf("--epoch must not be negative, got %d", epoch)
+	}
+	return nil
+}
+
+// debFileName returns the name dpkg-buildpackage gives the package. dpkg
+// leaves the epoch out of file names.
+func (c cfg) debFileName() string {
+	v := c.DebVersion
+	if i := strings.Index(v, ":"); i >= 0 {
+		v = v[i+1:]
+	}
+	return fmt.Sprintf("%s_%s_%s.deb", c.PackageName, v, c.DebArch)
+}
+
+// writeChecksum writes the sha256 of file to <file>.sha256 in the format
+// understood by sha256sum -c.
+func writeChecksum(file string) error {
+	sum, err := sha256File(file)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(file))
+	return ioutil.WriteFile(file+".sha256", []byte(line), 0644)
+}
+
+// releaseInfo holds the fields of an APT Release file that don't depend on
+// the indexed packages.
+type releaseInfo struct {
+	Origin, Label, Suite, Codename, Components string
+}
+
+// aptIndexes are the index files of a flat APT repository that Release
+// files carry checksums of.
+var aptIndexes = []string{"Packages", "Packages.gz"}
+
+// writeAptIndex indexes the packages in dir as a flat APT repository: it
+// writes Packages with dpkg-scanpackages, compresses it to Packages.gz and
+// writes a Release file describing both.
+func writeAptIndex(ctx context.Context, dir string, info releaseInfo, now time.Time) error {
+	// dpkg-scanpackages writes the index to stdout, which runCommand
+	// forwards to ours.
+	if err := runCommand(ctx, dir, nil, nil, "sh", "-c", "dpkg-scanpackages --multiversion . /dev/null > Packages"); err != nil {
+		return fmt.Errorf("indexing %s: %v", dir, err)
+	}
+	return finishAptIndex(dir, info, now)
+}
+
+// finishAptIndex compresses the Packages index in dir and writes the
+// Release file listing it.
+func finishAptIndex(dir string, info releaseInfo, now time.Time) error {
+	if err := gzipFile(filepath.Join(dir, "Packages")); err != nil {
+		return err
+	}
+	return writeRelease(dir, info, now)
+}
+
+// packagesIndex adds packages to the Packages index of their directory as
+// they are built, so the index always matches the packages on disk. It is
+// safe for concurrent use.
+type packagesIndex struct {
+	mu sync.Mutex
+}
+
+// add indexes the package file deb, replacing any previous entry of a
+// package with the same file name.
+func (p *packagesIndex) add(ctx context.Context, deb string) error {
+	dir, name := filepath.Split(deb)
+	stanza, err := packagesStanza(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+	return p.replace(dir, name, stanza)
+}
+
+// remove drops the entry of the package file deb, e.g. once it is pruned.
+func (p *packagesIndex) remove(deb string) error {
+	dir, name := filepath.Split(deb)
+	return p.replace(dir, name, "")
+}
+
+// replace replaces the entry of the package file name in the index of dir
+// with stanza, or drops it if stanza is empty.
+func (p *packagesIndex) replace(dir, name, stanza string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	index := filepath.Join(dir, "Packages")
+	data, err := ioutil.ReadFile(index)
+	if os.IsNotExist(err) && len(stanza) == 0 {
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, s := range strings.SplitAfter(string(data), "\n\n") {
+		if len(strings.TrimSpace(s)) == 0 || strings.Contains(s, "\nFilename: ./"+name+"\n") {
+			continue
+		}
+		buf.WriteString(s)
+	}
+	buf.WriteString(stanza)
+
+	// Replace the index at once, so readers never see a partial one.
+	tmp := index + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, index)
+}
+
+// packagesStanza returns the entry of the package file name in dir in a
+// Packages index, as dpkg-scanpackages writes it.
+func packagesStanza(ctx context.Context, dir, name string) (string, error) {
+	var fields bytes.Buffer
+	if err := runCommand(ctx, dir, nil, &fields, "dpkg-deb", "--field", name); err != nil {
+		return "", fmt.Errorf("reading the control fields of %s: %v", name, err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s\nFilename: ./%s\nSize: %d\nMD5sum: %x\nSHA1: %x\nSHA256: %x\n\n",
+		strings.TrimRight(fields.String(), "\n"), name, len(data), md5.Sum(data), sha1.Sum(data), sha256.Sum256(data)), nil
+}
+
+func gzipFile(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file+".gz", buf.Bytes(), 0644)
+}
+
+// writeRelease writes the Release file of the flat APT repository in dir,
+// with the MD5 and SHA256 checksums of its aptIndexes.
+func writeRelease(dir string, info releaseInfo, now time.Time) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	archs := map[string]bool{}
+	for _, f := range files {
+		if deb, ok := parseDebFileName(f.Name()); ok {
+			archs[deb.arch] = true
+		}
+	}
+	var archList []string
+	for a := range archs {
+		archList = append(archList, a)
+	}
+	sort.Strings(archList)
+
+	var buf bytes.Buffer
+	for _, field := range []struct{ name, value string }{
+		{"Origin", info.Origin},
+		{"Label", info.Label},
+		{"Suite", info.Suite},
+		{"Codename", info.Codename},
+		{"Date", now.UTC().Format("Mon, 02 Jan 2006 15:04:05 UTC")},
+		{"Architectures", strings.Join(archList, " ")},
+		{"Components", info.Components},
+	} {
+		if len(field.value) != 0 {
+			fmt.Fprintf(&buf, "%s: %s\n", field.name, field.value)
+		}
+	}
+
+	for _, sum := range []struct {
+		field string
+		hash  func() hash.Hash
+	}{
+		{"MD5Sum", md5.New},
+		{"SHA256", sha256.New},
+	} {
+		fmt.Fprintf(&buf, "%s:\n", sum.field)
+		for _, index := range aptIndexes {
+			data, err := ioutil.ReadFile(filepath.Join(dir, index))
+			if err != nil {
+				return err
+			}
+			h := sum.hash()
+			h.Write(data)
+			fmt.Fprintf(&buf, " %s %16d %s\n", hex.EncodeToString(h.Sum(nil)), len(data), index)
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "Release"), buf.Bytes(), 0644)
+}
+
+// checkSigningKey fails unless gpg has the secret key to sign with.
+func checkSigningKey(key string) error {
+	out, err := exec.Command("gpg", "--batch", "--list-secret-keys", key).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("secret key %q is not available to gpg: %v: %s", key, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// signRelease signs the Release file in dir with key, writing both the
+// detached Release.gpg and the inline signed InRelease.
+func signRelease(ctx context.Context, dir, key string) error {
+	for _, args := range [][]string{
+		{"--armor", "--detach-sign", "--output", "Release.gpg"},
+		{"--clearsign", "--output", "InRelease"},
+	} {
+		args = append([]string{"--batch", "--yes", "--local-user", key, "--digest-algo", "SHA256"}, args...)
+		if err := runCommand(ctx, dir, nil, nil, "gpg", append(args, "Release")...); err != nil {
+			return fmt.Errorf("signing the Release file of %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// Media types of the OCI artifacts pushed with --push-oci. Every artifact
+// holds a single .deb layer and its sha256sum file.
+const (
+	ociArtifactType      = "application/vnd.kubernetes.deb.v1"
+	ociDebMediaType      = "application/vnd.debian.binary-package"
+	ociChecksumMediaType = "text/plain"
+)
+
+// pushError is returned when a package was built but couldn't be pushed, so
+// that the two kinds of failures can be told apart.
+type pushError struct {
+	ref string
+	err error
+}
+
+func (e *pushError) Error() string {
+	return fmt.Sprintf("pushing to %s: %v", e.ref, e.err)
+}
+
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// ociTag derives the tag the .deb is pushed under. Packages of the same
+// name exist for every distro, so the distro is part of the tag.
+func ociTag(distro, fileName string) string {
+	tag := invalidTagChars.ReplaceAllString(distro+"-"+strings.TrimSuffix(fileName, ".deb"), "_")
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return tag
+}
+
+// pushOCIArtifact pushes debPath and its checksum to repo with oras.
+func (c cfg) pushOCIArtifact(ctx context.Context, repo, debPath string) error {
+	dir, fileName := filepath.Split(debPath)
+	ref := fmt.Sprintf("%s:%s", repo, ociTag(c.DistroName, fileName))
+
+	return runCommand(ctx, dir, nil, nil, "oras", "push", ref,
+		"--artifact-type", ociArtifactType,
+		"--annotation", "org.opencontainers.image.title="+c.PackageName,
+		"--annotation", "org.opencontainers.image.version="+c.DebVersion,
+		"--annotation", "io.k8s.release.distro="+c.DistroName,
+		"--annotation", "io.k8s.release.channel="+string(c.Channel),
+		"--annotation", "io.k8s.release.arch="+c.DebArch,
+		fileName+":"+ociDebMediaType,
+		fileName+".sha256:"+ociChecksumMediaType,
+	)
+}
+
+// binaryURL returns the download URL of the Kubernetes binary named after the
+// package.
+func (c cfg) binaryURL() string {
+	name := c.Package
+	if c.OS == "windows" {
+		name += ".exe"
+	}
+	return fmt.Sprintf("%s/bin/%s/%s/%s", c.DownloadLinkBase, c.OS, c.Arch, name)
+}
+
+// sourceURLs returns the upstream artifacts the package is built from.
+func (c cfg) sourceURLs() []string {
+	var urls []string
+	for _, s := range c.sources() {
+		urls = append(urls, s.url)
+	}
+	return urls
+}
+
+// source is an upstream artifact of a package.
+type source struct {
+	url string
+	// binary tells apart the artifacts of a package shipping several
+	// programs, e.g. crictl of cri-tools. It is empty for the others.
+	binary string
+	// path is where debian/rules looks for the artifact, relative to the
+	// definition, before downloading it, and mode the mode it needs there.
+	path string
+	mode os.FileMode
+}
+
+// sources returns the upstream artifacts of the package. They have to be
+// kept in sync with the downloads in the debian/rules templates.
+func (c cfg) sources() []source {
+	switch c.Package {
+	case "kubectl", "kubelet", "kubeadm":
+		return []source{{url: c.binaryURL(), path: filepath.Join("usr", "bin", c.Package), mode: 0755}}
+	case "kubernetes-cni":
+		u := fmt.Sprintf("https://github.com/containernetworking/plugins/releases/download/v%s/cni-plugins-%s-v%s.tgz", c.Version, c.Arch, c.Version)
+		return []source{{url: u, path: path.Base(u), mode: 0644}}
+	case "cri-tools":
+		var sources []source
+		for _, tool := range c.Binaries {
+			u := fmt.Sprintf("https://github.com/kubernetes-incubator/cri-tools/releases/download/v%s/%s-v%s-linux-%s.tar.gz", c.Version, tool, c.Version, c.Arch)
+			sources = append(sources, source{url: u, binary: tool, path: path.Base(u), mode: 0644})
+		}
+		return sources
+	}
+	return nil
+}
+
+func sha256File(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string         `json:"name"`
+	SPDXID           string         `json:"SPDXID"`
+	VersionInfo      string         `json:"versionInfo,omitempty"`
+	PackageFileName  string         `json:"packageFileName,omitempty"`
+	DownloadLocation string         `json:"downloadLocation"`
+	FilesAnalyzed    bool           `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum `json:"checksums,omitempty"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	LicenseDeclared  string         `json:"licenseDeclared"`
+	CopyrightText    string         `json:"copyrightText"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// newSPDXDocument describes the .deb called fileName with the given sha256
+// and the upstream artifacts it was built from, with their sha256 in
+// sourceSums by URL.
+func newSPDXDocument(c cfg, fileName, sum string, sourceSums map[string]string, created time.Time) spdxDocument {
+	debID := "SPDXRef-Package-" + c.PackageName
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.2",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              fileName,
+		DocumentNamespace: fmt.Sprintf("https://dl.k8s.io/spdx/%s-%s", fileName, sum),
+		CreationInfo: spdxCreationInfo{
+			Created:  created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: k8s.io/release/debian"},
+		},
+		Packages: []spdxPackage{
+			{
+				Name:             c.PackageName,
+				SPDXID:           debID,
+				VersionInfo:      c.DebVersion,
+				PackageFileName:  fileName,
+				DownloadLocation: "NOASSERTION",
+				Checksums:        []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: sum}},
+				LicenseConcluded: "Apache-2.0",
+				LicenseDeclared:  "Apache-2.0",
+				CopyrightText:    "NOASSERTION",
+			},
+		},
+		Relationships: []spdxRelationship{
+			{
+				SPDXElementID:      "SPDXRef-DOCUMENT",
+				RelationshipType:   "DESCRIBES",
+				RelatedSPDXElement: debID,
+			},
+		},
+	}
+
+	for i, u := range c.sourceURLs() {
+		srcID := fmt.Sprintf("SPDXRef-Source-%d", i)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:             path.Base(u),
+			SPDXID:           srcID,
+			VersionInfo:      c.Version,
+			DownloadLocation: u,
+			Checksums:        []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: sourceSums[u]}},
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      debID,
+			RelationshipType:   "GENERATED_FROM",
+			RelatedSPDXElement: srcID,
+		})
+	}
+	return doc
+}
+
+// sourceChecksums returns the sha256 of the upstream artifacts of the
+// package by URL: those of the binaries staged from --binaries-manifest, or
+// the published ones.
+func (c cfg) sourceChecksums(ctx context.Context) (map[string]string, error) {
+	sums := map[string]string{}
+	for _, s := range c.sources() {
+		var err error
+		if binaries != nil {
+			var path string
+			if path, err = binaries.lookup(c.Package, s.binary, c.Version, c.OS, c.Arch); err == nil {
+				sums[s.url], err = sha256File(path)
+			}
+		} else {
+			sums[s.url], err = fetchChecksum(ctx, s.url+".sha256")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error getting the checksum of %s: %v", s.url, err)
+		}
+	}
+	return sums, nil
+}
+
+// writeSBOM writes an SPDX document for debPath to <debPath>.spdx.json.
+func (c cfg) writeSBOM(ctx context.Context, debPath string) error {
+	sum, err := sha256File(debPath)
+	if err != nil {
+		return err
+	}
+	sourceSums, err := c.sourceChecksums(ctx)
+	if err != nil {
+		return err
+	}
+
+	doc := newSPDXDocument(c, filepath.Base(debPath), sum, sourceSums, c.now())
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(debPath+".spdx.json", data, 0644)
+}
+
+// provenanceStatement is an in-toto statement of SLSA provenance, see
+// https://slsa.dev/provenance/v0.2.
+type provenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []provenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     provenancePredicate `json:"predicate"`
+}
+
+type provenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type provenancePredicate struct {
+	Builder    provenanceBuilder    `json:"builder"`
+	BuildType  string               `json:"buildType"`
+	Invocation provenanceInvocation `json:"invocation"`
+	Metadata   provenanceMetadata   `json:"metadata"`
+	Materials  []provenanceMaterial `json:"materials"`
+}
+
+type provenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+type provenanceInvocation struct {
+	ConfigSource provenanceConfigSource `json:"configSource"`
+	Parameters   map[string]string      `json:"parameters"`
+}
+
+type provenanceConfigSource struct {
+	URI        string            `json:"uri"`
+	Digest     map[string]string `json:"digest,omitempty"`
+	EntryPoint string            `json:"entryPoint"`
+}
+
+type provenanceMetadata struct {
+	BuildStartedOn  string `json:"buildStartedOn"`
+	BuildFinishedOn string `json:"buildFinishedOn"`
+	Reproducible    bool   `json:"reproducible"`
+}
+
+type provenanceMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+const (
+	provenanceBuilderID = "https://k8s.io/release/debian"
+	provenanceBuildType = "https://k8s.io/release/debian/build@v1"
+)
+
+// secretFlags are the flags provenance never records the values of.
+var secretFlags = map[string]bool{
+	"github-token":       true,
+	"version-auth-token": true,
+	"version-auth-basic": true,
+}
+
+// invocationFlags returns the flags set on the command line of fs, with the
+// values of secretFlags redacted.
+func invocationFlags(fs *flag.FlagSet) map[string]string {
+	flags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		if secretFlags[f.Name] {
+			flags[f.Name] = "<redacted>"
+			return
+		}
+		flags[f.Name] = f.Value.String()
+	})
+	return flags
+}
+
+// newProvenance describes how the .deb called fileName with the given
+// sha256 was built by c, with the command line flags, between started and
+// finished.
+func newProvenance(c cfg, fileName, sum string, flags map[string]string, started, finished time.Time) provenanceStatement {
+	params := map[string]string{
+		"package":          c.PackageName,
+		"version":          c.Version,
+		"debVersion":       c.DebVersion,
+		"revision":         c.Revision,
+		"channel":          string(c.Channel),
+		"distro":           c.DistroName,
+		"os":               c.OS,
+		"arch":             c.Arch,
+		"downloadLinkBase": c.DownloadLinkBase,
+	}
+	for name, value := range flags {
+		params["flag:"+name] = value
+	}
+
+	source := provenanceConfigSource{
+		URI:        "git+https://github.com/kubernetes/release",
+		EntryPoint: path.Join("debian", c.DistroName, c.Package),
+	}
+	if len(c.GitCommit) != 0 {
+		source.Digest = map[string]string{"sha1": c.GitCommit}
+	}
+
+	var materials []provenanceMaterial
+	if len(c.GitCommit) != 0 {
+		materials = append(materials, provenanceMaterial{URI: source.URI, Digest: source.Digest})
+	}
+	for _, url := range c.sourceURLs() {
+		materials = append(materials, provenanceMaterial{URI: url})
+	}
+
+	return provenanceStatement{
+		Type:          "https://in-toto.io/Statement/v0.1",
+		Subject:       []provenanceSubject{{Name: fileName, Digest: map[string]string{"sha256": sum}}},
+		PredicateType: "https://slsa.dev/provenance/v0.2",
+		Predicate: provenancePredicate{
+			Builder:   provenanceBuilder{ID: provenanceBuilderID},
+			BuildType: provenanceBuildType,
+			Invocation: provenanceInvocation{
+				ConfigSource: source,
+				Parameters:   params,
+			},
+			Metadata: provenanceMetadata{
+				BuildStartedOn:  started.UTC().Format(time.RFC3339),
+				BuildFinishedOn: finished.UTC().Format(time.RFC3339),
+			},
+			Materials: materials,
+		},
+	}
+}
+
+// writeProvenance writes the SLSA provenance of debPath, built until
+// finished, to <debPath>.intoto.json.
+func (c cfg) writeProvenance(debPath string, finished time.Time) error {
+	sum, err := sha256File(debPath)
+	if err != nil {
+		return err
+	}
+
+	doc := newProvenance(c, filepath.Base(debPath), sum, invocationFlags(flag.CommandLine), c.started, finished)
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(debPath+".intoto.json", data, 0644)
+}
+
+// outputDir returns the directory the package is written to,
+// bin/<channel>[/<component>]/<distro>[/<arch>]. Packages
+// wrapping non-linux binaries go to a per-OS subdirectory so that they don't
+// collide with the linux packages of the same name.
+func (c cfg) outputDir() string {
+	return c.publishedDirs()[0]
+}
+
+// publishedDirs returns the directories the package is published to, its
+// outputDir first. With --per-arch-dirs, packages of Architecture all are in
+// the directory of every architecture they are built for, so that the
+// index of each lists them.
+func (c cfg) publishedDirs() []string {
+	if c.DebArch != "all" || !*perArchDirs || packageFormat(*format) != formatDeb {
+		return []string{c.archDir(c.DebArch)}
+	}
+	var dirs []string
+	for _, a := range architectures {
+		if validatePlatform(c.OS, a, c.Package) == nil {
+			dirs = append(dirs, c.archDir(getDebArch(a)))
+		}
+	}
+	if len(dirs) == 0 {
+		return []string{c.archDir(c.DebArch)}
+	}
+	return dirs
+}
+
+// archDir returns the output directory of the packages of debArch.
+func (c cfg) archDir(debArch string) string {
+	dstParts := []string{"bin", string(c.Channel)}
+	if len(*component) != 0 {
+		dstParts = append(dstParts, *component)
+	}
+	dstParts = append(dstParts, c.DistroName)
+	if c.OS != "linux" {
+		dstParts = append(dstParts, c.OS)
+	}
+	// Alpine packages are always split by architecture, see buildAPK.
+	if *perArchDirs && packageFormat(*format) == formatDeb {
+		dstParts = append(dstParts, debArch)
+	}
+	return filepath.Join(dstParts...)
+}
+
+// validComponent matches the component names accepted in APT repositories.
+var validComponent = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]*$`)
+
+func validateComponent(name string) error {
+	if len(name) != 0 && !validComponent.MatchString(name) {
+		return fmt.Errorf("invalid component %q: must consist of lowercase letters, digits, '+', '-' and '.'", name)
+	}
+	return nil
+}
+
+// buildAPK runs abuild against the rendered APKBUILD in dstdir and moves the
+// resulting packages to bin/<channel>/alpine/<arch>.
+func (c cfg) buildAPK(ctx context.Context, dstdir string) error {
+	repoDest := filepath.Join(dstdir, "packages")
+	env := []string{"CARCH=" + c.ApkArch, "REPODEST=" + repoDest}
+
+	if err := runCommand(ctx, dstdir, env, nil, "abuild", "-F", "checksum"); err != nil {
+		return err
+	}
+	if err := runCommand(ctx, dstdir, env, nil, "abuild", "-F", "-d"); err != nil {
+		return err
+	}
+
+	dstPath := filepath.Join(c.outputDir(), c.ApkArch)
+	os.MkdirAll(dstPath, 0777)
+
+	apks, err := filepath.Glob(filepath.Join(repoDest, "*", c.ApkArch, "*.apk"))
+	if err != nil {
+		return err
+	}
+	if len(apks) == 0 {
+		return fmt.Errorf("abuild produced no packages for %s", c.Package)
+	}
+	for _, apk := range apks {
+		if err := runCommand(ctx, "", nil, nil, "mv", apk, dstPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// debFile is a .deb named <package>_<version>-<revision>_<arch>.deb. The
+// version may carry an epoch, which some tools write as "1:" and others
+// escape as "1%3a"; both are parsed into "1:".
+type debFile struct {
+	name                         string
+	pkg, version, revision, arch string
+}
+
+func parseDebFileName(name string) (debFile, bool) {
+	base := strings.TrimSuffix(name, ".deb")
+	if base == name {
+		return debFile{}, false
+	}
+
+	first, last := strings.Index(base, "_"), strings.LastIndex(base, "_")
+	if first <= 0 || first == last {
+		return debFile{}, false
+	}
+	versionRevision := base[first+1 : last]
+	if i := strings.Index(strings.ToLower(versionRevision), "%3a"); i > 0 {
+		versionRevision = versionRevision[:i] + ":" + versionRevision[i+3:]
+	}
+	if i := strings.Index(versionRevision, ":"); i >= 0 {
+		if _, err := strconv.ParseUint(versionRevision[:i], 10, 32); err != nil {
+			return debFile{}, false
+		}
+	}
+	dash := strings.LastIndex(versionRevision, "-")
+	if dash <= 0 {
+		return debFile{}, false
+	}
+
+	return debFile{
+		name:     name,
+		pkg:      base[:first],
+		version:  versionRevision[:dash],
+		revision: versionRevision[dash+1:],
+		arch:     base[last+1:],
+	}, true
+}
+
+// revisionLess orders revisions numerically when both are numbers, so that
+// 10 sorts after 09, and lexically otherwise.
+func revisionLess(a, b string) bool {
+	na, errA := strconv.ParseUint(a, 10, 64)
+	nb, errB := strconv.ParseUint(b, 10, 64)
+	if errA == nil && errB == nil {
+		return na < nb
+	}
+	return a < b
+}
+
+type byRevisionDesc []debFile
+
+func (d byRevisionDesc) Len() int           { return len(d) }
+func (d byRevisionDesc) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byRevisionDesc) Less(i, j int) bool { return revisionLess(d[j].revision, d[i].revision) }
+
+// selectPrunable returns the .deb files that aren't among the keep newest
+// revisions of their package, version and architecture. Files that don't
+// look like packages are never selected.
+func selectPrunable(files []string, keep int) []string {
+	groups := map[string][]debFile{}
+	var keys []string
+	for _, f := range files {
+		deb, ok := parseDebFileName(f)
+		if !ok {
+			continue
+		}
+		key := deb.pkg + "_" + deb.version + "_" + deb.arch
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], deb)
+	}
+
+	var prunable []string
+	for _, key := range keys {
+		debs := groups[key]
+		if len(debs) <= keep {
+			continue
+		}
+		sort.Sort(byRevisionDesc(debs))
+		for _, deb := range debs[keep:] {
+			prunable = append(prunable, deb.name)
+		}
+	}
+	return prunable
+}
+
+// pruneRevisions applies selectPrunable to every directory below root and
+// deletes the selected packages together with their sidecar files (e.g.
+// <package>.deb.spdx.json). It returns the paths of the deleted packages.
+func pruneRevisions(root string, keep int) ([]string, error) {
+	var pruned []string
+	var dirs []string
+	if err := filepath.Walk(root, func(dir string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			dirs = append(dirs, dir)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, e := range entries {
+			if !e.IsDir() {
+				files = append(files, e.Name())
+			}
+		}
+
+		for _, deb := range selectPrunable(files, keep) {
+			for _, name := range files {
+				if name == deb || strings.HasPrefix(name, deb+".") {
+					log.Printf("pruning %s", filepath.Join(dir, name))
+					if err := os.Remove(filepath.Join(dir, name)); err != nil {
+						return nil, err
+					}
+				}
+			}
+			pruned = append(pruned, filepath.Join(dir, deb))
+		}
+	}
+	return pruned, nil
+}
+
+// stateEntry identifies a completed build in the state file.
+type stateEntry struct {
+	Package string      `json:"package"`
+	Distro  string      `json:"distro"`
+	OS      string      `json:"os"`
+	Arch    string      `json:"arch"`
+	Channel ChannelType `json:"channel"`
+	// DebVersion changes with the version, the revision, --epoch and
+	// --version-metadata, all of which make another package.
+	DebVersion string `json:"debVersion"`
+}
+
+func (c cfg) stateEntry() stateEntry {
+	return stateEntry{
+		Package:    c.PackageName,
+		Distro:     c.DistroName,
+		OS:         c.OS,
+		Arch:       c.Arch,
+		Channel:    c.Channel,
+		DebVersion: c.DebVersion,
+	}
+}
+
+// buildState records the builds that completed in a JSON lines file, so
+// that an interrupted run can be resumed with --resume.
+type buildState struct {
+	path      string
+	mu        sync.Mutex
+	completed map[stateEntry]bool
+}
+
+// loadBuildState opens the state file at path. Unless resume is set, or if
+// the file is missing or corrupt, it starts over with no completed builds.
+func loadBuildState(path string, resume bool) (*buildState, error) {
+	var entries []stateEntry
+	if resume {
+		data, err := ioutil.ReadFile(path)
+		switch {
+		case os.IsNotExist(err):
+			log.Printf("state file %s doesn't exist, building everything", path)
+		case err != nil:
+			return nil, err
+		default:
+			if entries, err = parseBuildState(data); err != nil {
+				log.Printf("state file %s is corrupt, building everything: %v", path, err)
+				entries = nil
+			} else {
+				log.Printf("resuming with %d completed builds from %s", len(entries), path)
+			}
+		}
+	}
+
+	// Rewrite the file so that new entries aren't appended to a truncated
+	// or corrupt line.
+	var buf bytes.Buffer
+	s := &buildState{path: path, completed: map[stateEntry]bool{}}
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(append(line, '\n'))
+		s.completed[e] = true
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parseBuildState(data []byte) ([]stateEntry, error) {
+	var entries []stateEntry
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		var e stateEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			if i == len(lines)-1 {
+				// A run killed while recording a build leaves a
+				// truncated last line; that build has to be redone.
+				break
+			}
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// done reports whether the build of e completed in a previous run.
+func (s *buildState) done(e stateEntry) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.completed[e]
+}
+
+// record appends e to the state file.
+func (s *buildState) record(e stateEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.completed[e] = true
+	return nil
+}
+
+// detectContainerRuntime returns preferred if it is set and available, or
+// the first of docker and podman found in PATH.
+func detectContainerRuntime(preferred string) (string, error) {
+	candidates := []string{"docker", "podman"}
+	if len(preferred) != 0 {
+		candidates = []string{preferred}
+	}
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c); err == nil {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("none of %s found in PATH", strings.Join(candidates, ", "))
+}
+
+// distroImage returns the container image of the official release of
+// distro.
+func distroImage(distro string) (string, error) {
+	switch distro {
+	case "precise", "trusty", "utopic", "vivid", "wily", "xenial", "yakkety", "bionic", "focal", "jammy":
+		return "ubuntu:" + distro, nil
+	case "wheezy", "jessie", "stretch", "buster", "bullseye", "bookworm", "sid":
+		return "debian:" + distro, nil
+	}
+	return "", fmt.Errorf("no container image known for distro %q", distro)
+}
+
+// smokeTestImages returns the container images the packages of each of
+// distros are smoke tested in: the official image of the distro, or the
+// one named by rendering text with the DistroName and DistroVersion of the
+// distro.
+func smokeTestImages(text string, distros []string) (map[string]string, error) {
+	images := map[string]string{}
+	if len(text) == 0 {
+		for _, distro := range distros {
+			image, err := distroImage(distro)
+			if err != nil {
+				return nil, err
+			}
+			images[distro] = image
+		}
+		return images, nil
+	}
+
+	t, err := template.New("image").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, distro := range distros {
+		version := distroVersions[distro]
+		if len(version) == 0 && templateUsesField(t.Tree.Root, "DistroVersion") {
+			return nil, fmt.Errorf("image template uses .DistroVersion, but the version of distro %q is unknown", distro)
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, map[string]string{"DistroName": distro, "DistroVersion": version}); err != nil {
+			return nil, err
+		}
+		image := strings.TrimSpace(buf.String())
+		if len(image) == 0 {
+			return nil, fmt.Errorf("image template renders to nothing for distro %q", distro)
+		}
+		images[distro] = image
+	}
+	return images, nil
+}
+
+// distroVersions maps the codenames of the distros to their release numbers.
+// Debian sid has none, as it is never released.
+var distroVersions = map[string]string{
+	"precise":  "12.04",
+	"trusty":   "14.04",
+	"utopic":   "14.10",
+	"vivid":    "15.04",
+	"wily":     "15.10",
+	"xenial":   "16.04",
+	"yakkety":  "16.10",
+	"bionic":   "18.04",
+	"focal":    "20.04",
+	"jammy":    "22.04",
+	"wheezy":   "7",
+	"jessie":   "8",
+	"stretch":  "9",
+	"buster":   "10",
+	"bullseye": "11",
+	"bookworm": "12",
+}
+
+// smokeTests collects the packages built for the host architecture, grouped
+// by output directory, so that each group can be installed together in a
+// container of its distro.
+type smokeTests map[string]*smokeTestGroup
+
+type smokeTestGroup struct {
+	distro   string
+	packages []string
+	files    []string
+}
+
+func (s smokeTests) add(c cfg) {
+	if c.OS != "linux" || c.DebArch != getDebArch(hostArch) {
+		log.Printf("not smoke testing %s for %s/%s, which can't run on this host", c.PackageName, c.OS, c.Arch)
+		return
+	}
+	dir := c.outputDir()
+	g, ok := s[dir]
+	if !ok {
+		g = &smokeTestGroup{distro: c.DistroName}
+		s[dir] = g
+	}
+	g.packages = append(g.packages, c.PackageName)
+	g.files = append(g.files, c.debFileName())
+}
+
+// run installs every group in a fresh container of the image of its distro
+// and reports the groups that failed to install.
+func (s smokeTests) run(ctx context.Context, engine string, images map[string]string) error {
+	var dirs []string
+	for dir := range s {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var failed []string
+	for _, dir := range dirs {
+		if err := s[dir].run(ctx, engine, images[s[dir].distro], dir); err != nil {
+			errorLog.Printf("smoke test of %s failed: %v", dir, err)
+			failed = append(failed, dir)
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("packages in %s failed to install", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (g *smokeTestGroup) run(ctx context.Context, engine, image, dir string) error {
+	if len(image) == 0 {
+		return fmt.Errorf("no container image to smoke test distro %q in", g.distro)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	var debs []string
+	for _, f := range g.files {
+		debs = append(debs, "/packages/"+f)
+	}
+	// dpkg -i fails on dependencies outside the group, which apt-get then
+	// pulls in from the distro archive.
+	script := fmt.Sprintf("apt-get update -qq && { dpkg -i %s || apt-get install -f -y -qq; } && dpkg -s %s >/dev/null",
+		strings.Join(debs, " "), strings.Join(g.packages, " "))
+
+	return runCommand(ctx, "", nil, nil, engine, "run", "--rm",
+		"-e", "DEBIAN_FRONTEND=noninteractive",
+		"-v", absDir+":/packages:ro",
+		image, "sh", "-c", script)
+}
+
+// publishedPlatforms lists the os/arch combinations dl.k8s.io publishes
+// binaries for. Only kubectl is published for operating systems other than
+// linux.
+var publishedPlatforms = map[string][]string{
+	"linux":   {"amd64", "arm", "arm64", "ppc64le", "s390x"},
+	"darwin":  {"amd64"},
+	"windows": {"amd64", "386"},
+}
+
+// validatePlatform returns an error if there are no binaries of pkg
+// published for osName/arch.
+func validatePlatform(osName, arch, pkg string) error {
+	arches, ok := publishedPlatforms[osName]
+	if !ok {
+		return fmt.Errorf("unsupported operating system %q", osName)
+	}
+	if osName != "linux" && pkg != "kubectl" {
+		return fmt.Errorf("%s is only published for linux", pkg)
+	}
+	for _, a := range arches {
+		if a == arch {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s binaries are not published for %s/%s", pkg, osName, arch)
+}
+
+func walkBuilds(builds []build, f func(b build, distro, osName, arch string, v version) error) error {
+	// Architecture independent packages are only built for the first
+	// platform --filter keeps them for.
+	walked := map[string]bool{}
+	for _, o := range operatingSystems {
+		for _, a := range architectures {
+			if err := walkArchBuilds(builds, o, a, func(b build, distro, osName, arch string, v version) error {
+				if b.ArchIndependent {
+					key := strings.Join([]string{b.Package, distro, string(v.Channel), v.Version}, "/")
+					if walked[key] {
+						return nil
+					}
+					walked[key] = true
+				}
+				return f(b, distro, osName, arch, v)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// packageSizes are rough upper bounds of the size of the packages, used to
+// estimate the disk space a run needs.
+var packageSizes = map[string]uint64{
+	"kubectl":        60 << 20,
+	"kubelet":        120 << 20,
+	"kubeadm":        60 << 20,
+	"kubernetes-cni": 40 << 20,
+	"cri-tools":      40 << 20,
+	"kubernetes":     1 << 20,
+}
+
+// defaultPackageSize is the estimate for packages missing in packageSizes.
+const defaultPackageSize = 100 << 20
+
+// estimateDiskSpace returns the space the packages of tasks take in the
+// output directory, and the space up to jobs builds take at once in the
+// temporary directory, where a package exists about three times: as the
+// downloaded binary, staged, and packaged.
+func estimateDiskSpace(tasks []buildTask, jobs int) (output, temp uint64) {
+	var largest uint64
+	for _, t := range tasks {
+		size, ok := packageSizes[t.build.Package]
+		if !ok {
+			size = defaultPackageSize
+		}
+		output += size
+		if size > largest {
+			largest = size
+		}
+	}
+	n := uint64(jobs)
+	if n > uint64(len(tasks)) {
+		n = uint64(len(tasks))
+	}
+	return output, 3 * largest * n
+}
+
+// statfs returns the space available to unprivileged users on the file
+// system of path. It is a variable so tests can replace it with a fake.
+var statfs = func(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// checkDiskSpace fails if the file systems of outputDir and tempDir have
+// less space available than tasks are estimated to need, or than minFree
+// if set, and warns if they have less than twice as much.
+func checkDiskSpace(tasks []buildTask, jobs int, outputDir, tempDir, minFree string) error {
+	output, temp := estimateDiskSpace(tasks, jobs)
+	if len(minFree) != 0 {
+		n, err := parseSize(minFree)
+		if err != nil {
+			return fmt.Errorf("invalid --min-free-space: %v", err)
+		}
+		output, temp = n, n
+	}
+
+	for _, fs := range []struct {
+		what, dir string
+		need      uint64
+	}{
+		{"output", outputDir, output},
+		{"temporary", tempDir, temp},
+	} {
+		if fs.need == 0 {
+			continue
+		}
+		// The output directory may not have been created yet.
+		dir := fs.dir
+		for {
+			if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+		free, err := statfs(dir)
+		if err != nil {
+			return fmt.Errorf("checking the free space of %s: %v", dir, err)
+		}
+		switch {
+		case free < fs.need:
+			return fmt.Errorf("%s has %s free, but the %s files need about %s; free up space, or override the estimate with --min-free-space", dir, formatSize(free), fs.what, formatSize(fs.need))
+		case free < 2*fs.need:
+			log.Printf("warning: %s has %s free, which is tight for the %s files that need about %s", dir, formatSize(free), fs.what, formatSize(fs.need))
+		}
+	}
+	return nil
+}
+
+var sizeUnits = []string{"K", "M", "G", "T"}
+
+// parseSize parses a number of bytes with an optional binary unit suffix,
+// e.g. 512M or 10G.
+func parseSize(s string) (uint64, error) {
+	// Accept 10G, 10GB and 10GiB alike.
+	num, shift := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I"), uint(0)
+	for i, u := range sizeUnits {
+		if strings.HasSuffix(num, u) {
+			num = strings.TrimSuffix(num, u)
+			shift = 10 * uint(i+1)
+			break
+		}
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a size like 512M or 10G", s)
+	}
+	return n << shift, nil
+}
+
+// formatSize formats n bytes with the largest binary unit it has one of.
+func formatSize(n uint64) string {
+	unit, value := "B", float64(n)
+	for _, u := range sizeUnits {
+		if value < 1024 {
+			break
+		}
+		unit, value = u+"iB", value/1024
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + unit
+}
+
+// buildTask is a build of the matrix walked by walkBuilds.
+type buildTask struct {
+	build   build
+	distro  string
+	os      string
+	arch    string
+	version version
+}
+
+// buildScheduler runs up to jobs builds at a time, and up to perArch of them
+// for the same architecture if perArch is positive, so that builds for an
+// architecture whose emulation is saturated leave room for the others.
+type buildScheduler struct {
+	jobs, perArch int
+}
+
+// run runs f for all tasks, in order as far as the limits allow. After a
+// task failed, no other is started, and the first error is returned.
+func (s buildScheduler) run(tasks []buildTask, f func(buildTask) error) error {
+	var (
+		mu       sync.Mutex
+		cond     = sync.NewCond(&mu)
+		pending  = tasks
+		running  = map[string]int{}
+		firstErr error
+	)
+	// next returns the first pending task of an architecture with a free
+	// slot, waiting for one if there is none.
+	next := func() (buildTask, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		for len(pending) != 0 && firstErr == nil {
+			for i, t := range pending {
+				if s.perArch <= 0 || running[t.arch] < s.perArch {
+					pending = append(pending[:i:i], pending[i+1:]...)
+					running[t.arch]++
+					return t, true
+				}
+			}
+			cond.Wait()
+		}
+		return buildTask{}, false
+	}
+
+	jobs := s.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				t, ok := next()
+				if !ok {
+					return
+				}
+				err := f(t)
+
+				mu.Lock()
+				running[t.arch]--
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				cond.Broadcast()
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func walkArchBuilds(builds []build, osName, a string, f func(b build, distro, osName, arch string, v version) error) error {
+	for _, b := range builds {
+		if err := validatePlatform(osName, a, b.Package); err != nil {
+			log.Printf("skipping %s for %s/%s: %v", b.Package, osName, a, err)
+			continue
+		}
+		for _, d := range b.Distros {
+			for _, v := range b.Versions {
+				// Populate the version if it doesn't exist
+				if len(v.Version) == 0 && v.GetVersion != nil {
+					var err error
+					v.Version, err = v.GetVersion()
+					if err != nil {
+						return err
+					}
+				}
+
+				// Populate the version if it doesn't exist
+				if len(v.DownloadLinkBase) == 0 && v.GetDownloadLinkBase != nil {
+					var err error
+					v.DownloadLinkBase, err = v.GetDownloadLinkBase(v)
+					if err != nil {
+						return err
+					}
+				}
+
+				if buildFilter != nil && !buildFilter.match(map[string]string{
+					"package": b.Package,
+					"distro":  d,
+					"os":      osName,
+					"arch":    a,
+					"channel": string(v.Channel),
+					"version": v.Version,
+				}) {
+					continue
+				}
+
+				if err := f(b, d, osName, a, v); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// buildFilter selects the builds walkBuilds visits. It's set with --filter;
+// nil selects all builds.
+var buildFilter filterExpr
+
+// filterExpr is a parsed --filter expression. The grammar is:
+//
+//	expr       = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" expr ")" | comparison
+//	comparison = field ( "==" | "!=" ) value
+//	field      = "package" | "distro" | "os" | "arch" | "channel" | "version"
+//
+// Values are either bare words of letters, digits and ._+~:- or double
+// quoted strings. ! binds tightest, then &&, then ||, e.g.
+//
+//	channel==stable && arch==arm64 && distro!=trusty
+type filterExpr interface {
+	match(fields map[string]string) bool
+}
+
+var filterFields = map[string]bool{
+	"package": true,
+	"distro":  true,
+	"os":      true,
+	"arch":    true,
+	"channel": true,
+	"version": true,
+}
+
+type filterOr struct{ left, right filterExpr }
+
+func (e filterOr) match(f map[string]string) bool { return e.left.match(f) || e.right.match(f) }
+
+type filterAnd struct{ left, right filterExpr }
+
+func (e filterAnd) match(f map[string]string) bool { return e.left.match(f) && e.right.match(f) }
+
+type filterNot struct{ expr filterExpr }
+
+func (e filterNot) match(f map[string]string) bool { return !e.expr.match(f) }
+
+type filterComparison struct {
+	field, value string
+	equal        bool
+}
+
+func (e filterComparison) match(f map[string]string) bool { return (f[e.field] == e.value) == e.equal }
+
+// parseFilter parses a --filter expression.
+func parseFilter(s string) (filterExpr, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos].text)
+	}
+	return expr, nil
+}
+
+type filterToken struct {
+	text string
+	// word is set for field names and values, as opposed to operators.
+	word bool
+}
+
+func tokenizeFilter(s string) ([]filterToken, error) {
+	isWordChar := func(c byte) bool {
+		return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("._+~:-", c) >= 0
+	}
+
+	var tokens []filterToken
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.HasPrefix(s[i:], "&&"), strings.HasPrefix(s[i:], "||"),
+			strings.HasPrefix(s[i:], "=="), strings.HasPrefix(s[i:], "!="):
+			tokens = append(tokens, filterToken{text: s[i : i+2]})
+			i += 2
+		case c == '!' || c == '(' || c == ')':
+			tokens = append(tokens, filterToken{text: s[i : i+1]})
+			i++
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string in filter at offset %d", i)
+			}
+			tokens = append(tokens, filterToken{text: s[i+1 : i+1+end], word: true})
+			i += end + 2
+		case isWordChar(c):
+			j := i
+			for j < len(s) && isWordChar(s[j]) {
+				j++
+			}
+			tokens = append(tokens, filterToken{text: s[i:j], word: true})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q in filter at offset %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// accept consumes the next token if it is the operator op.
+func (p *filterParser) accept(op string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].word && p.tokens[p.pos].text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterExpr, error) {
+	if p.accept("!") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{expr}, nil
+	}
+	if p.accept("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterExpr, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+	field := p.tokens[p.pos]
+	if !field.word {
+		return nil, fmt.Errorf("expected a field in filter, got %q", field.text)
+	}
+	if !filterFields[field.text] {
+		return nil, fmt.Errorf("unknown field %q in filter", field.text)
+	}
+	p.pos++
+
+	var equal bool
+	switch {
+	case p.accept("=="):
+		equal = true
+	case p.accept("!="):
+	default:
+		return nil, fmt.Errorf("expected == or != after %s in filter", field.text)
+	}
+
+	if p.pos >= len(p.tokens) || !p.tokens[p.pos].word {
+		return nil, fmt.Errorf("expected a value to compare %s with in filter", field.text)
+	}
+	value := p.tokens[p.pos].text
+	p.pos++
+	return filterComparison{field: field.text, value: value, equal: equal}, nil
+}
+
+// hostArch is the architecture of the machine building the packages.
+var hostArch = runtime.GOARCH
+
+// nativeArchitectures restricts archs to the one of the host. It's an error
+// if the host architecture isn't among them.
+func nativeArchitectures(archs stringList, host string) (stringList, error) {
+	for _, a := range archs {
+		if a == host {
+			return stringList{a}, nil
+		}
+	}
+	return nil, fmt.Errorf("host architecture %s (%s) is not one of the architectures to build: %s", host, getDebArch(host), archs.String())
+}
+
+// binfmtDir is where binfmt_misc lists the registered interpreters.
+var binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// qemuInterpreters maps an architecture to the binfmt_misc entry
+// qemu-user-static registers for it.
+var qemuInterpreters = map[string]string{
+	"386":     "qemu-i386",
+	"amd64":   "qemu-x86_64",
+	"arm":     "qemu-arm",
+	"arm64":   "qemu-aarch64",
+	"ppc64le": "qemu-ppc64le",
+	"s390x":   "qemu-s390x",
+}
+
+// checkBinfmt fails unless binfmt_misc in dir can run binaries of all the
+// archs other than host, which dpkg-buildpackage needs to cross-build them.
+func checkBinfmt(dir string, archs stringList, host string) error {
+	var foreign []string
+	for _, a := range archs {
+		if a != host {
+			foreign = append(foreign, a)
+		}
+	}
+	if len(foreign) == 0 {
+		return nil
+	}
+	if !binfmtEnabled(filepath.Join(dir, "status")) {
+		return fmt.Errorf("binfmt_misc is not enabled in %s, which is needed to build for %s; mount it with: mount -t binfmt_misc binfmt_misc %s", dir, strings.Join(foreign, ", "), dir)
+	}
+	var missing []string
+	for _, a := range foreign {
+		name, ok := qemuInterpreters[a]
+		if !ok {
+			return fmt.Errorf("no known qemu interpreter for architecture %s", a)
+		}
+		if !binfmtEnabled(filepath.Join(dir, name)) {
+			missing = append(missing, fmt.Sprintf("%s (%s)", a, name))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no binfmt_misc handler is registered for %s; install qemu-user-static (apt-get install qemu-user-static binfmt-support) or register the handlers with: docker run --privileged --rm tonistiigi/binfmt --install all", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// binfmtEnabled tells whether the binfmt_misc entry at path exists and is
+// enabled.
+func binfmtEnabled(path string) bool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	lines := strings.SplitN(string(data), "\n", 2)
+	return strings.TrimSpace(lines[0]) == "enabled"
+}
+
+// getDebArch maps a Kubernetes architecture to the name Debian uses for it.
+func getDebArch(arch string) string {
+	switch arch {
+	case "386":
+		return "i386"
+	case "arm":
+		return "armhf"
+	case "ppc64le":
+		return "ppc64el"
+	}
+	return arch
+}
+
+// apkBuilds restricts builds to the packages that have an Alpine definition
+// and retargets them at the alpine "distro".
+func apkBuilds(builds []build) []build {
+	var apk []build
+	for _, b := range builds {
+		if _, err := os.Stat(filepath.Join("alpine", b.Package)); err != nil {
+			continue
+		}
+		b.Distros = []string{"alpine"}
+		apk = append(apk, b)
+	}
+	return apk
+}
+
+// getApkArch maps a Kubernetes architecture to the name Alpine uses for it.
+func getApkArch(arch string) (string, error) {
+	switch arch {
+	case "amd64":
+		return "x86_64", nil
+	case "arm":
+		return "armhf", nil
+	case "arm64":
+		return "aarch64", nil
+	case "ppc64le", "s390x":
+		return arch, nil
+	}
+	return "", fmt.Errorf("architecture %q is not supported by alpine", arch)
+}
+
+// getApkVersion converts a semver version into an apk pkgver. apk does not
+// allow "-" in versions, so pre-releases are expressed as suffixes, e.g.
+// 1.11.0-beta.2 becomes 1.11.0_beta2 and the CI build 1.12.0-alpha.0.123-abc
+// becomes 1.12.0_alpha0_p123.
+func getApkVersion(v string) (string, error) {
+	sv, err := semver.Make(v)
+	if err != nil {
+		return "", err
+	}
+
+	apkVersion := fmt.Sprintf("%d.%d.%d", sv.Major, sv.Minor, sv.Patch)
+	if len(sv.Pre) == 0 {
+		return apkVersion, nil
+	}
+
+	switch sv.Pre[0].VersionStr {
+	case "alpha", "beta", "rc":
+	default:
+		return "", fmt.Errorf("unsupported pre-release %q in version %q", sv.Pre[0], v)
+	}
+	apkVersion += "_" + sv.Pre[0].VersionStr
+	if len(sv.Pre) > 1 && sv.Pre[1].IsNum {
+		apkVersion += fmt.Sprint(sv.Pre[1].VersionNum)
+	}
+	if len(sv.Pre) > 2 {
+		// CI builds carry the commit count since the tag, optionally
+		// followed by the commit hash.
+		commits := strings.SplitN(sv.Pre[2].String(), "-", 2)[0]
+		if _, err := strconv.ParseUint(commits, 10, 64); err == nil {
+			apkVersion += "_p" + commits
+		}
+	}
+	return apkVersion, nil
+}
+
+func fetchVersion(url string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	versionAuth.apply(req)
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return "", fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+
+	versionBytes, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	// Remove a newline and the v prefix from the string
+	return strings.Replace(strings.Replace(string(versionBytes), "v", "", 1), "\n", "", 1), nil
+}
+
+// versionAuth authenticates the requests for the published versions.
+var versionAuth credentials
+
+// credentials authenticate HTTP requests with a bearer token, or with a
+// user and password. Requests to hosts without either fall back to the
+// machine, or default, entries of netrc. They are never printed.
+type credentials struct {
+	token          string
+	user, password string
+	netrc          []netrcEntry
+}
+
+// netrcEntry is a machine of a netrc file, or its default if machine is
+// empty.
+type netrcEntry struct {
+	machine, login, password string
+}
+
+func (c credentials) String() string {
+	return "<redacted>"
+}
+
+// apply sets the Authorization header of req.
+func (c credentials) apply(req *http.Request) {
+	switch {
+	case len(c.token) != 0:
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case len(c.user) != 0:
+		req.SetBasicAuth(c.user, c.password)
+	default:
+		if e, ok := lookupNetrc(c.netrc, req.URL.Host); ok {
+			req.SetBasicAuth(e.login, e.password)
+		}
+	}
+}
+
+// newCredentials returns the credentials given by --version-auth-token or
+// --version-auth-basic, falling back to the netrc file. The errors never
+// include the secrets.
+func newCredentials(token, basic, netrc string) (credentials, error) {
+	var c credentials
+	if len(token) != 0 && len(basic) != 0 {
+		return c, fmt.Errorf("--version-auth-token and --version-auth-basic are mutually exclusive")
+	}
+	c.token = token
+	if len(basic) != 0 {
+		i := strings.Index(basic, ":")
+		if i <= 0 {
+			return c, fmt.Errorf("--version-auth-basic must be user:password")
+		}
+		c.user, c.password = basic[:i], basic[i+1:]
+	}
+	if len(netrc) != 0 {
+		data, err := ioutil.ReadFile(netrc)
+		if err != nil && !os.IsNotExist(err) {
+			return c, err
+		}
+		if c.netrc, err = parseNetrc(string(data)); err != nil {
+			return c, fmt.Errorf("%s: %v", netrc, err)
+		}
+	}
+	return c, nil
+}
+
+// parseNetrc parses the machine and default entries of a netrc file. Macro
+// definitions aren't supported.
+func parseNetrc(data string) ([]netrcEntry, error) {
+	var entries []netrcEntry
+	var e *netrcEntry
+	fields := strings.Fields(data)
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine", "default":
+			entries = append(entries, netrcEntry{})
+			e = &entries[len(entries)-1]
+			if fields[i] == "default" {
+				continue
+			}
+		case "login", "password", "account":
+		case "macdef":
+			return nil, fmt.Errorf("macdef is not supported")
+		default:
+			return nil, fmt.Errorf("unexpected token %q", fields[i])
+		}
+		if i+1 == len(fields) {
+			return nil, fmt.Errorf("%s without a value", fields[i])
+		}
+		if e == nil {
+			return nil, fmt.Errorf("%s outside of a machine", fields[i])
+		}
+		i++
+		switch fields[i-1] {
+		case "machine":
+			e.machine = fields[i]
+		case "login":
+			e.login = fields[i]
+		case "password":
+			e.password = fields[i]
+		}
+	}
+	return entries, nil
+}
+
+// lookupNetrc returns the entry of host, with or without its port, or the
+// default entry.
+func lookupNetrc(entries []netrcEntry, host string) (netrcEntry, bool) {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	for _, e := range entries {
+		if len(e.machine) != 0 && (e.machine == host || e.machine == name) {
+			return e, true
+		}
+	}
+	for _, e := range entries {
+		if len(e.machine) == 0 {
+			return e, true
+		}
+	}
+	return netrcEntry{}, false
+}
+
+// httpClient is shared by all requests so that connections to the same
+// hosts are reused.
+var httpClient = newHTTPClient()
+
+func newHTTPClient() *http.Client {
+	t := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	// file:// download bases serve binaries built locally.
+	t.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	return &http.Client{Transport: t}
+}
+
+// redirectPolicy returns a CheckRedirect function for httpClient following
+// at most max redirects, and only to the host of the original request
+// unless crossHost.
+func redirectPolicy(max int, crossHost bool) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return fmt.Errorf("stopped after %d redirects", max)
+		}
+		if !crossHost && req.URL.Host != via[0].URL.Host {
+			return fmt.Errorf("redirect from %s to another host %s is not allowed", via[0].URL.Host, req.URL.Host)
+		}
+		return nil
+	}
+}
+
+// versions memoizes the versions published at the well-known URLs, so that
+// every build of a run uses the same version even if a new one is published
+// meanwhile, and so that they're fetched once.
+var versions = &versionCache{
+	fetch: func(url string) (string, error) {
+		return fetchValidVersion(url, ciFetchAttempts, ciFetchRetryDelay)
+	},
+}
+
+// versionCache memoizes the successful results of fetch per URL. Concurrent
+// requests for the same URL share a single fetch.
+type versionCache struct {
+	fetch func(url string) (string, error)
+
+	mu      sync.Mutex
+	entries map[string]*versionEntry
+}
+
+type versionEntry struct {
+	done    chan struct{}
+	version string
+	err     error
+}
+
+func (vc *versionCache) get(url string) (string, error) {
+	vc.mu.Lock()
+	if vc.entries == nil {
+		vc.entries = map[string]*versionEntry{}
+	}
+	if e, ok := vc.entries[url]; ok {
+		vc.mu.Unlock()
+		<-e.done
+		return e.version, e.err
+	}
+	e := &versionEntry{done: make(chan struct{})}
+	vc.entries[url] = e
+	vc.mu.Unlock()
+
+	e.version, e.err = vc.fetch(url)
+	if e.err != nil {
+		// Let the next caller try again.
+		vc.mu.Lock()
+		delete(vc.entries, url)
+		vc.mu.Unlock()
+	}
+	close(e.done)
+	return e.version, e.err
+}
+
+// prefetch fetches urls with at most parallelism concurrent requests.
+func (vc *versionCache) prefetch(urls []string, parallelism int) error {
+	jobs := make([]func() error, len(urls))
+	for i, url := range urls {
+		url := url
+		jobs[i] = func() error {
+			_, err := vc.get(url)
+			return err
+		}
+	}
+	return runParallel(parallelism, jobs)
+}
+
+// diskVersionCache keeps the versions fetched by fetch in the JSON file at
+// path, keyed by URL, so that runs within ttl of the fetch reuse them
+// instead of fetching them again. With refresh, every version is fetched
+// and the file updated.
+type diskVersionCache struct {
+	path    string
+	ttl     time.Duration
+	refresh bool
+	clock   Clock
+	fetch   func(url string) (string, error)
+	// uncached are the URLs always fetched, like ci-cross/latest.txt, which
+	// moves with every CI build.
+	uncached []string
+
+	// mu serializes the updates of the file by the builds of a run.
+	mu sync.Mutex
+}
+
+type cachedVersion struct {
+	Version string    `json:"version"`
+	Fetched time.Time `json:"fetched"`
+}
+
+func (dc *diskVersionCache) get(url string) (string, error) {
+	for _, u := range dc.uncached {
+		if u == url {
+			return dc.fetch(url)
+		}
+	}
+	if !dc.refresh {
+		dc.mu.Lock()
+		entries := dc.load()
+		dc.mu.Unlock()
+		if e, ok := entries[url]; ok {
+			age := dc.clock.Now().Sub(e.Fetched)
+			if age >= 0 && age < dc.ttl {
+				log.Printf("using version %s of %s cached %s ago", e.Version, url, age)
+				return e.Version, nil
+			}
+		}
+	}
+
+	v, err := dc.fetch(url)
+	if err != nil {
+		return "", err
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	entries := dc.load()
+	entries[url] = cachedVersion{Version: v, Fetched: dc.clock.Now()}
+	if err := dc.save(entries); err != nil {
+		log.Printf("warning: can't cache version %s of %s: %v", v, url, err)
+	}
+	return v, nil
+}
+
+// load reads the entries of the file. A missing or corrupt file is an
+// empty cache.
+func (dc *diskVersionCache) load() map[string]cachedVersion {
+	entries := map[string]cachedVersion{}
+	data, err := ioutil.ReadFile(dc.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("warning: ignoring version cache %s: %v", dc.path, err)
+		}
+		return entries
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Printf("warning: ignoring corrupt version cache %s: %v", dc.path, err)
+		return map[string]cachedVersion{}
+	}
+	return entries
+}
+
+// save replaces the file with entries, atomically so that concurrent runs
+// never read a partial file.
+func (dc *diskVersionCache) save(entries map[string]cachedVersion) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dc.path), filepath.Base(dc.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// TempFile creates the file with mode 0600.
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dc.path)
+}
+
+// multiError aggregates the errors of parallel jobs.
+type multiError []error
+
+func (m multiError) Error() string {
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// runParallel runs jobs with at most parallelism of them at a time and
+// returns the errors of all failed jobs.
+func runParallel(parallelism int, jobs []func() error) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs multiError
+	)
+	sem := make(chan struct{}, parallelism)
+	for _, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(job func() error) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := job(); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(job)
+	}
+	wg.Wait()
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// resolveVersions resolves the versions and download link bases of builds
+// up front, with at most parallelism concurrent lookups, so that walkBuilds
+// finds them memoized.
+func resolveVersions(builds []build, parallelism int) error {
+	var jobs []func() error
+	for _, b := range builds {
+		for _, v := range b.Versions {
+			v := v
+			if len(v.Version) != 0 || v.GetVersion == nil {
+				continue
+			}
+			jobs = append(jobs, func() error {
+				var err error
+				if v.Version, err = v.GetVersion(); err != nil {
+					return err
+				}
+				if v.GetDownloadLinkBase != nil {
+					_, err = v.GetDownloadLinkBase(v)
+				}
+				return err
+			})
+		}
+	}
+	return runParallel(parallelism, jobs)
+}
+
+const (
+	stableVersionURL = "https://dl.k8s.io/release/stable.txt"
+	latestVersionURL = "https://dl.k8s.io/release/latest.txt"
+	ciVersionURL     = "https://dl.k8s.io/ci-cross/latest.txt"
+)
+
+func getStableKubeVersion() (string, error) {
+	return versions.get(stableVersionURL)
+}
+
+func getLatestKubeVersion() (string, error) {
+	return versions.get(latestVersionURL)
+}
+
+func getLatestCIVersion() (string, error) {
+	latestVersion, err := getLatestKubeCIBuild()
+	if err != nil {
+		return "", err
+	}
+
+	// Replace the "+" with a "-" to make it semver-compliant
+	return strings.Replace(latestVersion, "+", "-", 1), nil
+}
+
+// metaPackage depends on all other KnownPackages at the versions built in
+// the same run, to install them together.
+const metaPackage = "kubernetes"
+
+// KnownPackages returns the names of the packages this tool builds, in the
+// order they are built.
+func KnownPackages() []string {
+	return []string{"kubectl", "kubelet", "kubernetes-cni", "kubeadm", "cri-tools", metaPackage}
+}
+
+// defaultBuilds returns the builds of all KnownPackages for every channel.
+func defaultBuilds() []build {
+	var builds []build
+	for _, pkg := range KnownPackages() {
+		var versions []version
+		for _, channel := range []ChannelType{ChannelStable, ChannelUnstable, ChannelNightly} {
+			versions = append(versions, defaultVersion(pkg, channel))
+		}
+		builds = append(builds, newBuild(pkg, versions))
+	}
+	return builds
+}
+
+// specifiedVersionBuilds returns the builds of all KnownPackages for the
+// stable channel, with the Kubernetes packages at kubeVersion.
+func specifiedVersionBuilds(kubeVersion string) []build {
+	getSpecifiedVersion := func() (string, error) {
+		return kubeVersion, nil
+	}
+
+	var builds []build
+	for _, pkg := range KnownPackages() {
+		v := defaultVersion(pkg, ChannelStable)
+		if v.GetDownloadLinkBase != nil {
+			v.GetVersion = getSpecifiedVersion
+		}
+		builds = append(builds, newBuild(pkg, []version{v}))
+	}
+	return builds
+}
+
+func newBuild(pkg string, versions []version) build {
+	b := build{
+		Package:  pkg,
+		Distros:  serverDistros,
+		Versions: versions,
+	}
+	switch pkg {
+	case "kubectl":
+		b.Distros = allDistros
+	case "cri-tools":
+		b.Binaries = []string{"crictl", "critest"}
+	case metaPackage:
+		b.ArchIndependent = true
+		// The meta-package has nothing to download.
+		for i := range b.Versions {
+			b.Versions[i].GetDownloadLinkBase = nil
+		}
+	}
+	return b
+}
+
+// defaultVersion returns the latest version of pkg in channel. The packages
+// of other projects are built at the same version in every channel.
+func defaultVersion(pkg string, channel ChannelType) version {
+	v := version{Revision: *revision, Channel: channel}
+	switch pkg {
+	case "kubernetes-cni":
+		v.GetVersion = getCNILatestVersion
+	case "cri-tools":
+		v.GetVersion = getCRIToolsLatestVersion
+	default:
+		switch channel {
+		case ChannelStable:
+			v.GetVersion = getStableKubeVersion
+			v.GetDownloadLinkBase = getReleaseDownloadLinkBase
+		case ChannelUnstable:
+			v.GetVersion = getLatestKubeVersion
+			v.GetDownloadLinkBase = getReleaseDownloadLinkBase
+		case ChannelNightly:
+			v.GetVersion = getLatestCIVersion
+			v.GetDownloadLinkBase = getCIBuildsDownloadLinkBase
+		}
+	}
+	return v
+}
+
+// validatePackages checks that names only contains KnownPackages.
+func validatePackages(names []string) error {
+	for _, name := range names {
+		known := false
+		for _, pkg := range KnownPackages() {
+			if name == pkg {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown package %q, must be one of %s", name, strings.Join(KnownPackages(), ", "))
+		}
+	}
+	return nil
+}
+
+// affectedPackages returns the packages that have to be rebuilt when those
+// in changed change: themselves and the packages relating to them, directly
+// or through others, in the order of KnownPackages.
+func affectedPackages(changed []string) []string {
+	affected := map[string]bool{}
+	for _, pkg := range changed {
+		affected[pkg] = true
+	}
+	// Walk the dependencies until no more package is affected.
+	for grew := true; grew; {
+		grew = false
+		for _, pkg := range KnownPackages() {
+			if affected[pkg] {
+				continue
+			}
+			for _, d := range (cfg{Package: pkg}).dependencies() {
+				if affected[d.Name] {
+					affected[pkg] = true
+					grew = true
+					break
+				}
+			}
+		}
+	}
+
+	var names []string
+	for _, pkg := range KnownPackages() {
+		if affected[pkg] {
+			names = append(names, pkg)
+		}
+	}
+	return names
+}
+
+// packageDescription describes a package in its control file: Synopsis is
+// the first line of the Description field, Long the paragraphs after it.
+type packageDescription struct {
+	Synopsis, Long string
+}
+
+// packageDescriptions are the descriptions of KnownPackages.
+var packageDescriptions = map[string]packageDescription{
+	"kubectl": {
+		"Kubernetes Command Line Tool",
+		"The Kubernetes command line tool for interacting with the Kubernetes API.",
+	},
+	"kubelet": {
+		"Kubernetes Node Agent",
+		"The node agent of Kubernetes, the container cluster manager.",
+	},
+	"kubeadm": {
+		"Kubernetes Cluster Bootstrapping Tool",
+		"The Kubernetes command line tool for bootstrapping a Kubernetes cluster.",
+	},
+	"kubernetes-cni": {
+		"Kubernetes CNI",
+		"The binaries required to provision container networking.",
+	},
+	"cri-tools": {
+		"Container Runtime Interface Tools",
+		"Binaries that interact with the container runtime through the container runtime interface.",
+	},
+	"kubernetes": {
+		"Kubernetes Components",
+		"Installs the node agent, the command line tools, the CNI plugins and the container runtime interface tools of Kubernetes at matching versions.",
+	},
+}
+
+// parseDescriptions parses --description values of the form
+// <package>=<synopsis> into the descriptions of all KnownPackages.
+func parseDescriptions(specs []string) (map[string]packageDescription, error) {
+	descriptions := map[string]packageDescription{}
+	for pkg, d := range packageDescriptions {
+		descriptions[pkg] = d
+	}
+	for _, spec := range specs {
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q is not of the form <package>=<synopsis>", spec)
+		}
+		pkg := spec[:i]
+		if err := validatePackages([]string{pkg}); err != nil {
+			return nil, err
+		}
+		d := descriptions[pkg]
+		d.Synopsis = spec[i+1:]
+		descriptions[pkg] = d
+	}
+	for _, pkg := range KnownPackages() {
+		if err := validateDescription(descriptions[pkg]); err != nil {
+			return nil, fmt.Errorf("description of %s: %v", pkg, err)
+		}
+	}
+	return descriptions, nil
+}
+
+func validateDescription(d packageDescription) error {
+	switch {
+	case len(strings.TrimSpace(d.Synopsis)) == 0:
+		return fmt.Errorf("the synopsis is empty")
+	case strings.Contains(d.Synopsis, "\n"):
+		return fmt.Errorf("the synopsis %q must be a single line", d.Synopsis)
+	case len(d.Synopsis) > 80:
+		return fmt.Errorf("the synopsis %q is longer than 80 characters", d.Synopsis)
+	case len(strings.TrimSpace(d.Long)) == 0:
+		return fmt.Errorf("the long description is empty")
+	}
+	return nil
+}
+
+// controlText formats the long description for the Description field of a
+// control file: every line is indented by a space, and empty lines are
+// written as a dot.
+func (d packageDescription) controlText() string {
+	lines := strings.Split(strings.TrimSpace(d.Long), "\n")
+	for i, line := range lines {
+		if len(strings.TrimSpace(line)) == 0 {
+			line = "."
+		}
+		lines[i] = " " + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// validateHomepage checks that homepage is an absolute http(s) URL.
+func validateHomepage(homepage string) error {
+	u, err := url.Parse(homepage)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+		return fmt.Errorf("homepage %q is not an http:// or https:// URL", homepage)
+	}
+	return nil
+}
+
+// selectPackages restricts builds to the packages named in names.
+func selectPackages(builds []build, names []string) []build {
+	var selected []build
+	for _, b := range builds {
+		for _, name := range names {
+			if b.Package == name {
+				selected = append(selected, b)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+func getCRIToolsLatestVersion() (string, error) {
+	return criToolsSource.LatestVersion()
+}
+
+func getCNILatestVersion() (string, error) {
+	return cniSource.LatestVersion()
+}
+
+// The canonical versions of cri-tools and the CNI plugins are their GitHub
+// releases. The constraints keep them on the minor versions the package
+// definitions and dependencies are written for.
+var (
+	criToolsSource = &GitHubReleaseSource{
+		Owner:      "kubernetes-incubator",
+		Repo:       "cri-tools",
+		Constraint: fmt.Sprintf(">=%s <1.12.0", criToolsVersion),
+	}
+	cniSource = &GitHubReleaseSource{
+		Owner:      "containernetworking",
+		Repo:       "plugins",
+		Constraint: fmt.Sprintf(">=%s <0.7.0", cniVersion),
+	}
+)
+
+// GitHubReleaseSource resolves the latest release of a GitHub repository,
+// optionally restricted to the versions matching a semver range.
+type GitHubReleaseSource struct {
+	Owner, Repo string
+	// Constraint is a semver range like ">=1.11.0 <1.12.0". Empty matches
+	// every release.
+	Constraint string
+
+	client gitHubClient
+
+	mu      sync.Mutex
+	version string
+}
+
+// LatestVersion returns the highest non-draft, non-prerelease version that
+// matches the constraint, without the "v" prefix of the tag. The result is
+// remembered, as unauthenticated API requests are heavily rate limited.
+func (s *GitHubReleaseSource) LatestVersion() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.version) != 0 {
+		return s.version, nil
+	}
+
+	inRange := func(semver.Version) bool { return true }
+	if len(s.Constraint) != 0 {
+		r, err := semver.ParseRange(s.Constraint)
+		if err != nil {
+			return "", fmt.Errorf("invalid constraint for %s/%s: %v", s.Owner, s.Repo, err)
+		}
+		inRange = r
+	}
+
+	client := s.client
+	if client == nil {
+		client = newGitHubAPIClient(*githubToken)
+	}
+
+	var latest *semver.Version
+	for page := 1; page != 0; {
+		releases, next, err := client.ListReleases(s.Owner, s.Repo, page)
+		if err != nil {
+			return "", err
+		}
+		for _, r := range releases {
+			if r.Draft || r.Prerelease {
+				continue
+			}
+			v, err := semver.ParseTolerant(r.TagName)
+			if err != nil {
+				// Not every tag is a version.
+				continue
+			}
+			if inRange(v) && (latest == nil || v.GT(*latest)) {
+				latest = &v
+			}
+		}
+		page = next
+	}
+
+	if latest == nil {
+		return "", fmt.Errorf("no release of %s/%s matches %q", s.Owner, s.Repo, s.Constraint)
+	}
+	s.version = latest.String()
+	return s.version, nil
+}
+
+type gitHubRelease struct {
+	TagName    string `json:"tag_name"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
+}
+
+// gitHubClient lists the releases of a repository a page at a time. The
+// returned next page is 0 after the last page.
+type gitHubClient interface {
+	ListReleases(owner, repo string, page int) (releases []gitHubRelease, next int, err error)
+}
+
+type gitHubAPIClient struct {
+	baseURL string
+	token   string
+}
+
+func newGitHubAPIClient(token string) *gitHubAPIClient {
+	return &gitHubAPIClient{baseURL: "https://api.github.com", token: token}
+}
+
+var nextPageLink = regexp.MustCompile(`<[^>]*[?&]page=(\d+)[^>]*>;\s*rel="next"`)
+
+func (g *gitHubAPIClient) ListReleases(owner, repo string, page int) ([]gitHubRelease, int, error) {
+	url := fmt.Sprintf("%s/repos/%s/%s/releases?per_page=100&page=%d", g.baseURL, owner, repo, page)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	if len(g.token) != 0 {
+		req.Header.Set("Authorization", "token "+g.token)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	if (res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusTooManyRequests) &&
+		res.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset := "unknown"
+		if epoch, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			reset = time.Unix(epoch, 0).UTC().Format(time.RFC3339)
+		}
+		return nil, 0, fmt.Errorf("GitHub API rate limit exceeded listing releases of %s/%s (resets at %s); use --github-token to raise the limit", owner, repo, reset)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+
+	var releases []gitHubRelease
+	if err := json.NewDecoder(res.Body).Decode(&releases); err != nil {
+		return nil, 0, fmt.Errorf("decoding releases of %s/%s: %v", owner, repo, err)
+	}
+
+	next := 0
+	if m := nextPageLink.FindStringSubmatch(res.Header.Get("Link")); m != nil {
+		next, _ = strconv.Atoi(m[1])
+	}
+	return releases, next, nil
+}
+
+func getLatestKubeCIBuild() (string, error) {
+	return versions.get(ciVersionURL)
+}
+
+// publishedVersion matches a complete version as published in the release
+// buckets, after the "v" prefix has been stripped.
+var publishedVersion = regexp.MustCompile(`^\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+var (
+	ciFetchAttempts   = 5
+	ciFetchRetryDelay = 5 * time.Second
+)
+
+// fetchValidVersion is fetchVersion for endpoints that are rewritten while
+// being served, like ci-cross/latest.txt, which occasionally returns an empty
+// or truncated body while a build is being published. It retries until the
+// body looks like a complete version.
+func fetchValidVersion(url string, attempts int, delay time.Duration) (string, error) {
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			log.Printf("retrying %s in %v: %v", url, delay, lastErr)
+			time.Sleep(delay)
+		}
+
+		v, err := fetchVersion(url)
+		if err != nil {
+			return "", err
+		}
+		if publishedVersion.MatchString(v) {
+			return v, nil
+		}
+		lastErr = fmt.Errorf("%s returned invalid version %q", url, v)
+	}
+	return "", lastErr
+}
+
+func getCIBuildsDownloadLinkBase(_ version) (string, error) {
+	latestCiVersion, err := getLatestKubeCIBuild()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/v%s", strings.TrimSuffix(*ciDownloadLinkBase, "/"), latestCiVersion), nil
+}
+
+func getReleaseDownloadLinkBase(v version) (string, error) {
+	return fmt.Sprintf("%s/v%s", strings.TrimSuffix(*releaseDownloadLinkBase, "/"), v.Version), nil
+}
+
+// validateDownloadBase checks that the binaries under base are downloaded
+// securely: over HTTPS, or from the local file system. Plain HTTP is only
+// accepted if allowInsecure.
+func validateDownloadBase(base string, allowInsecure bool) error {
+	u, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "https":
+		if len(u.Host) == 0 {
+			return fmt.Errorf("download base %q has no host", base)
+		}
+	case "file":
+		if len(u.Path) == 0 {
+			return fmt.Errorf("download base %q has no path", base)
+		}
+	case "http":
+		if !allowInsecure {
+			return fmt.Errorf("download base %q is not HTTPS, pass --allow-insecure-downloads to use it anyway", base)
+		}
+	default:
+		return fmt.Errorf("download base %q must be an https:// or file:// URL", base)
+	}
+	return nil
+}
+
+// gitCommit returns the HEAD commit of the git checkout containing dir.
+func gitCommit(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse HEAD in %s: %v", dir, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// nextPatchVersion returns the patch release following current, e.g. 1.11.1
+// for 1.11.0. Pre-release versions are rejected unless --strip-prerelease is
+// set, in which case the suffix is dropped before incrementing.
+func nextPatchVersion(current string) (string, error) {
+	sv, err := semver.Make(current)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sv.Pre) != 0 {
+		if !*stripPrerelease {
+			return "", fmt.Errorf("version %q is a pre-release", current)
+		}
+		sv.Pre = nil
+	}
+	sv.Build = nil
+	sv.Patch++
+	return sv.String(), nil
+}
+
+// The version of this file to use changed in 1.8 and 1.11 so use the target build
+// version to figure out which copy of it to include in the deb.
+func getKubeadmKubeletConfigFile(v version) (string, error) {
+	sv, err := semver.Make(v.Version)
+	if err != nil {
+		return "", err
+	}
+
+	v180, err := semver.Make("1.8.0-alpha.0")
+	if err != nil {
+		return "", err
+	}
+	v1110, err := semver.Make("1.11.0-alpha.0")
+	if err != nil {
+		return "", err
+	}
+
+	if sv.LT(v1110) {
+		if sv.LT(v180) {
+			return pre180kubeadmconf, nil
+		}
+		return pre1110kubeadmconf, nil
+	}
+	return latestkubeadmconf, nil
+}
+
+// CNI get bumped in 1.9, which is incompatible for kubelet<1.9.
+// So we need to restrict the CNI version when install kubelet. cni is the
+// Debian version of the kubernetes-cni package, which kubelet pins exactly.
+func getKubeletCNIVersion(v version, cni string) (string, error) {
+	sv, err := semver.Make(v.Version)
+	if err != nil {
+		return "", err
+	}
+
+	v190, err := semver.Make("1.9.0-alpha.0")
+	if err != nil {
+		return "", err
+	}
+
+	if sv.GTE(v190) {
+		return fmt.Sprintf("= %s", cni), nil
+	}
+	return fmt.Sprint("= 0.5.1"), nil
+}
+
+// usesCNIVersion tells whether the dependencies of pkg refer to the version
+// of kubernetes-cni built in the same run.
+func usesCNIVersion(pkg string) bool {
+	switch pkg {
+	case "kubelet", "kubeadm":
+		return true
+	}
+	return false
+}
+
+// cniVersionFor returns the upstream and Debian versions of the
+// kubernetes-cni package built for channel, so that the packages depending
+// on it match what is built in the same run. Without such a build, both are
+// the minimum supported version.
+func cniVersionFor(builds []build, channel ChannelType, epoch int, metadata string) (upstream, deb string, err error) {
+	for _, b := range builds {
+		if b.Package != "kubernetes-cni" {
+			continue
+		}
+		for _, v := range b.Versions {
+			if v.Channel != channel {
+				continue
+			}
+			if len(v.Version) == 0 && v.GetVersion != nil {
+				if v.Version, err = v.GetVersion(); err != nil {
+					return "", "", err
+				}
+			}
+			if deb, err = debVersion(epoch, v, metadata); err != nil {
+				return "", "", err
+			}
+			return v.Version, deb, nil
+		}
+	}
+	return cniVersion, cniVersion, nil
+}
+
+// debVersionsFor returns the Debian versions the packages of builds other
+// than the meta-package are built at in channel, by package. It fails if a
+// package is built at several versions in channel, which the meta-package
+// can't pin.
+func debVersionsFor(builds []build, channel ChannelType, epoch int, metadata string) (map[string]string, error) {
+	versions := map[string]string{}
+	for _, b := range builds {
+		if b.Package == metaPackage {
+			continue
+		}
+		for _, v := range b.Versions {
+			if v.Channel != channel {
+				continue
+			}
+			if _, ok := versions[b.Package]; ok {
+				return nil, fmt.Errorf("%s is built at several versions in the %s channel", b.Package, channel)
+			}
+			if len(v.Version) == 0 && v.GetVersion != nil {
+				var err error
+				if v.Version, err = v.GetVersion(); err != nil {
+					return nil, err
+				}
+			}
+			dv, err := debVersion(epoch, v, metadata)
+			if err != nil {
+				return nil, err
+			}
+			versions[b.Package] = dv
+		}
+	}
+	return versions, nil
+}
+
+// errorLog reports errors, which --quiet doesn't silence unlike the
+// standard logger.
+var errorLog = log.New(os.Stderr, "", log.LstdFlags)
+
+func main() {
+	flag.Parse()
+
+	if *quiet {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	if *nativeOnly {
+		native, err := nativeArchitectures(architectures, hostArch)
+		if err != nil {
+			errorLog.Fatalf("--native-only: %v", err)
+		}
+		architectures = native
+	}
+
+	for _, l := range []struct {
+		what string
+		list stringList
+	}{
+		{"operating system", operatingSystems},
+		{"architecture", architectures},
+		{"distro", allDistros},
+		{"server distro", serverDistros},
+	} {
+		if err := requireNonEmpty(l.what, l.list); err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+
+	switch packageFormat(*format) {
+	case formatDeb:
+	case formatAPK:
+		if _, err := exec.LookPath("abuild"); err != nil {
+			errorLog.Fatalf("--format=apk requires abuild (from alpine-sdk) in PATH: %v", err)
+		}
+	default:
+		errorLog.Fatalf("unknown package format %q", *format)
+	}
+
+	var smokeTestRuntime string
+	var smokeImages map[string]string
+	smoke := smokeTests{}
+	if *smokeTest {
+		var err error
+		if smokeTestRuntime, err = detectContainerRuntime(*containerRuntime); err != nil {
+			errorLog.Fatalf("--smoke-test requires a container runtime: %v", err)
+		}
+		if packageFormat(*format) == formatDeb {
+			distros := append(stringList{}, allDistros...)
+			distros = append(distros, serverDistros...)
+			if smokeImages, err = smokeTestImages(*smokeTestImageTemplate, distros); err != nil {
+				errorLog.Fatalf("invalid --smoke-test-image-template: %v", err)
+			}
+		}
+	}
+
+	if *aptIndex {
+		if packageFormat(*format) != formatDeb {
+			errorLog.Fatalf("--apt-index is only supported with --format=deb")
+		}
+		if _, err := exec.LookPath("dpkg-scanpackages"); err != nil {
+			errorLog.Fatalf("--apt-index requires dpkg-scanpackages (from dpkg-dev) in PATH: %v", err)
+		}
+	}
+
+	if packageFormat(*format) == formatDeb && !*skipBinfmtCheck {
+		if err := checkBinfmt(binfmtDir, architectures, hostArch); err != nil {
+			errorLog.Fatalf("%v (pass --skip-binfmt-check to build anyway)", err)
+		}
+	}
+
+	netrc := *netrcFile
+	if len(netrc) == 0 {
+		if home := os.Getenv("HOME"); len(home) != 0 {
+			netrc = filepath.Join(home, ".netrc")
+		}
+	}
+	var err error
+	if versionAuth, err = newCredentials(*versionAuthToken, *versionAuthBasic, netrc); err != nil {
+		errorLog.Fatal(err)
+	}
+
+	switch {
+	case *versionCacheTTL < 0:
+		errorLog.Fatalf("--version-cache-ttl must not be negative")
+	case *versionCacheTTL > 0 && len(*versionCacheFile) == 0:
+		errorLog.Fatalf("--version-cache-ttl requires --version-cache-file")
+	case *refreshVersions && len(*versionCacheFile) == 0:
+		errorLog.Fatalf("--refresh-versions requires --version-cache-file")
+	case len(*versionCacheFile) != 0:
+		versions.fetch = (&diskVersionCache{
+			path:     *versionCacheFile,
+			ttl:      *versionCacheTTL,
+			refresh:  *refreshVersions,
+			clock:    systemClock,
+			fetch:    versions.fetch,
+			uncached: []string{ciVersionURL},
+		}).get
+	}
+
+	if *jobs < 1 {
+		errorLog.Fatalf("--jobs must be at least 1")
+	}
+	if *perArchJobs < 0 {
+		errorLog.Fatalf("--per-arch-jobs must not be negative")
+	}
+
+	if *maxRedirects < 0 {
+		errorLog.Fatalf("--max-redirects must not be negative")
+	}
+	httpClient.CheckRedirect = redirectPolicy(*maxRedirects, *crossHostRedirects)
+
+	for _, base := range []struct {
+		flag, url string
+	}{
+		{"--release-download-link-base", *releaseDownloadLinkBase},
+		{"--ci-download-link-base", *ciDownloadLinkBase},
+	} {
+		if err := validateDownloadBase(base.url, *allowInsecureDownloads); err != nil {
+			errorLog.Fatalf("invalid %s: %v", base.flag, err)
+		}
+	}
+
+	if err := validateHomepage(*homepage); err != nil {
+		errorLog.Fatalf("invalid --homepage: %v", err)
+	}
+	descriptions, err := parseDescriptions(descriptionSpecs)
+	if err != nil {
+		errorLog.Fatalf("invalid --description: %v", err)
+	}
+
+	relationOverrides, err := parseRelationOverrides(relationSpecs)
+	if err != nil {
+		errorLog.Fatalf("invalid --relation: %v", err)
+	}
+
+	if len(*manifestFile) != 0 && packageFormat(*format) != formatDeb {
+		errorLog.Fatalf("--manifest is only supported with --format=deb")
+	}
+	if err := validateManifestFormat(*manifestFormat); err != nil {
+		errorLog.Fatalf("invalid --manifest-format: %v", err)
+	}
+	var previousManifest manifest
+	if len(*compareManifest) != 0 {
+		if len(*manifestFile) == 0 {
+			errorLog.Fatalf("--compare-manifest requires --manifest")
+		}
+		if previousManifest, err = loadManifest(*compareManifest); err != nil {
+			errorLog.Fatalf("error loading --compare-manifest: %v", err)
+		}
+	}
+
+	if *withDbgsym && packageFormat(*format) != formatDeb {
+		errorLog.Fatalf("--with-dbgsym is only supported with --format=deb")
+	}
+
+	if *aptIndexIncremental && !*aptIndex {
+		errorLog.Fatalf("--apt-index-incremental requires --apt-index")
+	}
+
+	if len(*signKey) != 0 {
+		if !*aptIndex {
+			errorLog.Fatalf("--sign-key requires --apt-index")
+		}
+		if err := checkSigningKey(*signKey); err != nil {
+			errorLog.Fatalf("--sign-key: %v", err)
+		}
+	}
+
+	if len(*pushOCI) != 0 {
+		if _, err := exec.LookPath("oras"); err != nil {
+			errorLog.Fatalf("--push-oci requires oras in PATH: %v", err)
+		}
+	}
+
+	if err := validateComponent(*component); err != nil {
+		errorLog.Fatal(err)
+	}
+
+	if err := validateCompatLevel(*compatLevel); err != nil {
+		errorLog.Fatal(err)
+	}
+
+	if len(*filter) != 0 {
+		var err error
+		if buildFilter, err = parseFilter(*filter); err != nil {
+			errorLog.Fatalf("invalid --filter: %v", err)
+		}
+	}
+
+	if err := validatePackages(packages); err != nil {
+		errorLog.Fatalf("invalid --packages: %v", err)
+	}
+	if err := validatePackages(changed); err != nil {
+		errorLog.Fatalf("invalid --changed: %v", err)
+	}
+
+	if *resume && len(*stateFile) == 0 {
+		errorLog.Fatalf("--resume requires --state-file")
+	}
+
+	if err := validateRevision(*revision); err != nil {
+		errorLog.Fatal(err)
+	}
+
+	if err := validateVersionMetadata(*versionMetadata); err != nil {
+		errorLog.Fatal(err)
+	}
+	if len(*versionMetadata) != 0 && packageFormat(*format) != formatDeb {
+		errorLog.Fatalf("--version-metadata is only supported with --format=deb")
+	}
+
+	if err := validateStandardsVersion(*standardsVersion); err != nil {
+		errorLog.Fatal(err)
+	}
+
+	if err := validateEpoch(*epoch); err != nil {
+		errorLog.Fatal(err)
+	}
+	if *epoch != 0 && packageFormat(*format) != formatDeb {
+		errorLog.Fatalf("--epoch is only supported with --format=deb")
+	}
+
+	if _, err := compressionEnv(*xzThreads); err != nil {
+		errorLog.Fatalf("invalid --xz-threads: %v", err)
+	}
+
+	for _, o := range operatingSystems {
+		if _, ok := publishedPlatforms[o]; !ok {
+			errorLog.Fatalf("unsupported operating system %q", o)
+		}
+		if o != "linux" && packageFormat(*format) == formatAPK {
+			errorLog.Fatalf("--format=apk only supports linux binaries")
+		}
+	}
+
+	if len(*binariesManifestFile) != 0 {
+		if packageFormat(*format) != formatDeb {
+			errorLog.Fatalf("--binaries-manifest is only supported with --format=deb")
+		}
+		if *nextPatch {
+			errorLog.Fatalf("--next-patch looks the stable version up, it can't be used with --binaries-manifest")
+		}
+		if binaries, err = loadBinariesManifest(*binariesManifestFile); err != nil {
+			errorLog.Fatalf("error loading binaries manifest: %v", err)
+		}
+		// Nothing is looked up: the packages and the Kubernetes version
+		// are those of the binaries, unless given.
+		if len(packages) == 0 {
+			packages = binaries.packages()
+		}
+		for _, pkg := range packages {
+			if kubeVersion != "" || !stagesBinary(pkg) && pkg != metaPackage {
+				continue
+			}
+			if kubeVersion, err = binaries.version("kubectl", "kubelet", "kubeadm"); err != nil {
+				errorLog.Fatalf("%v, set --kube-version", err)
+			}
+		}
+	}
+
+	builds := defaultBuilds()
+
+	if *nextPatch {
+		if kubeVersion != "" {
+			errorLog.Fatalf("--next-patch and --kube-version are mutually exclusive")
+		}
+		stable, err := getStableKubeVersion()
+		if err != nil {
+			errorLog.Fatalf("error getting stable version: %v", err)
+		}
+		kubeVersion, err = nextPatchVersion(stable)
+		if err != nil {
+			errorLog.Fatalf("error computing next patch version: %v", err)
+		}
+		log.Printf("building next patch version %s (stable is %s)", kubeVersion, stable)
+	}
+
+	// The binaries of a manifest are built for the stable channel only.
+	if kubeVersion != "" || binaries != nil {
+		builds = specifiedVersionBuilds(kubeVersion)
+	}
+
+	// The dependencies on the other packages refer to the versions they
+	// would be built at, even when they aren't selected.
+	allBuilds := builds
+	if len(packages) != 0 {
+		builds = selectPackages(builds, packages)
+	}
+	if len(changed) != 0 {
+		affected := affectedPackages(changed)
+		log.Printf("rebuilding %s, affected by changes to %s", strings.Join(affected, ", "), changed.String())
+		builds = selectPackages(builds, affected)
+	}
+
+	if packageFormat(*format) == formatAPK {
+		builds = apkBuilds(builds)
+	}
+
+	if binaries != nil {
+		// The other packages are at the version of their archives.
+		for _, b := range builds {
+			if stagesBinary(b.Package) || b.Package == metaPackage {
+				continue
+			}
+			v, err := binaries.version(b.Package)
+			if err != nil {
+				errorLog.Fatalf("%v, leave it out with --packages", err)
+			}
+			for j := range b.Versions {
+				b.Versions[j].Version = v
+			}
+		}
+		// The versions of the packages that aren't built, which the
+		// dependencies would refer to, can't be looked up either.
+		allBuilds = builds
+		// The binaries are local, there is nothing to download them from.
+		for i := range builds {
+			for j := range builds[i].Versions {
+				builds[i].Versions[j].GetDownloadLinkBase = nil
+			}
+		}
+	}
+
+	if err := resolveVersions(builds, *versionParallelism); err != nil {
+		errorLog.Fatalf("error resolving versions: %v", err)
+	}
+
+	definitionsCommit, err := gitCommit(".")
+	if err != nil {
+		log.Printf("warning: packages won't record the commit they were built from: %v", err)
+	}
+
+	var state *buildState
+	if len(*stateFile) != 0 {
+		if state, err = loadBuildState(*stateFile, *resume); err != nil {
+			errorLog.Fatalf("error opening state file: %v", err)
+		}
+	}
+
+	// indexDirs maps the output directories to one of the builds in them.
+	indexDirs := map[string]cfg{}
+	incrementalIndex := &packagesIndex{}
+	var reports []buildReport
+	built := manifest{GitCommit: definitionsCommit}
+	summary := &runSummary{}
+	var tasks []buildTask
+	err = walkBuilds(builds, func(b build, distro, osName, arch string, v version) error {
+		tasks = append(tasks, buildTask{build: b, distro: distro, os: osName, arch: arch, version: v})
+		return nil
+	})
+	if err == nil {
+		if err := checkDiskSpace(tasks, *jobs, "bin", os.TempDir(), *minFreeSpace); err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+
+	// cniVersions are the upstream and Debian versions of kubernetes-cni by
+	// channel, resolved once for the builds whose dependencies refer to it.
+	type cniRelease struct{ upstream, deb string }
+	cniVersions := map[ChannelType]cniRelease{}
+	for _, t := range tasks {
+		if _, ok := cniVersions[t.version.Channel]; ok || !usesCNIVersion(t.build.Package) {
+			continue
+		}
+		upstream, deb, err := cniVersionFor(allBuilds, t.version.Channel, *epoch, *versionMetadata)
+		if err != nil {
+			errorLog.Fatalf("error getting the kubernetes-cni version: %v", err)
+		}
+		cniVersions[t.version.Channel] = cniRelease{upstream, deb}
+	}
+
+	// packageVersions are the versions the meta-package of each channel
+	// depends on.
+	packageVersions := map[ChannelType]map[string]string{}
+	for _, t := range tasks {
+		if _, ok := packageVersions[t.version.Channel]; ok || t.build.Package != metaPackage {
+			continue
+		}
+		versions, err := debVersionsFor(allBuilds, t.version.Channel, *epoch, *versionMetadata)
+		if err != nil {
+			errorLog.Fatalf("error getting the versions of the packages: %v", err)
+		}
+		packageVersions[t.version.Channel] = versions
+	}
+
+	var downloads *binaryCache
+	if len(*downloadCacheDir) != 0 {
+		downloads = &binaryCache{dir: *downloadCacheDir}
+	}
+
+	// mu guards what the builds running in parallel collect.
+	var mu sync.Mutex
+	// collect adds the packages of c, built in this run or completed in a
+	// previous one, to the manifest and the directories to index.
+	collect := func(c cfg) error {
+		var entries []manifestEntry
+		if len(*manifestFile) != 0 {
+			var err error
+			if entries, err = c.manifestEntries(); err != nil {
+				return err
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, dir := range c.publishedDirs() {
+			indexDirs[dir] = c
+		}
+		built.Packages = append(built.Packages, entries...)
+		return nil
+	}
+	scheduler := buildScheduler{jobs: *jobs, perArch: *perArchJobs}
+	if err == nil {
+		err = scheduler.run(tasks, func(t buildTask) (err error) {
+			b, distro, osName, arch, v := t.build, t.distro, t.os, t.arch, t.version
+			skipped := false
+			defer func() {
+				name := fmt.Sprintf("%s %s %s/%s/%s", b.Package, v.Channel, distro, osName, arch)
+				err = summary.record(name, skipped, err, *keepGoing)
+			}()
+
+			c := cfg{
+				Package:           b.Package,
+				version:           v,
+				DistroName:        distro,
+				DistroVersion:     distroVersions[distro],
+				StandardsVersion:  *standardsVersion,
+				WithDbgsym:        *withDbgsym,
+				OS:                osName,
+				Arch:              arch,
+				GitCommit:         definitionsCommit,
+				PackageName:       packageName(b.Package, v.Channel),
+				Urgency:           channelUrgency(v.Channel),
+				Distribution:      channelDistribution(distro, v.Channel),
+				Binaries:          b.binaries(),
+				Homepage:          *homepage,
+				Description:       descriptions[b.Package].Synopsis,
+				LongDescription:   descriptions[b.Package].controlText(),
+				relationOverrides: relationOverrides[b.Package],
+				templateData:      b.TemplateData,
+				downloads:         downloads,
+			}
+			c.DebArch = getDebArch(c.Arch)
+			if b.ArchIndependent {
+				c.DebArch = "all"
+			}
+			c.messages = &[]dpkgMessage{}
+
+			if c.DebVersion, err = debVersion(*epoch, v, *versionMetadata); err != nil {
+				return err
+			}
+
+			if state != nil && state.done(c.stateEntry()) {
+				log.Printf("skipping %s %s for %s/%s, completed in a previous run", c.PackageName, c.DebVersion, c.DistroName, c.Arch)
+				skipped = true
+				return collect(c)
+			}
+
+			if packageFormat(*format) == formatAPK {
+				if c.ApkArch, err = getApkArch(c.Arch); err != nil {
+					return err
+				}
+				if c.ApkVersion, err = getApkVersion(v.Version); err != nil {
+					return err
+				}
+				rel, err := strconv.Atoi(v.Revision)
+				if err != nil {
+					return fmt.Errorf("apk revision must be numeric: %v", err)
+				}
+				c.ApkRelease = strconv.Itoa(rel)
+			}
+
+			c.KubeadmKubeletConfigFile, err = getKubeadmKubeletConfigFile(v)
+			if err != nil {
+				return fmt.Errorf("error getting kubeadm config: %v", err)
+			}
+
+			if usesCNIVersion(b.Package) {
+				cni := cniVersions[v.Channel]
+				c.CNIVersion = cni.upstream
+				// Alpine packages have no Debian revision to pin.
+				pin := cni.deb
+				if packageFormat(*format) == formatAPK {
+					pin = cni.upstream
+				}
+				c.KubeletCNIVersion, err = getKubeletCNIVersion(v, pin)
+				if err != nil {
+					return fmt.Errorf("error getting kubelet config: %v", err)
+				}
+			}
+
+			if b.Package == metaPackage {
+				c.packageVersions = packageVersions[v.Channel]
+			}
+
+			err = runWithTimeout(*timeoutPerBuild, c.run)
+			if len(*c.messages) != 0 {
+				mu.Lock()
+				reports = append(reports, buildReport{Package: c.debFileName(), Messages: *c.messages})
+				mu.Unlock()
+			}
+			if err != nil {
+				return err
+			}
+			if state != nil {
+				if err := state.record(c.stateEntry()); err != nil {
+					return err
+				}
+			}
+			if err := collect(c); err != nil {
+				return err
+			}
+			mu.Lock()
+			if *smokeTest && packageFormat(*format) == formatDeb {
+				smoke.add(c)
+			}
+			mu.Unlock()
+			if *aptIndexIncremental {
+				if err := c.addToIndex(context.Background(), incrementalIndex); err != nil {
+					return fmt.Errorf("error adding %s to the APT index: %v", c.debFileName(), err)
+				}
+			}
+			return nil
+		})
+	}
+	for _, r := range reports {
+		for _, m := range r.Messages {
+			log.Printf("%s: %s", r.Package, m)
+		}
+	}
+	if summary.failures() != 0 {
+		errorLog.Print(summary)
+	} else {
+		log.Print(summary)
+	}
+	if err != nil {
+		if _, ok := err.(*pushError); ok {
+			errorLog.Fatalf("package built, but push failed: %v", err)
+		}
+		errorLog.Fatalf("err: %v", err)
+	}
+
+	if len(*manifestFile) != 0 {
+		var buf bytes.Buffer
+		if err := built.write(&buf, *manifestFormat); err != nil {
+			errorLog.Fatalf("error writing manifest: %v", err)
+		}
+		if *manifestFile == "-" {
+			_, err = os.Stdout.Write(buf.Bytes())
+		} else {
+			err = ioutil.WriteFile(*manifestFile, buf.Bytes(), 0644)
+		}
+		if err != nil {
+			errorLog.Fatalf("error writing manifest: %v", err)
+		}
+	}
+
+	manifestChanged := false
+	if len(*compareManifest) != 0 {
+		diff := diffManifests(previousManifest, built)
+		manifestChanged = !diff.empty()
+		out := os.Stdout
+		if *manifestFile == "-" {
+			out = os.Stderr
+		}
+		if err := diff.write(out); err != nil {
+			errorLog.Fatalf("error writing manifest diff: %v", err)
+		}
+	}
+
+	if *smokeTest {
+		if err := smoke.run(context.Background(), smokeTestRuntime, smokeImages); err != nil {
+			errorLog.Fatalf("smoke test failed: %v", err)
+		}
+	}
+
+	if *pruneKeep > 0 {
+		pruned, err := pruneRevisions("bin", *pruneKeep)
+		if err != nil {
+			errorLog.Fatalf("error pruning old revisions: %v", err)
+		}
+		// The incremental index still lists the pruned packages.
+		if *aptIndexIncremental {
+			for _, deb := range pruned {
+				if err := incrementalIndex.remove(deb); err != nil {
+					errorLog.Fatalf("error removing %s from the APT index: %v", deb, err)
+				}
+			}
+		}
+	}
+
+	if *aptIndex {
+		var dirs []string
+		for dir := range indexDirs {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+		for _, dir := range dirs {
+			c := indexDirs[dir]
+			info := releaseInfo{
+				Origin:     *aptOrigin,
+				Label:      *aptLabel,
+				Suite:      string(c.Channel),
+				Codename:   c.DistroName,
+				Components: *component,
+			}
+			write := writeAptIndex
+			if *aptIndexIncremental {
+				write = func(_ context.Context, dir string, info releaseInfo, now time.Time) error {
+					return finishAptIndex(dir, info, now)
+				}
+			}
+			if err := write(context.Background(), dir, info, systemClock.Now()); err != nil {
+				errorLog.Fatalf("error writing APT index: %v", err)
+			}
+			if len(*signKey) != 0 {
+				if err := signRelease(context.Background(), dir, *signKey); err != nil {
+					errorLog.Fatal(err)
+				}
+			}
+			log.Printf("wrote APT index of %s", dir)
+		}
+	}
+
+	code := summary.exitCode()
+	if code == 0 && manifestChanged {
+		code = exitManifestChanged
 	}
+	os.Exit(code)
 }
@@ -1,7 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"text/template"
+	"time"
 )
 
 func TestGetKubeadmConfig(t *testing.T) {
@@ -84,3 +111,4482 @@ func TestGetKubeadmConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestGetApkVersion(t *testing.T) {
+	testcases := []struct {
+		version   string
+		expect    string
+		expectErr bool
+	}{
+		{"1.11.0", "1.11.0", false},
+		{"1.11.0-alpha.0", "1.11.0_alpha0", false},
+		{"1.11.0-beta.2", "1.11.0_beta2", false},
+		{"1.11.0-rc.1", "1.11.0_rc1", false},
+		{"1.12.0-alpha.0.123-abcdef", "1.12.0_alpha0_p123", false},
+		{"1.12.0-dirty", "", true},
+		{"not-a-real-version", "", true},
+	}
+
+	for _, tc := range testcases {
+		apkVersion, err := getApkVersion(tc.version)
+
+		if err != nil {
+			if !tc.expectErr {
+				t.Errorf("getApkVersion(%s) returned unwanted error: %v", tc.version, err)
+			}
+		} else {
+			if tc.expectErr {
+				t.Errorf("getApkVersion(%s) expected an error, got %q", tc.version, apkVersion)
+			}
+			if apkVersion != tc.expect {
+				t.Errorf("getApkVersion(%s) got %q, wanted %q", tc.version, apkVersion, tc.expect)
+			}
+		}
+	}
+}
+
+func TestGetApkArch(t *testing.T) {
+	testcases := []struct {
+		arch      string
+		expect    string
+		expectErr bool
+	}{
+		{"amd64", "x86_64", false},
+		{"arm", "armhf", false},
+		{"arm64", "aarch64", false},
+		{"ppc64le", "ppc64le", false},
+		{"s390x", "s390x", false},
+		{"mips", "", true},
+	}
+
+	for _, tc := range testcases {
+		apkArch, err := getApkArch(tc.arch)
+
+		if err != nil {
+			if !tc.expectErr {
+				t.Errorf("getApkArch(%s) returned unwanted error: %v", tc.arch, err)
+			}
+		} else if apkArch != tc.expect {
+			t.Errorf("getApkArch(%s) got %q, wanted %q", tc.arch, apkArch, tc.expect)
+		}
+	}
+}
+
+func TestGetDebArch(t *testing.T) {
+	testcases := []struct {
+		arch   string
+		expect string
+	}{
+		{"amd64", "amd64"},
+		{"386", "i386"},
+		{"arm", "armhf"},
+		{"arm64", "arm64"},
+		{"ppc64le", "ppc64el"},
+		{"s390x", "s390x"},
+	}
+
+	for _, tc := range testcases {
+		if got := getDebArch(tc.arch); got != tc.expect {
+			t.Errorf("getDebArch(%s) got %q, wanted %q", tc.arch, got, tc.expect)
+		}
+	}
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	defer func(orig func(context.Context, string, []string, io.Writer, string, ...string) error) {
+		runCommand = orig
+	}(runCommand)
+	// A dpkg-buildpackage that never finishes on its own.
+	runCommand = func(ctx context.Context, _ string, _ []string, _ io.Writer, _ string, _ ...string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	build := func(ctx context.Context) error {
+		return runCommand(ctx, "", nil, nil, "dpkg-buildpackage")
+	}
+
+	err := runWithTimeout(10*time.Millisecond, build)
+	if _, ok := err.(*buildTimeoutError); !ok {
+		t.Errorf("runWithTimeout() returned %v, wanted a buildTimeoutError", err)
+	}
+
+	runCommand = func(context.Context, string, []string, io.Writer, string, ...string) error {
+		return nil
+	}
+	if err := runWithTimeout(10*time.Millisecond, build); err != nil {
+		t.Errorf("runWithTimeout() returned unwanted error: %v", err)
+	}
+}
+
+func TestNewSPDXDocument(t *testing.T) {
+	c := cfg{
+		version: version{
+			Version:          "1.11.0",
+			Revision:         "00",
+			DownloadLinkBase: "https://dl.k8s.io/v1.11.0",
+		},
+		Package:     "kubectl",
+		PackageName: "kubectl",
+		DebVersion:  "1.11.0-00",
+		OS:          "linux",
+		Arch:        "arm64",
+	}
+	created := time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC)
+
+	const binaryURL = "https://dl.k8s.io/v1.11.0/bin/linux/arm64/kubectl"
+	doc := newSPDXDocument(c, "kubectl_1.11.0-00_arm64.deb", "abc123", map[string]string{binaryURL: "def456"}, created)
+
+	if doc.SPDXVersion != "SPDX-2.2" {
+		t.Errorf("got spdxVersion %q, wanted SPDX-2.2", doc.SPDXVersion)
+	}
+	if doc.CreationInfo.Created != "2018-07-04T00:00:00Z" {
+		t.Errorf("got created %q, wanted 2018-07-04T00:00:00Z", doc.CreationInfo.Created)
+	}
+	if len(doc.Packages) != 2 {
+		t.Fatalf("got %d packages, wanted 2", len(doc.Packages))
+	}
+
+	deb := doc.Packages[0]
+	if deb.Name != "kubectl" || deb.VersionInfo != "1.11.0-00" {
+		t.Errorf("got package %s %s, wanted kubectl 1.11.0-00", deb.Name, deb.VersionInfo)
+	}
+	if len(deb.Checksums) != 1 || deb.Checksums[0].ChecksumValue != "abc123" {
+		t.Errorf("got checksums %v, wanted the sha256 of the .deb", deb.Checksums)
+	}
+
+	src := doc.Packages[1]
+	if src.DownloadLocation != binaryURL {
+		t.Errorf("got source download location %q, wanted %q", src.DownloadLocation, binaryURL)
+	}
+	if len(src.Checksums) != 1 || src.Checksums[0].ChecksumValue != "def456" {
+		t.Errorf("got source checksums %v, wanted the sha256 of the binary", src.Checksums)
+	}
+}
+
+func TestSourceURLsMatchRules(t *testing.T) {
+	// The SBOM names the archives debian/rules downloads, unless staged
+	// where it looks for them.
+	for _, pkg := range []string{"kubernetes-cni", "cri-tools"} {
+		c := cfg{
+			version:  version{Version: "1.11.0", Revision: "00"},
+			Package:  pkg,
+			OS:       "linux",
+			Arch:     "arm64",
+			Binaries: newBuild(pkg, nil).binaries(),
+		}
+		if pkg == "kubernetes-cni" {
+			c.Version = "0.6.0"
+		}
+		rules := renderDefinition(t, filepath.Join("xenial", pkg, "debian", "rules"), c)
+		rules = strings.NewReplacer("$(CNI_ARCHIVE)", "cni-plugins-arm64-v0.6.0.tgz", "$(CNI_VERSION)", "v"+c.Version, "$(CRI_TOOLS_VERSION)", c.Version).Replace(rules)
+		for _, src := range c.sources() {
+			if !strings.Contains(rules, src.url) {
+				t.Errorf("%s debian/rules doesn't download %s:\n%s", pkg, src.url, rules)
+			}
+			if want := "[ -f " + src.path + " ] ||"; !strings.Contains(rules, want) {
+				t.Errorf("%s debian/rules doesn't look for %s before downloading it:\n%s", pkg, src.path, rules)
+			}
+		}
+	}
+}
+
+func TestSourceChecksums(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.11.0/bin/linux/arm64/kubectl.sha256":
+			fmt.Fprintln(w, "def456  kubectl")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c := cfg{
+		version:  version{Version: "1.11.0", DownloadLinkBase: srv.URL + "/v1.11.0"},
+		Package:  "kubectl",
+		OS:       "linux",
+		Arch:     "arm64",
+		Binaries: []string{"kubectl"},
+	}
+	sums, err := c.sourceChecksums(context.Background())
+	if err != nil {
+		t.Fatalf("sourceChecksums() returned unwanted error: %v", err)
+	}
+	if want := map[string]string{srv.URL + "/v1.11.0/bin/linux/arm64/kubectl": "def456"}; !reflect.DeepEqual(sums, want) {
+		t.Errorf("sourceChecksums() got %v, wanted %v", sums, want)
+	}
+
+	c.Arch = "amd64"
+	if _, err := c.sourceChecksums(context.Background()); err == nil {
+		t.Errorf("sourceChecksums() without a published checksum expected an error")
+	}
+}
+
+func TestBinaryCacheFetch(t *testing.T) {
+	binary := []byte("kubectl binary")
+	sum := sha256.Sum256(binary)
+
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.11.0/bin/linux/amd64/kubectl":
+			downloads++
+			w.Write(binary)
+		case "/v1.11.0/bin/linux/amd64/kubectl.sha256":
+			fmt.Fprintln(w, hex.EncodeToString(sum[:]))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "binary-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bc := &binaryCache{dir: dir}
+	url := srv.URL + "/v1.11.0/bin/linux/amd64/kubectl"
+	key := filepath.Join("1.11.0", "linux", "amd64", "kubectl")
+
+	for i := 0; i < 2; i++ {
+		cached, err := bc.fetch(context.Background(), url, key)
+		if err != nil {
+			t.Fatalf("fetch() returned unwanted error: %v", err)
+		}
+		if data, _ := ioutil.ReadFile(cached); string(data) != string(binary) {
+			t.Errorf("cached binary has content %q, wanted %q", data, binary)
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("binary was downloaded %d times, wanted 1", downloads)
+	}
+
+	// A corrupted entry must be replaced.
+	if err := ioutil.WriteFile(filepath.Join(dir, key), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.fetch(context.Background(), url, key); err != nil {
+		t.Fatalf("fetch() returned unwanted error: %v", err)
+	}
+	if downloads != 2 {
+		t.Errorf("corrupted binary was not downloaded again")
+	}
+}
+
+func TestBinaryCacheConcurrentFetch(t *testing.T) {
+	binary := bytes.Repeat([]byte("kubelet binary "), 1<<16)
+	sum := sha256.Sum256(binary)
+
+	var mu sync.Mutex
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.11.0/bin/linux/amd64/kubelet":
+			mu.Lock()
+			downloads++
+			mu.Unlock()
+			w.Write(binary)
+		case "/v1.11.0/bin/linux/amd64/kubelet.sha256":
+			fmt.Fprintln(w, hex.EncodeToString(sum[:]))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "binary-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The builds of a run share the cache, e.g. those of several distros.
+	bc := &binaryCache{dir: dir}
+	url := srv.URL + "/v1.11.0/bin/linux/amd64/kubelet"
+	key := filepath.Join("1.11.0", "linux", "amd64", "kubelet")
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cached, err := bc.fetch(context.Background(), url, key)
+			if err == nil {
+				var data []byte
+				if data, err = ioutil.ReadFile(cached); err == nil && !bytes.Equal(data, binary) {
+					err = fmt.Errorf("cached binary has %d bytes, wanted %d", len(data), len(binary))
+				}
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("binary was downloaded %d times, wanted 1", downloads)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, key+".tmp*"))
+	if len(matches) != 0 {
+		t.Errorf("temporary downloads were left behind: %v", matches)
+	}
+}
+
+func TestNextPatchVersion(t *testing.T) {
+	testcases := []struct {
+		version         string
+		stripPrerelease bool
+		expect          string
+		expectErr       bool
+	}{
+		{"1.20.3", false, "1.20.4", false},
+		{"1.11.0", false, "1.11.1", false},
+		{"1.20.3-rc.1", false, "", true},
+		{"1.20.3-rc.1", true, "1.20.4", false},
+		{"not-a-real-version", false, "", true},
+	}
+
+	defer func(orig bool) { *stripPrerelease = orig }(*stripPrerelease)
+	for _, tc := range testcases {
+		*stripPrerelease = tc.stripPrerelease
+		next, err := nextPatchVersion(tc.version)
+
+		if err != nil {
+			if !tc.expectErr {
+				t.Errorf("nextPatchVersion(%s) returned unwanted error: %v", tc.version, err)
+			}
+		} else {
+			if tc.expectErr {
+				t.Errorf("nextPatchVersion(%s) expected an error, got %q", tc.version, next)
+			}
+			if next != tc.expect {
+				t.Errorf("nextPatchVersion(%s) got %q, wanted %q", tc.version, next, tc.expect)
+			}
+		}
+	}
+}
+
+func TestValidatePlatform(t *testing.T) {
+	testcases := []struct {
+		os, arch, pkg string
+		expectErr     bool
+	}{
+		{"linux", "amd64", "kubelet", false},
+		{"linux", "s390x", "kubectl", false},
+		{"darwin", "amd64", "kubectl", false},
+		{"darwin", "amd64", "kubelet", true},
+		{"darwin", "arm", "kubectl", true},
+		{"windows", "386", "kubectl", false},
+		{"plan9", "amd64", "kubectl", true},
+	}
+
+	for _, tc := range testcases {
+		err := validatePlatform(tc.os, tc.arch, tc.pkg)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("validatePlatform(%s, %s, %s) returned %v, expected error: %v", tc.os, tc.arch, tc.pkg, err, tc.expectErr)
+		}
+	}
+}
+
+func TestBinaryURL(t *testing.T) {
+	c := cfg{
+		version: version{DownloadLinkBase: "https://dl.k8s.io/v1.11.0"},
+		Package: "kubectl",
+		OS:      "windows",
+		Arch:    "amd64",
+	}
+	if got, want := c.binaryURL(), "https://dl.k8s.io/v1.11.0/bin/windows/amd64/kubectl.exe"; got != want {
+		t.Errorf("binaryURL() got %q, wanted %q", got, want)
+	}
+}
+
+func TestSelectPrunable(t *testing.T) {
+	files := []string{
+		"kubectl_1.11.0-00_amd64.deb",
+		"kubectl_1.11.0-01_amd64.deb",
+		"kubectl_1.11.0-09_amd64.deb",
+		"kubectl_1.11.0-10_amd64.deb",
+		"kubectl_1.11.0-10_amd64.deb.spdx.json",
+		"kubectl_1.11.0-00_arm64.deb",
+		"kubectl_1.10.5-00_amd64.deb",
+		"kubeadm_1.12.0-alpha.0.123-abc-00_amd64.deb",
+		"kubeadm_1.12.0-alpha.0.123-abc-01_amd64.deb",
+		"README",
+	}
+
+	testcases := []struct {
+		keep   int
+		expect []string
+	}{
+		{
+			keep: 1,
+			expect: []string{
+				"kubeadm_1.12.0-alpha.0.123-abc-00_amd64.deb",
+				"kubectl_1.11.0-00_amd64.deb",
+				"kubectl_1.11.0-01_amd64.deb",
+				"kubectl_1.11.0-09_amd64.deb",
+			},
+		},
+		{
+			keep: 3,
+			expect: []string{
+				"kubectl_1.11.0-00_amd64.deb",
+			},
+		},
+		{
+			keep:   4,
+			expect: nil,
+		},
+	}
+
+	for _, tc := range testcases {
+		prunable := selectPrunable(files, tc.keep)
+		sort.Strings(prunable)
+		if !reflect.DeepEqual(prunable, tc.expect) {
+			t.Errorf("selectPrunable(keep=%d) got %v, wanted %v", tc.keep, prunable, tc.expect)
+		}
+	}
+}
+
+func TestPruneRevisionsRemovesSidecars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	distroDir := filepath.Join(dir, "stable", "xenial")
+	if err := os.MkdirAll(distroDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"kubectl_1.11.0-00_amd64.deb",
+		"kubectl_1.11.0-00_amd64.deb.spdx.json",
+		"kubectl_1.11.0-01_amd64.deb",
+		"kubectl_1.11.0-01_amd64.deb.spdx.json",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(distroDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruned, err := pruneRevisions(dir, 1)
+	if err != nil {
+		t.Fatalf("pruneRevisions() returned unwanted error: %v", err)
+	}
+	if want := []string{filepath.Join(distroDir, "kubectl_1.11.0-00_amd64.deb")}; !reflect.DeepEqual(pruned, want) {
+		t.Errorf("pruneRevisions() returned %v, wanted %v", pruned, want)
+	}
+
+	entries, err := ioutil.ReadDir(distroDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	expect := []string{"kubectl_1.11.0-01_amd64.deb", "kubectl_1.11.0-01_amd64.deb.spdx.json"}
+	if !reflect.DeepEqual(left, expect) {
+		t.Errorf("pruneRevisions() left %v, wanted %v", left, expect)
+	}
+}
+
+func TestCompressionEnv(t *testing.T) {
+	testcases := []struct {
+		threads   int
+		expect    []string
+		expectErr bool
+	}{
+		{0, []string{"XZ_OPT=-T0"}, false},
+		{4, []string{"XZ_OPT=-T4", "DPKG_DEB_THREADS_MAX=4"}, false},
+		{-1, nil, true},
+	}
+
+	for _, tc := range testcases {
+		env, err := compressionEnv(tc.threads)
+		if err != nil {
+			if !tc.expectErr {
+				t.Errorf("compressionEnv(%d) returned unwanted error: %v", tc.threads, err)
+			}
+		} else if !reflect.DeepEqual(env, tc.expect) {
+			t.Errorf("compressionEnv(%d) got %v, wanted %v", tc.threads, env, tc.expect)
+		}
+	}
+}
+
+func TestOCITag(t *testing.T) {
+	testcases := []struct {
+		distro, fileName, expect string
+	}{
+		{"xenial", "kubectl_1.11.0-00_amd64.deb", "xenial-kubectl_1.11.0-00_amd64"},
+		{"xenial", "kubeadm_1.12.0-alpha.0.1+abc-00_arm64.deb", "xenial-kubeadm_1.12.0-alpha.0.1_abc-00_arm64"},
+	}
+
+	for _, tc := range testcases {
+		if got := ociTag(tc.distro, tc.fileName); got != tc.expect {
+			t.Errorf("ociTag(%s, %s) got %q, wanted %q", tc.distro, tc.fileName, got, tc.expect)
+		}
+	}
+}
+
+func TestPushOCIArtifact(t *testing.T) {
+	defer func(orig func(context.Context, string, []string, io.Writer, string, ...string) error) {
+		runCommand = orig
+	}(runCommand)
+
+	var gotDir string
+	var gotArgs []string
+	runCommand = func(_ context.Context, pwd string, _ []string, _ io.Writer, command string, args ...string) error {
+		gotDir = pwd
+		gotArgs = append([]string{command}, args...)
+		return nil
+	}
+
+	c := cfg{
+		version:    version{Version: "1.11.0", Revision: "00", Channel: ChannelStable},
+		Package:    "kubectl",
+		DistroName: "xenial",
+		DebArch:    "amd64",
+	}
+	debPath := filepath.Join("bin", "stable", "xenial", "kubectl_1.11.0-00_amd64.deb")
+	if err := c.pushOCIArtifact(context.Background(), "registry.example.com/debs", debPath); err != nil {
+		t.Fatalf("pushOCIArtifact() returned unwanted error: %v", err)
+	}
+
+	if want := filepath.Join("bin", "stable", "xenial") + "/"; gotDir != want {
+		t.Errorf("oras ran in %q, wanted %q", gotDir, want)
+	}
+	if len(gotArgs) < 3 || gotArgs[0] != "oras" || gotArgs[2] != "registry.example.com/debs:xenial-kubectl_1.11.0-00_amd64" {
+		t.Errorf("unexpected oras invocation %v", gotArgs)
+	}
+	files := gotArgs[len(gotArgs)-2:]
+	expect := []string{
+		"kubectl_1.11.0-00_amd64.deb:" + ociDebMediaType,
+		"kubectl_1.11.0-00_amd64.deb.sha256:" + ociChecksumMediaType,
+	}
+	if !reflect.DeepEqual(files, expect) {
+		t.Errorf("pushed files %v, wanted %v", files, expect)
+	}
+}
+
+func TestFetchValidVersion(t *testing.T) {
+	testcases := []struct {
+		name      string
+		responses []string
+		expect    string
+		expectErr bool
+	}{
+		{
+			name:      "valid",
+			responses: []string{"v1.12.0-alpha.0.1234+abcdef\n"},
+			expect:    "1.12.0-alpha.0.1234+abcdef",
+		},
+		{
+			name:      "empty then valid",
+			responses: []string{"", "v1.12.0-alpha.0.1234+abcdef\n"},
+			expect:    "1.12.0-alpha.0.1234+abcdef",
+		},
+		{
+			name:      "truncated then valid",
+			responses: []string{"v1.12", "v1.12.0\n"},
+			expect:    "1.12.0",
+		},
+		{
+			name:      "always empty",
+			responses: []string{"", "", ""},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		requests := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, tc.responses[requests])
+			requests++
+		}))
+
+		v, err := fetchValidVersion(srv.URL, len(tc.responses), 0)
+		srv.Close()
+
+		if err != nil {
+			if !tc.expectErr {
+				t.Errorf("%s: fetchValidVersion() returned unwanted error: %v", tc.name, err)
+			}
+			continue
+		}
+		if tc.expectErr {
+			t.Errorf("%s: fetchValidVersion() expected an error, got %q", tc.name, v)
+		}
+		if v != tc.expect {
+			t.Errorf("%s: fetchValidVersion() got %q, wanted %q", tc.name, v, tc.expect)
+		}
+		if requests != len(tc.responses) {
+			t.Errorf("%s: made %d requests, wanted %d", tc.name, requests, len(tc.responses))
+		}
+	}
+}
+
+func TestOutputDir(t *testing.T) {
+	defer func(orig string) { *component = orig }(*component)
+	defer func(orig bool) { *perArchDirs = orig }(*perArchDirs)
+
+	testcases := []struct {
+		component, os string
+		perArch       bool
+		expect        string
+	}{
+		{"", "linux", false, filepath.Join("bin", "stable", "xenial")},
+		{"main", "linux", false, filepath.Join("bin", "stable", "main", "xenial")},
+		{"", "darwin", false, filepath.Join("bin", "stable", "xenial", "darwin")},
+		{"", "linux", true, filepath.Join("bin", "stable", "xenial", "armhf")},
+		{"main", "linux", true, filepath.Join("bin", "stable", "main", "xenial", "armhf")},
+	}
+
+	for _, tc := range testcases {
+		*component = tc.component
+		*perArchDirs = tc.perArch
+		c := cfg{
+			version:    version{Channel: ChannelStable},
+			DistroName: "xenial",
+			OS:         tc.os,
+			DebArch:    "armhf",
+		}
+		if got := c.outputDir(); got != tc.expect {
+			t.Errorf("outputDir() with component %q, os %s and per-arch dirs %v got %q, wanted %q", tc.component, tc.os, tc.perArch, got, tc.expect)
+		}
+	}
+}
+
+func TestValidateComponent(t *testing.T) {
+	for _, name := range []string{"", "main", "restricted", "non-free", "k8s1.11"} {
+		if err := validateComponent(name); err != nil {
+			t.Errorf("validateComponent(%q) returned unwanted error: %v", name, err)
+		}
+	}
+	for _, name := range []string{"Main", "-main", "main/extra", "my component"} {
+		if err := validateComponent(name); err == nil {
+			t.Errorf("validateComponent(%q) expected an error", name)
+		}
+	}
+}
+
+func TestInstalledSizeKiB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "installed-size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]int{
+		"usr/bin/kubectl":             1025,
+		"etc/default/kubelet":         1,
+		"lib/systemd/kubelet.service": 1024,
+		"DEBIAN/control":              4096,
+	}
+	for name, size := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	size, err := installedSizeKiB(dir)
+	if err != nil {
+		t.Fatalf("installedSizeKiB() returned unwanted error: %v", err)
+	}
+	if size != 4 {
+		t.Errorf("installedSizeKiB() got %d, wanted 4", size)
+	}
+}
+
+func TestSetControlField(t *testing.T) {
+	testcases := []struct {
+		control, expect string
+	}{
+		{
+			"Package: kubectl\nInstalled-Size: 1\nDescription: Kubernetes Command Line Tool\n text\n",
+			"Package: kubectl\nInstalled-Size: 42\nDescription: Kubernetes Command Line Tool\n text\n",
+		},
+		{
+			"Package: kubectl\nArchitecture: amd64\nDescription: Kubernetes Command Line Tool\n text\n",
+			"Package: kubectl\nArchitecture: amd64\nInstalled-Size: 42\nDescription: Kubernetes Command Line Tool\n text\n",
+		},
+		{
+			"Package: kubectl",
+			"Package: kubectl\nInstalled-Size: 42\n",
+		},
+	}
+	for _, tc := range testcases {
+		if got := setControlField(tc.control, "Installed-Size", "42"); got != tc.expect {
+			t.Errorf("setControlField(%q) got %q, wanted %q", tc.control, got, tc.expect)
+		}
+	}
+}
+
+func TestSetInstalledSize(t *testing.T) {
+	defer func(orig func(context.Context, string, []string, io.Writer, string, ...string) error) {
+		runCommand = orig
+	}(runCommand)
+
+	// The package the build wrote, including a binary its debian/rules
+	// downloaded.
+	built := map[string]string{
+		"DEBIAN/control":          "Package: kubernetes-cni\nInstalled-Size: 1\nDescription: Kubernetes CNI\n",
+		"opt/cni/bin/bridge":      strings.Repeat("x", 3000),
+		"usr/share/doc/copyright": "Apache-2.0",
+	}
+	var control string
+	runCommand = func(_ context.Context, _ string, _ []string, _ io.Writer, command string, args ...string) error {
+		if command != "dpkg-deb" {
+			return fmt.Errorf("unexpected command %s", command)
+		}
+		switch args[0] {
+		case "--raw-extract":
+			for name, content := range built {
+				file := filepath.Join(args[2], name)
+				if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+					return err
+				}
+				if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+					return err
+				}
+			}
+		case "--root-owner-group":
+			data, err := ioutil.ReadFile(filepath.Join(args[2], "DEBIAN", "control"))
+			control = string(data)
+			return err
+		}
+		return nil
+	}
+
+	if err := setInstalledSize(context.Background(), "kubernetes-cni_0.6.0-00_amd64.deb"); err != nil {
+		t.Fatalf("setInstalledSize() returned unwanted error: %v", err)
+	}
+	if want := "Package: kubernetes-cni\nInstalled-Size: 4\nDescription: Kubernetes CNI\n"; control != want {
+		t.Errorf("repacked control is %q, wanted %q", control, want)
+	}
+}
+
+func TestStringListSet(t *testing.T) {
+	testcases := []struct {
+		value  string
+		expect stringList
+	}{
+		{"amd64,arm64", stringList{"amd64", "arm64"}},
+		{" amd64 , arm64 ", stringList{"amd64", "arm64"}},
+		{"amd64,", stringList{"amd64"}},
+		{"", nil},
+		{",", nil},
+		{"  ", nil},
+		{" , ,", nil},
+	}
+
+	for _, tc := range testcases {
+		ss := stringList{"default"}
+		if err := ss.Set(tc.value); err != nil {
+			t.Errorf("Set(%q) returned unwanted error: %v", tc.value, err)
+		}
+		if !reflect.DeepEqual(ss, tc.expect) {
+			t.Errorf("Set(%q) got %#v, wanted %#v", tc.value, ss, tc.expect)
+		}
+		if err := requireNonEmpty("architecture", ss); (err != nil) != (len(tc.expect) == 0) {
+			t.Errorf("requireNonEmpty() after Set(%q) returned %v", tc.value, err)
+		}
+	}
+
+	err := requireNonEmpty("architecture", nil)
+	if err == nil || err.Error() != "at least one architecture must be specified" {
+		t.Errorf("requireNonEmpty(nil) returned %v", err)
+	}
+}
+
+// renderDefinition renders a file of a package definition the way cfg.run
+// does.
+func renderDefinition(t *testing.T, file string, c cfg) string {
+	tmpl, err := template.New("").Funcs(c.templateFuncs()).Option("missingkey=error").ParseFiles(file)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", file, err)
+	}
+	data, err := c.templateContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Templates()[0].Execute(&buf, data); err != nil {
+		t.Fatalf("rendering %s: %v", file, err)
+	}
+	return buf.String()
+}
+
+func TestChangelogGitCommit(t *testing.T) {
+	c := cfg{
+		version:     version{Version: "1.11.0", Revision: "00"},
+		Package:     "kubeadm",
+		PackageName: "kubeadm",
+		DistroName:  "xenial",
+		Arch:        "amd64",
+	}
+	changelog := filepath.Join("xenial", "kubeadm", "debian", "changelog")
+
+	if got := renderDefinition(t, changelog, c); strings.Contains(got, "commit") {
+		t.Errorf("changelog without a commit mentions one:\n%s", got)
+	}
+
+	c.GitCommit = "0123456789abcdef"
+	got := renderDefinition(t, changelog, c)
+	want := "CHANGELOG.md\n  * Packaged from kubernetes/release commit 0123456789abcdef\n\n -- "
+	if !strings.Contains(got, want) {
+		t.Errorf("changelog doesn't record the commit:\n%s", got)
+	}
+}
+
+func TestGitCommitOutsideRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "not-a-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if commit, err := gitCommit(dir); err == nil {
+		t.Errorf("gitCommit() outside a repository returned %q, wanted an error", commit)
+	}
+}
+
+func TestPackageName(t *testing.T) {
+	defer func(orig bool) { *channelSuffix = orig }(*channelSuffix)
+
+	testcases := []struct {
+		suffix  bool
+		channel ChannelType
+		expect  string
+	}{
+		{false, ChannelStable, "kubectl"},
+		{false, ChannelNightly, "kubectl"},
+		{true, ChannelStable, "kubectl"},
+		{true, ChannelUnstable, "kubectl-unstable"},
+		{true, ChannelNightly, "kubectl-nightly"},
+	}
+
+	for _, tc := range testcases {
+		*channelSuffix = tc.suffix
+		if got := packageName("kubectl", tc.channel); got != tc.expect {
+			t.Errorf("packageName(kubectl, %s) with suffix %v got %q, wanted %q", tc.channel, tc.suffix, got, tc.expect)
+		}
+	}
+}
+
+func TestChannelSuffixRewritesDependencies(t *testing.T) {
+	defer func(orig bool) { *channelSuffix = orig }(*channelSuffix)
+	*channelSuffix = true
+
+	c := cfg{
+		version:     version{Version: "1.11.0", Revision: "00", Channel: ChannelNightly, CNIVersion: "0.6.0"},
+		Package:     "kubeadm",
+		PackageName: packageName("kubeadm", ChannelNightly),
+		DebArch:     "amd64",
+	}
+	control := renderDefinition(t, filepath.Join("xenial", "kubeadm", "debian", "control"), c)
+
+	for _, want := range []string{
+		"Package: kubeadm-nightly\n",
+		"kubelet-nightly (>= 1.6.0)",
+		"kubectl-nightly (>= 1.6.0)",
+		"kubernetes-cni-nightly (>= 0.6.0)",
+		"cri-tools-nightly (>=1.11.0)",
+	} {
+		if !strings.Contains(control, want) {
+			t.Errorf("control doesn't contain %q:\n%s", want, control)
+		}
+	}
+}
+
+func TestChannelSuffixConflicts(t *testing.T) {
+	defer func(orig bool) { *channelSuffix = orig }(*channelSuffix)
+	*channelSuffix = true
+
+	// The suffixed packages ship the files of the stable one, which they
+	// replace, and stand in for it.
+	for _, pkg := range KnownPackages() {
+		for _, channel := range []ChannelType{ChannelStable, ChannelNightly} {
+			c := cfg{
+				version:     version{Version: "1.11.0", Revision: "00", Channel: channel, CNIVersion: "0.6.0", KubeletCNIVersion: "= 0.6.0-00"},
+				Package:     pkg,
+				PackageName: packageName(pkg, channel),
+				DebVersion:  "1.11.0-00",
+				DebArch:     "amd64",
+			}
+			control := renderDefinition(t, filepath.Join("xenial", pkg, "debian", "control"), c)
+			relations := []string{
+				"\nConflicts: " + pkg + "\n",
+				"\nReplaces: " + pkg + "\n",
+				"\nProvides: " + pkg + " (= 1.11.0-00)\n",
+			}
+			for _, want := range relations {
+				if got := strings.Contains(control, want); got != (channel != ChannelStable) {
+					t.Errorf("%s control contains %q: %v, wanted %v:\n%s", c.PackageName, want, got, !got, control)
+				}
+			}
+		}
+	}
+}
+
+func TestRenamePackageFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debian")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"kubectl.install", "control", "kubectl-other.install"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := renamePackageFiles(dir, "kubectl", "kubectl-nightly"); err != nil {
+		t.Fatalf("renamePackageFiles() returned unwanted error: %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	expect := []string{"control", "kubectl-nightly.install", "kubectl-other.install"}
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("renamePackageFiles() left %v, wanted %v", names, expect)
+	}
+}
+
+func TestCleanBuildLeftovers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leftovers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"debian/control",
+		"debian/files",
+		"debian/kubectl.substvars",
+		"debian/kubectl.debhelper.log",
+		"debian/.debhelper/generated/kubectl/installed-by-dh_install",
+		"usr/bin/files",
+	} {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := cleanBuildLeftovers(dir)
+	if err != nil {
+		t.Fatalf("cleanBuildLeftovers() returned unwanted error: %v", err)
+	}
+	sort.Strings(removed)
+	expect := []string{
+		"debian/.debhelper",
+		"debian/files",
+		"debian/kubectl.debhelper.log",
+		"debian/kubectl.substvars",
+	}
+	if !reflect.DeepEqual(removed, expect) {
+		t.Errorf("cleanBuildLeftovers() removed %v, wanted %v", removed, expect)
+	}
+
+	for _, name := range []string{"debian/control", "usr/bin/files"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("cleanBuildLeftovers() removed %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "debian", "files")); !os.IsNotExist(err) {
+		t.Errorf("debian/files still exists: %v", err)
+	}
+}
+
+func TestOverrideCompatLevel(t *testing.T) {
+	testcases := []struct {
+		name          string
+		control       string
+		compat        bool
+		expectControl string
+	}{
+		{
+			name:          "debian/compat",
+			control:       "Build-Depends: curl, debhelper (>= 8.0.0)\n",
+			compat:        true,
+			expectControl: "Build-Depends: curl, debhelper (>= 8.0.0)\n",
+		},
+		{
+			name:          "debhelper-compat",
+			control:       "Build-Depends: curl, debhelper-compat (= 9)\n",
+			expectControl: "Build-Depends: curl, debhelper-compat (= 11)\n",
+		},
+	}
+
+	for _, tc := range testcases {
+		dir, err := ioutil.TempDir("", "compat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := os.Mkdir(filepath.Join(dir, "debian"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "debian", "control"), []byte(tc.control), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tc.compat {
+			if err := ioutil.WriteFile(filepath.Join(dir, "debian", "compat"), []byte("9\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := overrideCompatLevel(dir, 11); err != nil {
+			t.Fatalf("%s: overrideCompatLevel() returned unwanted error: %v", tc.name, err)
+		}
+
+		control, _ := ioutil.ReadFile(filepath.Join(dir, "debian", "control"))
+		if string(control) != tc.expectControl {
+			t.Errorf("%s: got control %q, wanted %q", tc.name, control, tc.expectControl)
+		}
+		compat, err := ioutil.ReadFile(filepath.Join(dir, "debian", "compat"))
+		if tc.compat {
+			if string(compat) != "11\n" {
+				t.Errorf("%s: got debian/compat %q, wanted \"11\\n\"", tc.name, compat)
+			}
+		} else if !os.IsNotExist(err) {
+			t.Errorf("%s: debian/compat was created alongside debhelper-compat", tc.name)
+		}
+	}
+}
+
+func TestValidateCompatLevel(t *testing.T) {
+	for _, level := range []int{0, 5, 9, 13} {
+		if err := validateCompatLevel(level); err != nil {
+			t.Errorf("validateCompatLevel(%d) returned unwanted error: %v", level, err)
+		}
+	}
+	for _, level := range []int{-1, 4, 14} {
+		if err := validateCompatLevel(level); err == nil {
+			t.Errorf("validateCompatLevel(%d) expected an error", level)
+		}
+	}
+}
+
+func TestTemplateContext(t *testing.T) {
+	c := cfg{
+		version:      version{Version: "1.11.0"},
+		Package:      "cri-tools",
+		templateData: map[string]interface{}{"Tools": []string{"crictl", "critest"}},
+	}
+	data, err := c.templateContext()
+	if err != nil {
+		t.Fatalf("templateContext() returned unwanted error: %v", err)
+	}
+	if data["Version"] != "1.11.0" || data["Package"] != "cri-tools" {
+		t.Errorf("templateContext() lost the cfg fields: %v", data)
+	}
+	if !reflect.DeepEqual(data["Tools"], []string{"crictl", "critest"}) {
+		t.Errorf("templateContext() got Tools %v, wanted the template data", data["Tools"])
+	}
+	if _, ok := data["templateData"]; ok {
+		t.Errorf("templateContext() exposes unexported fields")
+	}
+
+	c.templateData = map[string]interface{}{"Version": "2.0.0"}
+	if _, err := c.templateContext(); err == nil {
+		t.Errorf("templateContext() with colliding template data expected an error")
+	}
+}
+
+func TestCRIToolsInstall(t *testing.T) {
+	c := cfg{
+		version:  version{Version: "1.11.0"},
+		Package:  "cri-tools",
+		Binaries: newBuild("cri-tools", nil).binaries(),
+	}
+	got := renderDefinition(t, filepath.Join("xenial", "cri-tools", "debian", "cri-tools.install"), c)
+	want := "bin/crictl usr/bin/\nbin/critest usr/bin/\n"
+	if got != want {
+		t.Errorf("cri-tools.install got %q, wanted %q", got, want)
+	}
+}
+
+func TestSmokeTests(t *testing.T) {
+	defer func(orig func(context.Context, string, []string, io.Writer, string, ...string) error) {
+		runCommand = orig
+	}(runCommand)
+
+	var invocations [][]string
+	runCommand = func(_ context.Context, _ string, _ []string, _ io.Writer, command string, args ...string) error {
+		invocations = append(invocations, append([]string{command}, args...))
+		return nil
+	}
+
+	native := getDebArch(runtime.GOARCH)
+	foreign := "s390x"
+	if native == foreign {
+		foreign = "amd64"
+	}
+
+	smoke := smokeTests{}
+	for _, c := range []cfg{
+		{Package: "kubelet", PackageName: "kubelet", DistroName: "xenial", OS: "linux", DebArch: native},
+		{Package: "kubeadm", PackageName: "kubeadm", DistroName: "xenial", OS: "linux", DebArch: native},
+		{Package: "kubectl", PackageName: "kubectl", DistroName: "xenial", OS: "linux", DebArch: foreign},
+	} {
+		c.version = version{Version: "1.11.0", Revision: "00", Channel: ChannelStable}
+		c.DebVersion = "1.11.0-00"
+		smoke.add(c)
+	}
+
+	images := map[string]string{"xenial": "ubuntu:xenial"}
+	if err := smoke.run(context.Background(), "docker", images); err != nil {
+		t.Fatalf("run() returned unwanted error: %v", err)
+	}
+	if len(invocations) != 1 {
+		t.Fatalf("got %d container runs, wanted 1: %v", len(invocations), invocations)
+	}
+
+	args := invocations[0]
+	if args[0] != "docker" || args[len(args)-4] != "ubuntu:xenial" {
+		t.Errorf("unexpected container invocation %v", args)
+	}
+	script := args[len(args)-1]
+	for _, want := range []string{
+		"/packages/kubelet_1.11.0-00_" + native + ".deb",
+		"/packages/kubeadm_1.11.0-00_" + native + ".deb",
+		"dpkg -s kubelet kubeadm",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("smoke test script doesn't contain %q: %s", want, script)
+		}
+	}
+	if strings.Contains(script, "kubectl") {
+		t.Errorf("smoke test script installs a package of a foreign architecture: %s", script)
+	}
+}
+
+func TestDistroImage(t *testing.T) {
+	testcases := []struct {
+		distro, expect string
+		expectErr      bool
+	}{
+		{"xenial", "ubuntu:xenial", false},
+		{"stretch", "debian:stretch", false},
+		{"sid", "debian:sid", false},
+		{"alpine", "", true},
+	}
+
+	for _, tc := range testcases {
+		image, err := distroImage(tc.distro)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("distroImage(%s) returned %v, expected error: %v", tc.distro, err, tc.expectErr)
+		}
+		if image != tc.expect {
+			t.Errorf("distroImage(%s) got %q, wanted %q", tc.distro, image, tc.expect)
+		}
+	}
+}
+
+type fakeGitHubClient struct {
+	pages    [][]gitHubRelease
+	requests int
+}
+
+func (f *fakeGitHubClient) ListReleases(owner, repo string, page int) ([]gitHubRelease, int, error) {
+	f.requests++
+	if page < 1 || page > len(f.pages) {
+		return nil, 0, fmt.Errorf("unexpected page %d", page)
+	}
+	next := page + 1
+	if next > len(f.pages) {
+		next = 0
+	}
+	return f.pages[page-1], next, nil
+}
+
+func TestGitHubReleaseSourceLatestVersion(t *testing.T) {
+	pages := [][]gitHubRelease{
+		{
+			{TagName: "v1.13.0", Draft: true},
+			{TagName: "v1.12.0-beta.0", Prerelease: true},
+			{TagName: "v1.11.1"},
+			{TagName: "latest"},
+		},
+		{
+			{TagName: "v1.12.0"},
+			{TagName: "v1.11.0"},
+		},
+	}
+
+	testcases := []struct {
+		constraint string
+		expect     string
+		expectErr  bool
+	}{
+		{"", "1.12.0", false},
+		{">=1.11.0 <1.12.0", "1.11.1", false},
+		{"<1.11.0", "", true},
+		{"not a range", "", true},
+	}
+
+	for _, tc := range testcases {
+		client := &fakeGitHubClient{pages: pages}
+		s := &GitHubReleaseSource{Owner: "o", Repo: "r", Constraint: tc.constraint, client: client}
+		v, err := s.LatestVersion()
+		if (err != nil) != tc.expectErr {
+			t.Errorf("LatestVersion() with constraint %q returned %v, expected error: %v", tc.constraint, err, tc.expectErr)
+			continue
+		}
+		if v != tc.expect {
+			t.Errorf("LatestVersion() with constraint %q got %q, wanted %q", tc.constraint, v, tc.expect)
+		}
+		if tc.expectErr {
+			continue
+		}
+		if _, err := s.LatestVersion(); err != nil {
+			t.Errorf("second LatestVersion() returned %v", err)
+		}
+		if client.requests != len(pages) {
+			t.Errorf("got %d requests, wanted %d; the result should be remembered", client.requests, len(pages))
+		}
+	}
+}
+
+func TestGitHubAPIClientListReleases(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/o/r/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "token secret" {
+			t.Errorf("got Authorization %q, wanted %q", got, "token secret")
+		}
+		switch r.URL.Query().Get("page") {
+		case "1":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/repos/o/r/releases?per_page=100&page=2>; rel="next", <%s/repos/o/r/releases?per_page=100&page=2>; rel="last"`, server.URL, server.URL))
+			fmt.Fprint(w, `[{"tag_name": "v1.0.0"}]`)
+		case "2":
+			fmt.Fprint(w, `[{"tag_name": "v0.9.0", "prerelease": true}]`)
+		default:
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", "1530000000")
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	client := &gitHubAPIClient{baseURL: server.URL, token: "secret"}
+
+	releases, next, err := client.ListReleases("o", "r", 1)
+	if err != nil {
+		t.Fatalf("ListReleases(page 1) returned unwanted error: %v", err)
+	}
+	if !reflect.DeepEqual(releases, []gitHubRelease{{TagName: "v1.0.0"}}) || next != 2 {
+		t.Errorf("ListReleases(page 1) got %v, next %d", releases, next)
+	}
+
+	releases, next, err = client.ListReleases("o", "r", 2)
+	if err != nil {
+		t.Fatalf("ListReleases(page 2) returned unwanted error: %v", err)
+	}
+	if !reflect.DeepEqual(releases, []gitHubRelease{{TagName: "v0.9.0", Prerelease: true}}) || next != 0 {
+		t.Errorf("ListReleases(page 2) got %v, next %d", releases, next)
+	}
+
+	_, _, err = client.ListReleases("o", "r", 3)
+	if err == nil {
+		t.Fatalf("ListReleases() succeeded despite the rate limit")
+	}
+	for _, want := range []string{"rate limit", "2018-06-26T08:00:00Z", "--github-token"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("rate limit error %q doesn't contain %q", err, want)
+		}
+	}
+}
+
+func TestChangelogHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "changelog-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "debs", "debian"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dstdir := filepath.Join(dir, "debs")
+	history := filepath.Join(dir, "history")
+
+	c := cfg{
+		version:      version{Version: "1.11.1", Revision: "00", Channel: ChannelStable},
+		Package:      "kubectl",
+		PackageName:  "kubectl",
+		DebVersion:   "1.11.1-00",
+		DistroName:   "xenial",
+		Urgency:      channelUrgency(ChannelStable),
+		Distribution: channelDistribution("xenial", ChannelStable),
+	}
+	prior := "kubectl (1.11.0-00) xenial; urgency=medium\n\n  * 1.11.0\n\n -- Kubernetes Authors <kubernetes-dev@googlegroups.com>  Wed, 27 Jun 2018 18:00:00 +0000\n"
+	newer := "kubectl (1.12.0-00) xenial; urgency=medium\n\n  * 1.12.0\n\n -- Kubernetes Authors <kubernetes-dev@googlegroups.com>  Thu, 27 Sep 2018 18:00:00 +0000\n"
+	historyFile := c.changelogHistoryFile(history)
+	if err := os.MkdirAll(filepath.Dir(historyFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(historyFile, []byte(prior+"\n"+newer), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rendered := renderDefinition(t, filepath.Join("xenial", "kubectl", "debian", "changelog"), c)
+	changelogFile := filepath.Join(dstdir, "debian", "changelog")
+	if err := ioutil.WriteFile(changelogFile, []byte(rendered), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := c.applyChangelogHistory(dstdir, history)
+	if err != nil {
+		t.Fatalf("applyChangelogHistory() returned unwanted error: %v", err)
+	}
+	if err := c.saveChangelogHistory(history, entry); err != nil {
+		t.Fatalf("saveChangelogHistory() returned unwanted error: %v", err)
+	}
+	data, err := ioutil.ReadFile(historyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := string(data)
+	got, err := ioutil.ReadFile(changelogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(got), "kubectl (1.11.1-00) xenial; urgency=medium\n") {
+		t.Errorf("changelog doesn't start with the new entry:\n%s", got)
+	}
+	if !strings.HasSuffix(string(got), "\n\n"+prior) {
+		t.Errorf("changelog doesn't keep the prior entry below the new one:\n%s", got)
+	}
+	if strings.Contains(string(got), "1.12.0") {
+		t.Errorf("changelog contains an entry newer than the package:\n%s", got)
+	}
+
+	entries, err := parseChangelog(updated)
+	if err != nil {
+		t.Fatalf("updated history doesn't parse: %v", err)
+	}
+	var versions []string
+	for _, e := range entries {
+		versions = append(versions, e.version)
+	}
+	if want := []string{"1.12.0-00", "1.11.1-00", "1.11.0-00"}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("updated history has versions %v, wanted %v", versions, want)
+	}
+
+	// Rebuilding the same version replaces its entry.
+	_, again, err := mergeChangelog(rendered, updated)
+	if err != nil {
+		t.Fatalf("mergeChangelog() returned unwanted error: %v", err)
+	}
+	if n := strings.Count(again, "(1.11.1-00)"); n != 1 {
+		t.Errorf("history has %d entries for the rebuilt version, wanted 1", n)
+	}
+
+	// Other channels of the same package keep a history of their own.
+	nightly := c
+	nightly.Channel = ChannelNightly
+	if nightly.changelogHistoryFile(history) == historyFile {
+		t.Errorf("the stable and nightly builds of %s share the history %s", c.PackageName, historyFile)
+	}
+}
+
+func TestSaveChangelogHistoryConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "changelog-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The builds of the architectures of a package share its history, and
+	// entries saved at once must all be kept.
+	var builds []cfg
+	var rendered []string
+	for i := 0; i < 8; i++ {
+		c := cfg{
+			version:      version{Version: fmt.Sprintf("1.11.%d", i), Revision: "00", Channel: ChannelStable},
+			Package:      "kubectl",
+			PackageName:  "kubectl",
+			DebVersion:   fmt.Sprintf("1.11.%d-00", i),
+			DistroName:   "xenial",
+			Urgency:      channelUrgency(ChannelStable),
+			Distribution: channelDistribution("xenial", ChannelStable),
+			clock:        fakeClock{time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)},
+		}
+		builds = append(builds, c)
+		rendered = append(rendered, renderDefinition(t, filepath.Join("xenial", "kubectl", "debian", "changelog"), c))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(builds))
+	for i, c := range builds {
+		wg.Add(1)
+		go func(c cfg, rendered string) {
+			defer wg.Done()
+			errs <- c.saveChangelogHistory(dir, rendered)
+		}(c, rendered[i])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("saveChangelogHistory() returned unwanted error: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile((cfg{DistroName: "xenial", PackageName: "kubectl", version: version{Channel: ChannelStable}}).changelogHistoryFile(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := parseChangelog(string(data))
+	if err != nil {
+		t.Fatalf("history doesn't parse: %v", err)
+	}
+	if len(entries) != cap(errs) {
+		t.Errorf("history has %d entries, wanted %d:\n%s", len(entries), cap(errs), data)
+	}
+}
+
+func TestCompareDebianVersions(t *testing.T) {
+	testcases := []struct {
+		a, b   string
+		expect int
+	}{
+		{"1.11.0-00", "1.11.0-00", 0},
+		{"1.11.0-00", "1.11.1-00", -1},
+		{"1.11.10-00", "1.11.9-00", 1},
+		{"1.11.0-01", "1.11.0-00", 1},
+		{"1.11.0~beta.1-00", "1.11.0-00", -1},
+		{"1.11.0-beta.1-00", "1.11.0-00", 1},
+		{"1:1.10.0-00", "1.11.0-00", 1},
+		{"1.11.0a-00", "1.11.0+a-00", -1},
+	}
+
+	for _, tc := range testcases {
+		if got := compareDebianVersions(tc.a, tc.b); got != tc.expect {
+			t.Errorf("compareDebianVersions(%q, %q) got %d, wanted %d", tc.a, tc.b, got, tc.expect)
+		}
+	}
+}
+
+func TestNativeArchitectures(t *testing.T) {
+	defer func(orig string) { hostArch = orig }(hostArch)
+	defer func(orig stringList) { architectures = orig }(architectures)
+
+	testcases := []struct {
+		host      string
+		archs     stringList
+		expect    stringList
+		expectErr bool
+	}{
+		{"amd64", stringList{"amd64", "arm", "arm64", "ppc64le", "s390x"}, stringList{"amd64"}, false},
+		{"ppc64le", stringList{"amd64", "arm", "arm64", "ppc64le", "s390x"}, stringList{"ppc64le"}, false},
+		{"arm64", stringList{"amd64"}, nil, true},
+		{"mips", stringList{"amd64", "arm", "arm64", "ppc64le", "s390x"}, nil, true},
+	}
+
+	for _, tc := range testcases {
+		hostArch = tc.host
+		got, err := nativeArchitectures(tc.archs, hostArch)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("nativeArchitectures(%v, %s) returned %v, expected error: %v", tc.archs, tc.host, err, tc.expectErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("nativeArchitectures(%v, %s) got %v, wanted %v", tc.archs, tc.host, got, tc.expect)
+		}
+		if err != nil {
+			continue
+		}
+
+		architectures = got
+		var built []string
+		builds := []build{{
+			Package:  "kubectl",
+			Distros:  []string{"xenial"},
+			Versions: []version{{Version: "1.11.0", Revision: "00", Channel: ChannelStable}},
+		}}
+		if err := walkBuilds(builds, func(_ build, _, _, arch string, _ version) error {
+			built = append(built, arch)
+			return nil
+		}); err != nil {
+			t.Fatalf("walkBuilds() returned unwanted error: %v", err)
+		}
+		if want := []string{tc.host}; !reflect.DeepEqual(built, want) {
+			t.Errorf("with host %s built for %v, wanted %v", tc.host, built, want)
+		}
+	}
+}
+
+func TestParseDpkgMessages(t *testing.T) {
+	output := strings.Join([]string{
+		"dpkg-buildpackage: info: source package kubectl",
+		"dh: warning: Compatibility levels before 9 are deprecated (level 5 in use)",
+		"dpkg-gencontrol: warning: Depends field of package kubeadm: unknown substitution variable ${shlibs:Depends}",
+		"dpkg-shlibdeps (1.18.4): error: cannot find library libfoo.so.1",
+		"   needed by debian/kubelet/usr/bin/kubelet",
+		"W: kubectl: binary-without-manpage usr/bin/kubectl",
+		"dpkg-deb: building package 'kubectl' in '../kubectl_1.11.0-00_amd64.deb'.",
+		"  not a continuation",
+	}, "\n")
+
+	want := []dpkgMessage{
+		{"dh", "warning", "Compatibility levels before 9 are deprecated (level 5 in use)"},
+		{"dpkg-gencontrol", "warning", "Depends field of package kubeadm: unknown substitution variable ${shlibs:Depends}"},
+		{"dpkg-shlibdeps", "error", "cannot find library libfoo.so.1 needed by debian/kubelet/usr/bin/kubelet"},
+		{"lintian", "warning", "kubectl: binary-without-manpage usr/bin/kubectl"},
+	}
+	if got := parseDpkgMessages(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDpkgMessages() got\n%v\nwanted\n%v", got, want)
+	}
+}
+
+func TestBuildDebWarningsAsErrors(t *testing.T) {
+	defer func(orig func(context.Context, string, []string, io.Writer, string, ...string) error) {
+		runCommand = orig
+	}(runCommand)
+	defer func(orig bool) { *warningsAsErrors = orig }(*warningsAsErrors)
+
+	var moved bool
+	runCommand = func(_ context.Context, _ string, _ []string, out io.Writer, command string, _ ...string) error {
+		switch command {
+		case "dpkg-buildpackage":
+			fmt.Fprintln(out, "dpkg-gencontrol: warning: unknown substitution variable ${misc:Depends}")
+		case "mv":
+			moved = true
+		}
+		return nil
+	}
+
+	c := cfg{
+		version:     version{Version: "1.11.0", Revision: "00", Channel: ChannelStable},
+		Package:     "kubectl",
+		PackageName: "kubectl",
+		DistroName:  "xenial",
+		OS:          "linux",
+		Arch:        "amd64",
+		DebArch:     "amd64",
+		messages:    &[]dpkgMessage{},
+	}
+
+	*warningsAsErrors = true
+	err := c.buildDeb(context.Background(), "")
+	if _, ok := err.(*dpkgWarningsError); !ok {
+		t.Errorf("buildDeb() returned %v, wanted a dpkgWarningsError", err)
+	}
+	if moved {
+		t.Errorf("package with warnings was moved to the output directory")
+	}
+	if len(*c.messages) != 1 || (*c.messages)[0].Tool != "dpkg-gencontrol" {
+		t.Errorf("got messages %v, wanted the dpkg-gencontrol warning", *c.messages)
+	}
+}
+
+func TestEpoch(t *testing.T) {
+	v := version{Version: "1.20.0", Revision: "00", Channel: ChannelStable}
+
+	testcases := []struct {
+		epoch     int
+		expect    string
+		expectErr bool
+	}{
+		{0, "1.20.0-00", false},
+		{1, "1:1.20.0-00", false},
+		{-1, "", true},
+	}
+
+	for _, tc := range testcases {
+		if err := validateEpoch(tc.epoch); (err != nil) != tc.expectErr {
+			t.Errorf("validateEpoch(%d) returned %v, expected error: %v", tc.epoch, err, tc.expectErr)
+		}
+		if tc.expectErr {
+			continue
+		}
+
+		deb, err := debVersion(tc.epoch, v, "")
+		if err != nil {
+			t.Fatalf("debVersion(%d) returned unwanted error: %v", tc.epoch, err)
+		}
+		c := cfg{
+			version:      v,
+			Package:      "kubectl",
+			PackageName:  "kubectl",
+			DebVersion:   deb,
+			DistroName:   "xenial",
+			DebArch:      "amd64",
+			Urgency:      "medium",
+			Distribution: "xenial",
+		}
+		if c.DebVersion != tc.expect {
+			t.Errorf("debVersion(%d) got %q, wanted %q", tc.epoch, c.DebVersion, tc.expect)
+		}
+		changelog := renderDefinition(t, filepath.Join("xenial", "kubectl", "debian", "changelog"), c)
+		if want := "kubectl (" + tc.expect + ") xenial;"; !strings.HasPrefix(changelog, want) {
+			t.Errorf("changelog with epoch %d doesn't start with %q:\n%s", tc.epoch, want, changelog)
+		}
+		if got := c.debFileName(); got != "kubectl_1.20.0-00_amd64.deb" {
+			t.Errorf("debFileName() with epoch %d got %q, the epoch isn't part of file names", tc.epoch, got)
+		}
+	}
+}
+
+func TestParseDebFileNameEpoch(t *testing.T) {
+	testcases := []struct {
+		name          string
+		expectVersion string
+		expectOK      bool
+	}{
+		{"kubectl_1.20.0-00_amd64.deb", "1.20.0", true},
+		{"kubectl_1:1.20.0-00_amd64.deb", "1:1.20.0", true},
+		{"kubectl_1%3a1.20.0-00_amd64.deb", "1:1.20.0", true},
+		{"kubectl_1%3A1.20.0-00_amd64.deb", "1:1.20.0", true},
+		{"kubectl_x:1.20.0-00_amd64.deb", "", false},
+	}
+
+	for _, tc := range testcases {
+		deb, ok := parseDebFileName(tc.name)
+		if ok != tc.expectOK {
+			t.Errorf("parseDebFileName(%s) got ok %v, wanted %v", tc.name, ok, tc.expectOK)
+			continue
+		}
+		if ok && (deb.version != tc.expectVersion || deb.revision != "00" || deb.arch != "amd64") {
+			t.Errorf("parseDebFileName(%s) got %+v, wanted version %s", tc.name, deb, tc.expectVersion)
+		}
+	}
+}
+
+func TestBuildStateResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgFor := func(arch, debVersion string) cfg {
+		return cfg{
+			version:     version{Channel: ChannelStable},
+			DebVersion:  debVersion,
+			PackageName: "kubectl",
+			DistroName:  "xenial",
+			OS:          "linux",
+			Arch:        arch,
+		}
+	}
+	amd64, arm64 := cfgFor("amd64", "1.11.0-00"), cfgFor("arm64", "1.11.0-00")
+
+	path := filepath.Join(dir, "state")
+	s, err := loadBuildState(path, false)
+	if err != nil {
+		t.Fatalf("loadBuildState() returned unwanted error: %v", err)
+	}
+	if err := s.record(amd64.stateEntry()); err != nil {
+		t.Fatalf("record() returned unwanted error: %v", err)
+	}
+	// The run is killed while recording the arm64 build.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(f, `{"package":"kubectl","distro":"xe`)
+	f.Close()
+
+	s, err = loadBuildState(path, true)
+	if err != nil {
+		t.Fatalf("loadBuildState() returned unwanted error: %v", err)
+	}
+	testcases := []struct {
+		c      cfg
+		expect bool
+	}{
+		{amd64, true},
+		{arm64, false},
+		{cfgFor("amd64", "1.11.1-00"), false},
+		{cfgFor("amd64", "1.11.0-01"), false},
+		// Another --epoch or --version-metadata is another package.
+		{cfgFor("amd64", "1:1.11.0-00"), false},
+		{cfgFor("amd64", "1.11.0+job-00"), false},
+	}
+	for _, tc := range testcases {
+		if got := s.done(tc.c.stateEntry()); got != tc.expect {
+			t.Errorf("done(%+v) got %v, wanted %v", tc.c.stateEntry(), got, tc.expect)
+		}
+	}
+
+	if err := s.record(arm64.stateEntry()); err != nil {
+		t.Fatalf("record() returned unwanted error: %v", err)
+	}
+	s, err = loadBuildState(path, true)
+	if err != nil {
+		t.Fatalf("loadBuildState() returned unwanted error: %v", err)
+	}
+	if !s.done(amd64.stateEntry()) || !s.done(arm64.stateEntry()) {
+		t.Errorf("state after resuming doesn't record both builds: %v", s.completed)
+	}
+
+	// Without --resume, and with a corrupt state, everything is built.
+	if s, err = loadBuildState(path, false); err != nil || s.done(amd64.stateEntry()) {
+		t.Errorf("loadBuildState() without resume kept completed builds (err %v)", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("garbage\n"+`{"package":"kubectl"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = loadBuildState(path, true); err != nil || len(s.completed) != 0 {
+		t.Errorf("loadBuildState() of a corrupt state got %v (err %v), wanted no completed builds", s.completed, err)
+	}
+}
+
+func TestValidateRevision(t *testing.T) {
+	testcases := []struct {
+		revision  string
+		expectErr bool
+	}{
+		{"00", false},
+		{"1", false},
+		{"0ubuntu1", false},
+		{"1+deb9u1", false},
+		{"1~rc.1", false},
+		{"", true},
+		{"1:2", true},
+		{"bad rev", true},
+		{"1-2", true},
+	}
+
+	for _, tc := range testcases {
+		if err := validateRevision(tc.revision); (err != nil) != tc.expectErr {
+			t.Errorf("validateRevision(%q) returned %v, expected error: %v", tc.revision, err, tc.expectErr)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	stableArm64Xenial := map[string]string{"package": "kubectl", "distro": "xenial", "os": "linux", "arch": "arm64", "channel": "stable", "version": "1.11.0"}
+	nightlyAmd64Trusty := map[string]string{"package": "kubeadm", "distro": "trusty", "os": "linux", "arch": "amd64", "channel": "nightly", "version": "1.12.0-alpha.0.123+abcdef"}
+
+	testcases := []struct {
+		filter    string
+		expect    []bool // for stableArm64Xenial and nightlyAmd64Trusty
+		expectErr bool
+	}{
+		{"channel==stable && arch==arm64 && distro!=trusty", []bool{true, false}, false},
+		{"arch == amd64", []bool{false, true}, false},
+		{`version=="1.12.0-alpha.0.123+abcdef"`, []bool{false, true}, false},
+		{"version==1.11.0", []bool{true, false}, false},
+		// && binds tighter than ||.
+		{"channel==nightly || channel==stable && arch==amd64", []bool{false, true}, false},
+		{"(channel==nightly || channel==stable) && arch==amd64", []bool{false, true}, false},
+		{"(channel==nightly || channel==stable) && arch!=amd64", []bool{true, false}, false},
+		// ! binds tighter than &&.
+		{"!distro==trusty && package==kubectl", []bool{true, false}, false},
+		{"!(distro==trusty && package==kubeadm)", []bool{true, false}, false},
+		{"!!package==kubeadm", []bool{false, true}, false},
+		{"", nil, true},
+		{"color==blue", nil, true},
+		{"arch=arm64", nil, true},
+		{"arch==", nil, true},
+		{"(arch==arm64", nil, true},
+		{"arch==arm64)", nil, true},
+		{"arch==arm64 &&", nil, true},
+		{`version=="1.11.0`, nil, true},
+		{"arch==arm64 distro==xenial", nil, true},
+	}
+
+	for _, tc := range testcases {
+		expr, err := parseFilter(tc.filter)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("parseFilter(%q) returned %v, expected error: %v", tc.filter, err, tc.expectErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for i, fields := range []map[string]string{stableArm64Xenial, nightlyAmd64Trusty} {
+			if got := expr.match(fields); got != tc.expect[i] {
+				t.Errorf("filter %q on %v got %v, wanted %v", tc.filter, fields, got, tc.expect[i])
+			}
+		}
+	}
+}
+
+func TestWalkBuildsFilter(t *testing.T) {
+	defer func(orig filterExpr) { buildFilter = orig }(buildFilter)
+	defer func(orig stringList) { architectures = orig }(architectures)
+	architectures = stringList{"amd64", "arm64"}
+
+	var err error
+	if buildFilter, err = parseFilter("channel==stable && arch==arm64 && distro!=trusty"); err != nil {
+		t.Fatal(err)
+	}
+
+	builds := []build{{
+		Package: "kubectl",
+		Distros: []string{"xenial", "trusty"},
+		Versions: []version{
+			{Version: "1.11.0", Revision: "00", Channel: ChannelStable},
+			{Version: "1.12.0-beta.0", Revision: "00", Channel: ChannelUnstable},
+		},
+	}}
+	var built []string
+	if err := walkBuilds(builds, func(b build, distro, _, arch string, v version) error {
+		built = append(built, fmt.Sprintf("%s/%s/%s/%s", b.Package, distro, arch, v.Channel))
+		return nil
+	}); err != nil {
+		t.Fatalf("walkBuilds() returned unwanted error: %v", err)
+	}
+	if want := []string{"kubectl/xenial/arm64/stable"}; !reflect.DeepEqual(built, want) {
+		t.Errorf("walkBuilds() with a filter built %v, wanted %v", built, want)
+	}
+
+	// The meta-package is built for the first architecture the filter
+	// keeps, not skipped with the first one published.
+	if buildFilter, err = parseFilter("arch==arm64"); err != nil {
+		t.Fatal(err)
+	}
+	builds = []build{newBuild(metaPackage, []version{{Version: "1.11.0", Revision: "00", Channel: ChannelStable}})}
+	builds[0].Distros = []string{"xenial"}
+	built = nil
+	if err := walkBuilds(builds, func(b build, distro, _, arch string, v version) error {
+		built = append(built, fmt.Sprintf("%s/%s/%s/%s", b.Package, distro, arch, v.Channel))
+		return nil
+	}); err != nil {
+		t.Fatalf("walkBuilds() returned unwanted error: %v", err)
+	}
+	if want := []string{"kubernetes/xenial/arm64/stable"}; !reflect.DeepEqual(built, want) {
+		t.Errorf("walkBuilds() of the meta-package with a filter built %v, wanted %v", built, want)
+	}
+}
+
+func TestWriteAptIndex(t *testing.T) {
+	defer func(orig func(context.Context, string, []string, io.Writer, string, ...string) error) {
+		runCommand = orig
+	}(runCommand)
+
+	dir, err := ioutil.TempDir("", "apt-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, deb := range []string{"kubectl_1.11.0-00_amd64.deb", "kubectl_1.11.0-00_arm64.deb"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, deb), []byte(deb), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A dpkg-scanpackages that indexes the packages by name.
+	runCommand = func(_ context.Context, pwd string, _ []string, _ io.Writer, command string, args ...string) error {
+		if command != "sh" || !strings.Contains(args[len(args)-1], "dpkg-scanpackages") {
+			return fmt.Errorf("unexpected command %s %v", command, args)
+		}
+		files, _ := filepath.Glob(filepath.Join(pwd, "*.deb"))
+		var index bytes.Buffer
+		for _, f := range files {
+			fmt.Fprintf(&index, "Package: kubectl\nFilename: ./%s\n\n", filepath.Base(f))
+		}
+		return ioutil.WriteFile(filepath.Join(pwd, "Packages"), index.Bytes(), 0644)
+	}
+
+	info := releaseInfo{Origin: "Kubernetes", Label: "Kubernetes", Suite: "stable", Codename: "xenial"}
+	now := time.Date(2018, 7, 4, 12, 0, 0, 0, time.FixedZone("PDT", -7*3600))
+	if err := writeAptIndex(context.Background(), dir, info, now); err != nil {
+		t.Fatalf("writeAptIndex() returned unwanted error: %v", err)
+	}
+
+	release, err := ioutil.ReadFile(filepath.Join(dir, "Release"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Origin: Kubernetes\n",
+		"Suite: stable\n",
+		"Codename: xenial\n",
+		"Date: Wed, 04 Jul 2018 19:00:00 UTC\n",
+		"Architectures: amd64 arm64\n",
+	} {
+		if !bytes.Contains(release, []byte(want)) {
+			t.Errorf("Release doesn't contain %q:\n%s", want, release)
+		}
+	}
+	if bytes.Contains(release, []byte("Components:")) {
+		t.Errorf("Release has Components without a component:\n%s", release)
+	}
+
+	// Every index must be listed with its size and checksums.
+	sums := map[string][]string{}
+	section := ""
+	for _, line := range strings.Split(string(release), "\n") {
+		if strings.HasSuffix(line, ":") {
+			section = strings.TrimSuffix(line, ":")
+			continue
+		}
+		if strings.HasPrefix(line, " ") {
+			sums[section] = append(sums[section], strings.TrimSpace(line))
+		}
+	}
+	for _, section := range []string{"MD5Sum", "SHA256"} {
+		var want []string
+		for _, index := range aptIndexes {
+			data, err := ioutil.ReadFile(filepath.Join(dir, index))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sum string
+			if section == "MD5Sum" {
+				s := md5.Sum(data)
+				sum = hex.EncodeToString(s[:])
+			} else {
+				s := sha256.Sum256(data)
+				sum = hex.EncodeToString(s[:])
+			}
+			want = append(want, fmt.Sprintf("%s %16d %s", sum, len(data), index))
+		}
+		if !reflect.DeepEqual(sums[section], want) {
+			t.Errorf("Release %s section got %q, wanted %q", section, sums[section], want)
+		}
+	}
+
+	zr, err := os.Open(filepath.Join(dir, "Packages.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	gz, err := gzip.NewReader(zr)
+	if err != nil {
+		t.Fatalf("Packages.gz isn't gzipped: %v", err)
+	}
+	unzipped, _ := ioutil.ReadAll(gz)
+	packages, _ := ioutil.ReadFile(filepath.Join(dir, "Packages"))
+	if !bytes.Equal(unzipped, packages) {
+		t.Errorf("Packages.gz doesn't hold Packages")
+	}
+}
+
+func TestVersionCachePrefetch(t *testing.T) {
+	const parallelism = 3
+
+	var (
+		mu                sync.Mutex
+		fetches           = map[string]int{}
+		running, maxSeen  int
+		release           = make(chan struct{})
+		allowConcurrently = make(chan struct{}, 100)
+	)
+	vc := &versionCache{fetch: func(url string) (string, error) {
+		mu.Lock()
+		fetches[url]++
+		running++
+		if running > maxSeen {
+			maxSeen = running
+		}
+		mu.Unlock()
+		allowConcurrently <- struct{}{}
+		<-release
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if strings.HasSuffix(url, "broken") {
+			return "", fmt.Errorf("%s is broken", url)
+		}
+		return strings.TrimPrefix(url, "https://example.com/"), nil
+	}}
+
+	var urls []string
+	for i := 0; i < 8; i++ {
+		urls = append(urls, fmt.Sprintf("https://example.com/1.11.%d", i))
+	}
+	// Duplicates share the fetch of their URL.
+	urls = append(urls, urls[0], urls[1], "https://example.com/broken", urls[0])
+
+	done := make(chan error)
+	go func() { done <- vc.prefetch(urls, parallelism) }()
+
+	// Wait until the pool is saturated before letting fetches finish.
+	for i := 0; i < parallelism; i++ {
+		<-allowConcurrently
+	}
+	close(release)
+	err := <-done
+
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("prefetch() returned %v, wanted the error of the broken URL", err)
+	}
+	if maxSeen != parallelism {
+		t.Errorf("saw %d concurrent fetches, wanted %d", maxSeen, parallelism)
+	}
+	for url, n := range fetches {
+		if n != 1 {
+			t.Errorf("%s was fetched %d times, wanted once", url, n)
+		}
+	}
+	if len(fetches) != 9 {
+		t.Errorf("fetched %d distinct URLs, wanted 9", len(fetches))
+	}
+
+	// The build phase finds the versions memoized.
+	if v, err := vc.get(urls[3]); err != nil || v != "1.11.3" {
+		t.Errorf("get(%s) got %q, %v; wanted 1.11.3", urls[3], v, err)
+	}
+	if fetches[urls[3]] != 1 {
+		t.Errorf("get() after prefetch() fetched again")
+	}
+}
+
+func TestDebVersionMetadata(t *testing.T) {
+	testcases := []struct {
+		version   string
+		epoch     int
+		metadata  string
+		expect    string
+		expectErr bool
+	}{
+		{"1.11.0", 0, "", "1.11.0-00", false},
+		{"1.12.0-beta.0", 0, "", "1.12.0-beta.0-00", false},
+		{"1.11.0", 0, "job.1234", "1.11.0+job.1234-00", false},
+		{"1.12.0-beta.0", 0, "job.1234", "1.12.0~beta.0+job.1234-00", false},
+		{"1.12.0-alpha.0.123-abcdef", 0, "job-1", "1.12.0~alpha.0.123-abcdef+job-1-00", false},
+		{"1.12.0-rc.1", 1, "job.1234", "1:1.12.0~rc.1+job.1234-00", false},
+		{"not-a-real-version", 0, "job.1234", "", true},
+	}
+
+	for _, tc := range testcases {
+		got, err := debVersion(tc.epoch, version{Version: tc.version, Revision: "00"}, tc.metadata)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("debVersion(%d, %s, %s) returned %v, expected error: %v", tc.epoch, tc.version, tc.metadata, err, tc.expectErr)
+			continue
+		}
+		if got != tc.expect {
+			t.Errorf("debVersion(%d, %s, %s) got %q, wanted %q", tc.epoch, tc.version, tc.metadata, got, tc.expect)
+		}
+	}
+
+	// With metadata, versions still sort in semver order.
+	var ordered []string
+	for _, v := range []string{"1.12.0-alpha.0", "1.12.0-alpha.1", "1.12.0-beta.0", "1.12.0-rc.1", "1.12.0", "1.12.1-alpha.0", "1.12.1"} {
+		deb, err := debVersion(0, version{Version: v, Revision: "00"}, "job.1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ordered = append(ordered, deb)
+	}
+	for i := 1; i < len(ordered); i++ {
+		if compareDebianVersions(ordered[i-1], ordered[i]) >= 0 {
+			t.Errorf("%s doesn't sort before %s", ordered[i-1], ordered[i])
+		}
+	}
+}
+
+func TestValidateVersionMetadata(t *testing.T) {
+	testcases := []struct {
+		metadata  string
+		expectErr bool
+	}{
+		{"", false},
+		{"1234", false},
+		{"job.1234", false},
+		{"ci-job.1234.abcdef", false},
+		{"job..1234", true},
+		{"job_1234", true},
+		{"job+1234", true},
+		{".job", true},
+	}
+
+	for _, tc := range testcases {
+		if err := validateVersionMetadata(tc.metadata); (err != nil) != tc.expectErr {
+			t.Errorf("validateVersionMetadata(%q) returned %v, expected error: %v", tc.metadata, err, tc.expectErr)
+		}
+	}
+}
+
+func TestDistroVersions(t *testing.T) {
+	testcases := []struct {
+		distro string
+		expect string
+	}{
+		{"xenial", "16.04"},
+		{"trusty", "14.04"},
+		{"precise", "12.04"},
+		{"utopic", "14.10"},
+		{"vivid", "15.04"},
+		{"wily", "15.10"},
+		{"yakkety", "16.10"},
+		{"focal", "20.04"},
+		{"jammy", "22.04"},
+		{"wheezy", "7"},
+		{"jessie", "8"},
+		{"stretch", "9"},
+		{"sid", ""},
+	}
+
+	for _, tc := range testcases {
+		if got := distroVersions[tc.distro]; got != tc.expect {
+			t.Errorf("distroVersions[%s] got %q, wanted %q", tc.distro, got, tc.expect)
+		}
+	}
+}
+
+func TestRenderWorkUnknownDistroVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distro-version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	render := func(text string, c cfg) error {
+		tmpl, err := template.New("control").Option("missingkey=error").Parse(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(dir, "control")
+		info, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return renderWork([]work{{src: "control", dst: dst, t: tmpl, info: info}}, c)
+	}
+
+	xenial := cfg{DistroName: "xenial", DistroVersion: distroVersions["xenial"]}
+	sid := cfg{DistroName: "sid", DistroVersion: distroVersions["sid"]}
+
+	testcases := []struct {
+		text      string
+		c         cfg
+		expectErr bool
+	}{
+		{"Version: {{ .DistroVersion }}", xenial, false},
+		{"Version: {{ .DistroVersion }}", sid, true},
+		{`{{ if eq .DistroVersion "16.04" }}old{{ end }}`, sid, true},
+		{"{{ range .Binaries }}{{ $.DistroVersion }}{{ end }}", sid, true},
+		{"Distro: {{ .DistroName }}", sid, false},
+	}
+
+	for _, tc := range testcases {
+		err := render(tc.text, tc.c)
+		if tc.expectErr {
+			if err == nil || !strings.Contains(err.Error(), `distro "sid" is unknown`) {
+				t.Errorf("rendering %q for %s returned %v, wanted an unknown distro error", tc.text, tc.c.DistroName, err)
+			}
+		} else if err != nil {
+			t.Errorf("rendering %q for %s returned unwanted error: %v", tc.text, tc.c.DistroName, err)
+		}
+	}
+}
+
+func TestSignRelease(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not available")
+	}
+
+	dir, err := ioutil.TempDir("", "sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gnupgHome := filepath.Join(dir, "gnupg")
+	if err := os.Mkdir(gnupgHome, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer func(orig string) { os.Setenv("GNUPGHOME", orig) }(os.Getenv("GNUPGHOME"))
+	os.Setenv("GNUPGHOME", gnupgHome)
+	defer exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+
+	const key = "Release Test <release-test@example.com>"
+	if err := checkSigningKey(key); err == nil {
+		t.Errorf("checkSigningKey() succeeded for a missing key")
+	}
+	if out, err := exec.Command("gpg", "--batch", "--pinentry-mode", "loopback", "--passphrase", "",
+		"--quick-gen-key", key, "ed25519", "sign", "never").CombinedOutput(); err != nil {
+		t.Skipf("can't generate a test key: %v: %s", err, out)
+	}
+	if err := checkSigningKey(key); err != nil {
+		t.Fatalf("checkSigningKey() returned unwanted error: %v", err)
+	}
+
+	repo := filepath.Join(dir, "repo")
+	if err := os.Mkdir(repo, 0755); err != nil {
+		t.Fatal(err)
+	}
+	release := "Origin: Kubernetes\nSuite: stable\nCodename: xenial\n"
+	if err := ioutil.WriteFile(filepath.Join(repo, "Release"), []byte(release), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signRelease(context.Background(), repo, key); err != nil {
+		t.Fatalf("signRelease() returned unwanted error: %v", err)
+	}
+
+	for _, args := range [][]string{
+		{"--verify", "Release.gpg", "Release"},
+		{"--verify", "InRelease"},
+	} {
+		cmd := exec.Command("gpg", append([]string{"--batch"}, args...)...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("gpg %v failed: %v: %s", args, err, out)
+		}
+	}
+	inRelease, err := ioutil.ReadFile(filepath.Join(repo, "InRelease"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(inRelease), release) {
+		t.Errorf("InRelease doesn't contain the Release file:\n%s", inRelease)
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	failure := fmt.Errorf("dpkg-buildpackage failed")
+	pushFailure := &pushError{ref: "registry.k8s.io/debs", err: fmt.Errorf("unauthorized")}
+
+	type outcome struct {
+		skipped bool
+		err     error
+	}
+	testcases := []struct {
+		outcomes   []outcome
+		expectCode int
+		expectText string
+	}{
+		{[]outcome{{false, nil}, {false, nil}}, 0, "built 2, failed 0, skipped 0"},
+		{[]outcome{{true, nil}, {false, nil}}, 0, "built 1, failed 0, skipped 1"},
+		{[]outcome{{false, nil}, {false, failure}, {true, nil}}, exitSomeBuildsFailed, "built 1, failed 1, skipped 1\n  failed: build 1: dpkg-buildpackage failed"},
+		{[]outcome{{true, nil}, {false, failure}}, exitSomeBuildsFailed, "built 0, failed 1, skipped 1\n  failed: build 1: dpkg-buildpackage failed"},
+		{[]outcome{{false, failure}, {false, failure}}, exitAllBuildsFailed, "built 0, failed 2, skipped 0\n  failed: build 0: dpkg-buildpackage failed\n  failed: build 1: dpkg-buildpackage failed"},
+		{[]outcome{{false, nil}, {false, pushFailure}}, exitSomeBuildsFailed, "built 1, failed 0, skipped 0, built but not pushed 1\n  push failed: build 1: pushing to registry.k8s.io/debs: unauthorized"},
+		{[]outcome{{false, pushFailure}, {false, failure}}, exitAllBuildsFailed, "built 0, failed 1, skipped 0, built but not pushed 1\n  failed: build 1: dpkg-buildpackage failed\n  push failed: build 0: pushing to registry.k8s.io/debs: unauthorized"},
+	}
+
+	for _, tc := range testcases {
+		s := &runSummary{}
+		for i, o := range tc.outcomes {
+			if err := s.record(fmt.Sprintf("build %d", i), o.skipped, o.err, true); err != nil {
+				t.Errorf("record() with keep going returned %v", err)
+			}
+		}
+		if got := s.exitCode(); got != tc.expectCode {
+			t.Errorf("exitCode() for %v got %d, wanted %d", tc.outcomes, got, tc.expectCode)
+		}
+		if got := s.String(); got != tc.expectText {
+			t.Errorf("String() for %v got %q, wanted %q", tc.outcomes, got, tc.expectText)
+		}
+	}
+
+	s := &runSummary{}
+	if err := s.record("build", false, failure, false); err != failure {
+		t.Errorf("record() without keep going returned %v, wanted the build error", err)
+	}
+}
+
+func TestKubeadmDependsOnBuiltCNIVersion(t *testing.T) {
+	getCNIVersion := func() (string, error) { return "0.6.1", nil }
+	builds := []build{
+		{
+			Package: "kubernetes-cni",
+			Distros: []string{"xenial"},
+			Versions: []version{
+				{GetVersion: getCNIVersion, Revision: "00", Channel: ChannelStable},
+				{Version: "0.7.0", Revision: "00", Channel: ChannelUnstable},
+			},
+		},
+		{
+			Package: "kubeadm",
+			Distros: []string{"xenial"},
+			Versions: []version{
+				{Version: "1.11.0", Revision: "00", Channel: ChannelStable},
+				{Version: "1.12.0-beta.0", Revision: "00", Channel: ChannelUnstable},
+			},
+		},
+	}
+
+	built := map[ChannelType]string{}
+	controls := map[ChannelType]string{}
+	if err := walkArchBuilds(builds, "linux", "amd64", func(b build, distro, osName, arch string, v version) error {
+		if b.Package == "kubernetes-cni" {
+			built[v.Channel] = v.Version
+			return nil
+		}
+		cni, _, err := cniVersionFor(builds, v.Channel, 0, "")
+		if err != nil {
+			return err
+		}
+		v.CNIVersion = cni
+		c := cfg{version: v, Package: b.Package, PackageName: b.Package, DistroName: distro, OS: osName, Arch: arch, DebArch: arch}
+		controls[v.Channel] = renderDefinition(t, filepath.Join("xenial", "kubeadm", "debian", "control"), c)
+		return nil
+	}); err != nil {
+		t.Fatalf("walkArchBuilds() returned unwanted error: %v", err)
+	}
+
+	for _, channel := range []ChannelType{ChannelStable, ChannelUnstable} {
+		want := fmt.Sprintf("kubernetes-cni (>= %s)", built[channel])
+		if !strings.Contains(controls[channel], want) {
+			t.Errorf("%s kubeadm control doesn't depend on %q:\n%s", channel, want, controls[channel])
+		}
+	}
+
+	// Without a kubernetes-cni build, the minimum version is used.
+	if got, deb, err := cniVersionFor(builds[1:], ChannelStable, 1, "job"); err != nil || got != cniVersion || deb != cniVersion {
+		t.Errorf("cniVersionFor() without a kubernetes-cni build got %q, %q, %v; wanted %q", got, deb, err, cniVersion)
+	}
+}
+
+func TestKubeletDependsOnBuiltCNIDebVersion(t *testing.T) {
+	builds := []build{
+		{
+			Package:  "kubernetes-cni",
+			Distros:  []string{"xenial"},
+			Versions: []version{{Version: "0.6.0", Revision: "00", Channel: ChannelStable}},
+		},
+	}
+
+	// kubelet pins the exact version of the kubernetes-cni package, which
+	// --epoch and --version-metadata change.
+	testcases := []struct {
+		epoch    int
+		metadata string
+		expect   string
+	}{
+		{0, "", "kubernetes-cni (= 0.6.0-00)"},
+		{1, "", "kubernetes-cni (= 1:0.6.0-00)"},
+		{0, "job", "kubernetes-cni (= 0.6.0+job-00)"},
+		{1, "job", "kubernetes-cni (= 1:0.6.0+job-00)"},
+	}
+	for _, tc := range testcases {
+		cni, deb, err := cniVersionFor(builds, ChannelStable, tc.epoch, tc.metadata)
+		if err != nil {
+			t.Fatalf("cniVersionFor() returned unwanted error: %v", err)
+		}
+		v := version{Version: "1.11.0", Revision: "00", Channel: ChannelStable, CNIVersion: cni}
+		if v.KubeletCNIVersion, err = getKubeletCNIVersion(v, deb); err != nil {
+			t.Fatalf("getKubeletCNIVersion() returned unwanted error: %v", err)
+		}
+		c := cfg{version: v, Package: "kubelet", PackageName: "kubelet", DistroName: "xenial", OS: "linux", Arch: "amd64", DebArch: "amd64"}
+		control := renderDefinition(t, filepath.Join("xenial", "kubelet", "debian", "control"), c)
+		if !strings.Contains(control, tc.expect) {
+			t.Errorf("kubelet control with --epoch %d and --version-metadata %q doesn't depend on %q:\n%s", tc.epoch, tc.metadata, tc.expect, control)
+		}
+	}
+}
+
+func TestStandardsVersion(t *testing.T) {
+	testcases := []struct {
+		version   string
+		expectErr bool
+	}{
+		{"4.7.0", false},
+		{"3.9.8.0", false},
+		{"4.7", true},
+		{"4.7.0.0.1", true},
+		{"v4.7.0", true},
+		{"", true},
+	}
+
+	for _, tc := range testcases {
+		if err := validateStandardsVersion(tc.version); (err != nil) != tc.expectErr {
+			t.Errorf("validateStandardsVersion(%q) returned %v, expected error: %v", tc.version, err, tc.expectErr)
+		}
+	}
+
+	for _, pkg := range []string{"kubectl", "kubelet", "kubeadm", "kubernetes-cni", "cri-tools"} {
+		c := cfg{
+			version:          version{Version: "1.11.0", Revision: "00", Channel: ChannelStable},
+			Package:          pkg,
+			PackageName:      pkg,
+			DebArch:          "amd64",
+			StandardsVersion: "4.7.0",
+		}
+		control := renderDefinition(t, filepath.Join("xenial", pkg, "debian", "control"), c)
+		if !strings.Contains(control, "\nStandards-Version: 4.7.0\n") {
+			t.Errorf("%s control doesn't declare Standards-Version 4.7.0:\n%s", pkg, control)
+		}
+	}
+}
+
+func TestKnownPackages(t *testing.T) {
+	for _, builds := range [][]build{defaultBuilds(), specifiedVersionBuilds("1.11.0")} {
+		var names []string
+		for _, b := range builds {
+			names = append(names, b.Package)
+			if _, err := os.Stat(filepath.Join("xenial", b.Package)); err != nil {
+				t.Errorf("%s has no package definition: %v", b.Package, err)
+			}
+		}
+		if !reflect.DeepEqual(names, KnownPackages()) {
+			t.Errorf("builds are of packages %v, wanted KnownPackages() %v", names, KnownPackages())
+		}
+	}
+
+	if err := validatePackages(KnownPackages()); err != nil {
+		t.Errorf("validatePackages(KnownPackages()) returned unwanted error: %v", err)
+	}
+	if err := validatePackages([]string{"kubectl", "kube-proxy"}); err == nil {
+		t.Errorf("validatePackages() accepted an unknown package")
+	}
+
+	selected := selectPackages(defaultBuilds(), []string{"kubeadm", "kubectl"})
+	if len(selected) != 2 || selected[0].Package != "kubectl" || selected[1].Package != "kubeadm" {
+		t.Errorf("selectPackages() got %v, wanted the kubectl and kubeadm builds", selected)
+	}
+}
+
+func TestDbgsymFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbgsym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"kubelet_1.11.0-00_amd64.deb",
+		"kubelet-dbgsym_1.11.0-00_amd64.deb",
+		"kubelet-dbgsym_1.11.0-00_amd64.ddeb",
+		"kubelet-dbgsym_1.11.0-00_arm64.deb",
+		"kubelet-dbgsym_1.10.0-00_amd64.deb",
+		"kubectl-dbgsym_1.11.0-00_amd64.deb",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := cfg{PackageName: "kubelet", DebVersion: "1:1.11.0-00", DebArch: "amd64", WithDbgsym: true}
+	files, err := c.dbgsymFiles(dir)
+	if err != nil {
+		t.Fatalf("dbgsymFiles() returned unwanted error: %v", err)
+	}
+	want := []string{
+		filepath.Join(dir, "kubelet-dbgsym_1.11.0-00_amd64.deb"),
+		filepath.Join(dir, "kubelet-dbgsym_1.11.0-00_amd64.ddeb"),
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("dbgsymFiles() got %v, wanted %v", files, want)
+	}
+
+	for current, expect := range map[string]string{
+		"":                         "",
+		"nostrip":                  "",
+		"parallel=4 noautodbgsym":  "parallel=4",
+		"nocheck nostrip nodoc":    "nocheck nodoc",
+		"noautodbgsym nostrip foo": "foo",
+	} {
+		if got := dbgsymBuildOptions(current); got != expect {
+			t.Errorf("dbgsymBuildOptions(%q) got %q, wanted %q", current, got, expect)
+		}
+	}
+
+	rules := renderDefinition(t, filepath.Join("xenial", "kubelet", "debian", "rules"), cfg{
+		version:    version{Version: "1.11.0"},
+		OS:         "linux",
+		Arch:       "amd64",
+		WithDbgsym: true,
+	})
+	if !strings.Contains(rules, "\tdh_install\n\tdh_strip\n") {
+		t.Errorf("rules with dbgsym don't run dh_strip after dh_install:\n%s", rules)
+	}
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c fakeClock) Now() time.Time { return c.t }
+
+func TestChangelogDateFromClock(t *testing.T) {
+	c := cfg{
+		version:     version{Version: "1.11.0", Revision: "00"},
+		Package:     "kubeadm",
+		PackageName: "kubeadm",
+		DistroName:  "xenial",
+		Arch:        "amd64",
+		clock:       fakeClock{time.Date(2018, time.June, 27, 16, 30, 0, 0, time.UTC)},
+	}
+	changelog := filepath.Join("xenial", "kubeadm", "debian", "changelog")
+
+	want := " -- Kubernetes Authors <kubernetes-dev@googlegroups.com>  Wed, 27 Jun 2018 16:30:00 +0000"
+	for i := 0; i < 2; i++ {
+		if got := renderDefinition(t, changelog, c); !strings.Contains(got, want) {
+			t.Errorf("changelog isn't dated by the clock, wanted %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestCheckBinfmt(t *testing.T) {
+	testcases := []struct {
+		name      string
+		entries   map[string]string
+		archs     stringList
+		expectErr bool
+	}{
+		{"native only", nil, stringList{"amd64"}, false},
+		{"not mounted", nil, stringList{"amd64", "arm64"}, true},
+		{"disabled", map[string]string{"status": "disabled\n"}, stringList{"arm64"}, true},
+		{
+			"registered",
+			map[string]string{
+				"status":       "enabled\n",
+				"qemu-aarch64": "enabled\ninterpreter /usr/bin/qemu-aarch64-static\nflags: F\n",
+				"qemu-arm":     "enabled\ninterpreter /usr/bin/qemu-arm-static\nflags: F\n",
+			},
+			stringList{"amd64", "arm", "arm64"},
+			false,
+		},
+		{
+			"handler missing",
+			map[string]string{
+				"status":       "enabled\n",
+				"qemu-aarch64": "enabled\ninterpreter /usr/bin/qemu-aarch64-static\n",
+			},
+			stringList{"amd64", "arm64", "s390x"},
+			true,
+		},
+		{
+			"handler disabled",
+			map[string]string{
+				"status":       "enabled\n",
+				"qemu-aarch64": "disabled\ninterpreter /usr/bin/qemu-aarch64-static\n",
+			},
+			stringList{"arm64"},
+			true,
+		},
+		{"unknown architecture", map[string]string{"status": "enabled\n"}, stringList{"mips"}, true},
+	}
+
+	for _, tc := range testcases {
+		dir, err := ioutil.TempDir("", "binfmt_misc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for name, content := range tc.entries {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := checkBinfmt(dir, tc.archs, "amd64"); (err != nil) != tc.expectErr {
+			t.Errorf("%s: checkBinfmt(%v) returned %v, expected error: %v", tc.name, tc.archs, err, tc.expectErr)
+		}
+	}
+}
+
+func TestPackagesIndexConcurrentAdds(t *testing.T) {
+	defer func(orig func(context.Context, string, []string, io.Writer, string, ...string) error) {
+		runCommand = orig
+	}(runCommand)
+
+	dir, err := ioutil.TempDir("", "apt-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A dpkg-deb that reads the control fields from the package name.
+	runCommand = func(_ context.Context, _ string, _ []string, out io.Writer, command string, args ...string) error {
+		if command != "dpkg-deb" || len(args) != 2 || args[0] != "--field" {
+			return fmt.Errorf("unexpected command %s %v", command, args)
+		}
+		deb, ok := parseDebFileName(args[1])
+		if !ok {
+			return fmt.Errorf("not a package: %s", args[1])
+		}
+		fmt.Fprintf(out, "Package: %s\nVersion: %s-%s\nArchitecture: %s\n", deb.pkg, deb.version, deb.revision, deb.arch)
+		return nil
+	}
+
+	var debs []string
+	for _, pkg := range []string{"kubectl", "kubelet", "kubeadm", "cri-tools"} {
+		for _, arch := range []string{"amd64", "arm64", "armhf", "ppc64el", "s390x"} {
+			deb := filepath.Join(dir, fmt.Sprintf("%s_1.11.0-00_%s.deb", pkg, arch))
+			if err := ioutil.WriteFile(deb, []byte(deb), 0644); err != nil {
+				t.Fatal(err)
+			}
+			debs = append(debs, deb)
+		}
+	}
+
+	index := &packagesIndex{}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*len(debs))
+	// Every package is added twice, the second entry replacing the first.
+	for i := 0; i < 2; i++ {
+		for _, deb := range debs {
+			wg.Add(1)
+			go func(deb string) {
+				defer wg.Done()
+				errs <- index.add(context.Background(), deb)
+			}(deb)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("add() returned unwanted error: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "Packages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stanzas := strings.SplitAfter(strings.TrimSuffix(string(data), "\n\n"), "\n\n")
+	if len(stanzas) != len(debs) {
+		t.Fatalf("Packages has %d entries, wanted %d:\n%s", len(stanzas), len(debs), data)
+	}
+	for _, deb := range debs {
+		name := filepath.Base(deb)
+		sum := sha256.Sum256([]byte(deb))
+		want := fmt.Sprintf("\nFilename: ./%s\nSize: %d\n", name, len(deb))
+		if !strings.Contains(string(data), want) || !strings.Contains(string(data), fmt.Sprintf("SHA256: %x\n", sum)) {
+			t.Errorf("Packages doesn't index %s:\n%s", name, data)
+		}
+	}
+
+	// Pruned packages are dropped from the index.
+	pruned := debs[0]
+	if err := index.remove(pruned); err != nil {
+		t.Fatalf("remove() returned unwanted error: %v", err)
+	}
+	if data, err = ioutil.ReadFile(filepath.Join(dir, "Packages")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), filepath.Base(pruned)) {
+		t.Errorf("Packages still indexes the pruned %s:\n%s", filepath.Base(pruned), data)
+	}
+	if n := strings.Count(string(data), "\nFilename: "); n != len(debs)-1 {
+		t.Errorf("Packages has %d entries after removing one, wanted %d", n, len(debs)-1)
+	}
+	if err := index.remove(filepath.Join(t.Name(), "kubectl_1.11.0-00_amd64.deb")); err != nil {
+		t.Errorf("remove() from a missing index returned unwanted error: %v", err)
+	}
+
+	info := releaseInfo{Origin: "Kubernetes", Label: "Kubernetes", Suite: "stable", Codename: "xenial"}
+	if err := finishAptIndex(dir, info, time.Now()); err != nil {
+		t.Fatalf("finishAptIndex() returned unwanted error: %v", err)
+	}
+	for _, f := range []string{"Packages.gz", "Release"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("finishAptIndex() didn't write %s: %v", f, err)
+		}
+	}
+}
+
+func TestValidateDownloadBase(t *testing.T) {
+	testcases := []struct {
+		base          string
+		allowInsecure bool
+		expectErr     bool
+	}{
+		{"https://dl.k8s.io", false, false},
+		{"https://dl.k8s.io/ci-cross", false, false},
+		{"file:///srv/kubernetes/_output/release-stage", false, false},
+		{"http://dl.k8s.io", false, true},
+		{"http://dl.k8s.io", true, false},
+		{"ftp://dl.k8s.io", true, true},
+		{"dl.k8s.io", false, true},
+		{"https://", false, true},
+		{"file://", false, true},
+		{"", false, true},
+	}
+
+	for _, tc := range testcases {
+		if err := validateDownloadBase(tc.base, tc.allowInsecure); (err != nil) != tc.expectErr {
+			t.Errorf("validateDownloadBase(%q, %v) returned %v, expected error: %v", tc.base, tc.allowInsecure, err, tc.expectErr)
+		}
+	}
+}
+
+func TestFileDownloadBase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "kubectl"), []byte("kubectl"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	res, err := httpGet(context.Background(), "file://"+filepath.ToSlash(dir)+"/kubectl")
+	if err != nil {
+		t.Fatalf("httpGet() of a file:// URL returned unwanted error: %v", err)
+	}
+	defer res.Body.Close()
+	if got, err := ioutil.ReadAll(res.Body); err != nil || string(got) != "kubectl" {
+		t.Errorf("httpGet() of a file:// URL got %q, %v; wanted %q", got, err, "kubectl")
+	}
+}
+
+func TestBinaries(t *testing.T) {
+	testcases := []struct {
+		pkg    string
+		expect []string
+	}{
+		{"kubectl", []string{"kubectl"}},
+		{"kubeadm", []string{"kubeadm"}},
+		{"cri-tools", []string{"crictl", "critest"}},
+	}
+	for _, tc := range testcases {
+		if got := newBuild(tc.pkg, nil).binaries(); !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("binaries of %s got %v, wanted %v", tc.pkg, got, tc.expect)
+		}
+	}
+
+	postinst := `#!/bin/sh
+set -e
+{{- range .Binaries }}
+update-alternatives --install /usr/local/bin/{{ . }} {{ . }} /usr/bin/{{ . }} 50
+{{- end }}
+`
+	c := cfg{
+		version:  version{Version: "1.11.0"},
+		Package:  "cri-tools",
+		Binaries: newBuild("cri-tools", nil).binaries(),
+	}
+	data, err := c.templateContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := template.Must(template.New("postinst").Funcs(c.templateFuncs()).Option("missingkey=error").Parse(postinst))
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		t.Fatalf("rendering postinst: %v", err)
+	}
+	want := `#!/bin/sh
+set -e
+update-alternatives --install /usr/local/bin/crictl crictl /usr/bin/crictl 50
+update-alternatives --install /usr/local/bin/critest critest /usr/bin/critest 50
+`
+	if got := buf.String(); got != want {
+		t.Errorf("postinst got\n%s\nwanted\n%s", got, want)
+	}
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	defer func(orig func(*http.Request, []*http.Request) error) {
+		httpClient.CheckRedirect = orig
+	}(httpClient.CheckRedirect)
+
+	// /redirect/<n> redirects n times before serving the version.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if n > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+			return
+		}
+		fmt.Fprintln(w, "v1.11.0")
+	}))
+	defer srv.Close()
+
+	// other redirects to srv, on another host.
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, srv.URL+"/redirect/0", http.StatusFound)
+	}))
+	defer other.Close()
+
+	testcases := []struct {
+		url          string
+		maxRedirects int
+		crossHost    bool
+		expectErr    bool
+	}{
+		{srv.URL + "/redirect/0", 0, false, false},
+		{srv.URL + "/redirect/1", 0, false, true},
+		{srv.URL + "/redirect/10", 10, false, false},
+		{srv.URL + "/redirect/11", 10, false, true},
+		{srv.URL + "/redirect/15", 20, false, false},
+		{other.URL, 10, true, false},
+		{other.URL, 10, false, true},
+	}
+
+	for _, tc := range testcases {
+		httpClient.CheckRedirect = redirectPolicy(tc.maxRedirects, tc.crossHost)
+		got, err := fetchVersion(tc.url)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("fetchVersion(%s) with at most %d redirects, cross host %v returned %v, expected error: %v", tc.url, tc.maxRedirects, tc.crossHost, err, tc.expectErr)
+			continue
+		}
+		if err == nil && got != "1.11.0" {
+			t.Errorf("fetchVersion(%s) got %q, wanted %q", tc.url, got, "1.11.0")
+		}
+	}
+}
+
+func TestSmokeTestImages(t *testing.T) {
+	testcases := []struct {
+		text      string
+		distros   []string
+		expect    map[string]string
+		expectErr bool
+	}{
+		{
+			"",
+			[]string{"xenial", "stretch"},
+			map[string]string{"xenial": "ubuntu:xenial", "stretch": "debian:stretch"},
+			false,
+		},
+		{
+			"registry.example.com/ubuntu:{{ .DistroVersion }}",
+			[]string{"trusty", "xenial", "bionic"},
+			map[string]string{
+				"trusty": "registry.example.com/ubuntu:14.04",
+				"xenial": "registry.example.com/ubuntu:16.04",
+				"bionic": "registry.example.com/ubuntu:18.04",
+			},
+			false,
+		},
+		{
+			"registry.example.com/{{ .DistroName }}",
+			[]string{"xenial", "sid"},
+			map[string]string{"xenial": "registry.example.com/xenial", "sid": "registry.example.com/sid"},
+			false,
+		},
+		{"registry.example.com/debian:{{ .DistroVersion }}", []string{"stretch", "sid"}, nil, true},
+		{"registry.example.com/{{ .Codename }}", []string{"xenial"}, nil, true},
+		{"registry.example.com/{{ .DistroName", []string{"xenial"}, nil, true},
+		{"{{ if false }}x{{ end }}", []string{"xenial"}, nil, true},
+		{"", []string{"alpine"}, nil, true},
+	}
+
+	for _, tc := range testcases {
+		got, err := smokeTestImages(tc.text, tc.distros)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("smokeTestImages(%q, %v) returned %v, expected error: %v", tc.text, tc.distros, err, tc.expectErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("smokeTestImages(%q, %v) got %v, wanted %v", tc.text, tc.distros, got, tc.expect)
+		}
+	}
+}
+
+func TestVersionAuth(t *testing.T) {
+	defer func(orig credentials) { versionAuth = orig }(versionAuth)
+
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		if authorization != "Bearer s3cr3t" && authorization != "Basic "+base64.StdEncoding.EncodeToString([]byte("builder:pa:ss")) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintln(w, "v1.11.0")
+	}))
+	defer srv.Close()
+
+	netrc, err := ioutil.TempFile("", "netrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(netrc.Name())
+	host := strings.TrimPrefix(srv.URL, "http://")
+	fmt.Fprintf(netrc, "machine %s\n  login builder\n  password pa:ss\ndefault login anonymous password guest\n", strings.Split(host, ":")[0])
+	netrc.Close()
+
+	testcases := []struct {
+		token, basic, netrc string
+		expectAuth          string
+		expectErr           bool
+	}{
+		{"s3cr3t", "", "", "Bearer s3cr3t", false},
+		{"", "builder:pa:ss", "", "Basic YnVpbGRlcjpwYTpzcw==", false},
+		{"", "", netrc.Name(), "Basic YnVpbGRlcjpwYTpzcw==", false},
+		{"wrong", "", netrc.Name(), "Bearer wrong", true},
+		{"", "", "", "", true},
+	}
+
+	for _, tc := range testcases {
+		versionAuth, err = newCredentials(tc.token, tc.basic, tc.netrc)
+		if err != nil {
+			t.Fatalf("newCredentials() returned unwanted error: %v", err)
+		}
+		got, err := fetchVersion(srv.URL + "/release/stable.txt")
+		if (err != nil) != tc.expectErr {
+			t.Errorf("fetchVersion() with token %q, basic %q, netrc %q returned %v, expected error: %v", tc.token, tc.basic, tc.netrc, err, tc.expectErr)
+		}
+		if err == nil && got != "1.11.0" {
+			t.Errorf("fetchVersion() got %q, wanted %q", got, "1.11.0")
+		}
+		if authorization != tc.expectAuth {
+			t.Errorf("fetchVersion() with token %q, basic %q, netrc %q sent Authorization %q, wanted %q", tc.token, tc.basic, tc.netrc, authorization, tc.expectAuth)
+		}
+	}
+
+	// Neither the errors nor the formatted credentials reveal the secrets.
+	for _, basic := range []string{"nouser", ":s3cr3t"} {
+		if _, err := newCredentials("", basic, ""); err == nil || strings.Contains(err.Error(), basic) {
+			t.Errorf("newCredentials() with basic %q returned %v", basic, err)
+		}
+	}
+	if _, err := newCredentials("s3cr3t", "builder:s3cr3t", ""); err == nil || strings.Contains(err.Error(), "s3cr3t") {
+		t.Errorf("newCredentials() with a token and basic returned %v", err)
+	}
+	c, err := newCredentials("", "builder:s3cr3t", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprintf("%v %+v %s", c, c, c); strings.Contains(s, "s3cr3t") || strings.Contains(s, "builder") {
+		t.Errorf("formatted credentials reveal them: %s", s)
+	}
+}
+
+func TestParseNetrc(t *testing.T) {
+	entries, err := parseNetrc(`machine mirror.example.com login builder password pa55
+machine other.example.com
+	login other
+	account ignored
+	password other55
+default login anonymous password guest
+`)
+	if err != nil {
+		t.Fatalf("parseNetrc() returned unwanted error: %v", err)
+	}
+	want := []netrcEntry{
+		{"mirror.example.com", "builder", "pa55"},
+		{"other.example.com", "other", "other55"},
+		{"", "anonymous", "guest"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("parseNetrc() got %v, wanted %v", entries, want)
+	}
+
+	for host, login := range map[string]string{
+		"mirror.example.com":      "builder",
+		"mirror.example.com:8443": "builder",
+		"dl.k8s.io":               "anonymous",
+	} {
+		if e, ok := lookupNetrc(entries, host); !ok || e.login != login {
+			t.Errorf("lookupNetrc(%s) got %v, %v; wanted login %s", host, e, ok, login)
+		}
+	}
+	if e, ok := lookupNetrc(entries[:2], "dl.k8s.io"); ok {
+		t.Errorf("lookupNetrc() without a default got %v", e)
+	}
+
+	for _, data := range []string{"login builder", "machine", "machine a macdef init", "machine a user b"} {
+		if _, err := parseNetrc(data); err == nil {
+			t.Errorf("parseNetrc(%q) expected an error", data)
+		}
+	}
+}
+
+func TestManifestFormats(t *testing.T) {
+	m := manifest{
+		GitCommit: "0123456789abcdef",
+		Packages: []manifestEntry{
+			{
+				Package:  "kubelet",
+				Version:  "1.11.0-00",
+				Distro:   "xenial",
+				Channel:  "stable",
+				Arch:     "arm64",
+				Path:     "bin/stable/xenial/kubelet_1.11.0-00_arm64.deb",
+				SHA256:   "bbbb",
+				Warnings: []dpkgMessage{{"dpkg-shlibdeps", "warning", "binaries to analyze should already be installed in their package's directory"}},
+			},
+			{
+				Package: "kubectl",
+				Version: "1.11.0-00",
+				Distro:  "xenial",
+				Channel: "stable",
+				Arch:    "amd64",
+				Path:    "bin/stable/xenial/kubectl_1.11.0-00_amd64.deb",
+				SHA256:  "aaaa",
+			},
+		},
+	}
+
+	testcases := []struct {
+		format string
+		expect string
+	}{
+		{"json", `{
+  "gitCommit": "0123456789abcdef",
+  "packages": [
+    {
+      "package": "kubectl",
+      "version": "1.11.0-00",
+      "distro": "xenial",
+      "channel": "stable",
+      "arch": "amd64",
+      "path": "bin/stable/xenial/kubectl_1.11.0-00_amd64.deb",
+      "sha256": "aaaa"
+    },
+    {
+      "package": "kubelet",
+      "version": "1.11.0-00",
+      "distro": "xenial",
+      "channel": "stable",
+      "arch": "arm64",
+      "path": "bin/stable/xenial/kubelet_1.11.0-00_arm64.deb",
+      "sha256": "bbbb",
+      "warnings": [
+        {
+          "tool": "dpkg-shlibdeps",
+          "severity": "warning",
+          "text": "binaries to analyze should already be installed in their package's directory"
+        }
+      ]
+    }
+  ]
+}
+`},
+		{"list", `bin/stable/xenial/kubectl_1.11.0-00_amd64.deb
+bin/stable/xenial/kubelet_1.11.0-00_arm64.deb
+`},
+		{"csv", `package,version,distro,channel,arch,path,sha256
+kubectl,1.11.0-00,xenial,stable,amd64,bin/stable/xenial/kubectl_1.11.0-00_amd64.deb,aaaa
+kubelet,1.11.0-00,xenial,stable,arm64,bin/stable/xenial/kubelet_1.11.0-00_arm64.deb,bbbb
+`},
+	}
+
+	for _, tc := range testcases {
+		if err := validateManifestFormat(tc.format); err != nil {
+			t.Errorf("validateManifestFormat(%q) returned unwanted error: %v", tc.format, err)
+		}
+		var buf bytes.Buffer
+		if err := m.write(&buf, tc.format); err != nil {
+			t.Errorf("write(%q) returned unwanted error: %v", tc.format, err)
+			continue
+		}
+		if got := buf.String(); got != tc.expect {
+			t.Errorf("write(%q) got\n%s\nwanted\n%s", tc.format, got, tc.expect)
+		}
+	}
+
+	for _, format := range []string{"", "yaml", "JSON"} {
+		if err := validateManifestFormat(format); err == nil {
+			t.Errorf("validateManifestFormat(%q) expected an error", format)
+		}
+		if err := m.write(ioutil.Discard, format); err == nil {
+			t.Errorf("write(%q) expected an error", format)
+		}
+	}
+}
+
+func TestRenderWorkEmptyFiles(t *testing.T) {
+	defer func(orig bool) { *strict = orig }(*strict)
+
+	dir, err := ioutil.TempDir("", "empty-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := cfg{version: version{Version: "1.11.0"}, Package: "kubelet", DistroName: "xenial"}
+	testcases := []struct {
+		text       string
+		expectErr  bool
+		expectWarn bool
+	}{
+		{"", true, true},
+		{" \n\t\n", true, true},
+		{`{{ if eq .DistroName "sid" }}sid only{{ end }}`, true, true},
+		{"KUBELET_EXTRA_ARGS=\n", false, false},
+	}
+
+	for _, tc := range testcases {
+		src := filepath.Join(dir, "kubelet.default")
+		if err := ioutil.WriteFile(src, []byte(tc.text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl, err := template.New("").Funcs(c.templateFuncs()).Option("missingkey=error").ParseFiles(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := []work{{src: src, dst: filepath.Join(dir, "rendered"), t: tmpl.Templates()[0], info: info}}
+
+		*strict = true
+		if err := renderWork(w, c); (err != nil) != tc.expectErr {
+			t.Errorf("renderWork(%q) with --strict returned %v, expected error: %v", tc.text, err, tc.expectErr)
+		}
+
+		*strict = false
+		var logged bytes.Buffer
+		log.SetOutput(&logged)
+		err = renderWork(w, c)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Errorf("renderWork(%q) returned unwanted error: %v", tc.text, err)
+		}
+		if warned := strings.Contains(logged.String(), "renders to an empty file"); warned != tc.expectWarn {
+			t.Errorf("renderWork(%q) warned: %v, wanted: %v", tc.text, warned, tc.expectWarn)
+		}
+	}
+}
+
+func TestRelations(t *testing.T) {
+	v := version{Version: "1.11.0", Revision: "00", Channel: ChannelStable, CNIVersion: "0.6.0", KubeletCNIVersion: "= 0.6.0"}
+	testcases := []struct {
+		pkg       string
+		overrides []string
+		expect    []string
+		reject    []string
+	}{
+		{
+			"kubeadm",
+			nil,
+			[]string{"\nDepends: kubelet (>= 1.6.0), kubectl (>= 1.6.0), kubernetes-cni (>= 0.6.0), cri-tools (>=1.11.0), ${misc:Depends}\nDescription: "},
+			[]string{"Recommends:", "Suggests:"},
+		},
+		{
+			"kubeadm",
+			[]string{"kubeadm:cri-tools=recommends"},
+			[]string{"\nDepends: kubelet (>= 1.6.0), kubectl (>= 1.6.0), kubernetes-cni (>= 0.6.0), ${misc:Depends}\nRecommends: cri-tools (>=1.11.0)\nDescription: "},
+			[]string{"Suggests:"},
+		},
+		{
+			"kubeadm",
+			[]string{"kubeadm:cri-tools=suggests", "kubeadm:kubectl=recommends", "kubelet:socat=suggests"},
+			[]string{"\nDepends: kubelet (>= 1.6.0), kubernetes-cni (>= 0.6.0), ${misc:Depends}\nRecommends: kubectl (>= 1.6.0)\nSuggests: cri-tools (>=1.11.0)\nDescription: "},
+			nil,
+		},
+		{
+			"kubelet",
+			[]string{"kubelet:socat=suggests", "kubelet:ethtool=suggests"},
+			[]string{"\nDepends: iptables (>= 1.4.21), kubernetes-cni (= 0.6.0), iproute2, util-linux, mount, ebtables, ${misc:Depends}\nSuggests: socat, ethtool\nDescription: "},
+			[]string{"Recommends:"},
+		},
+		{
+			"kubectl",
+			nil,
+			[]string{"\nDepends: ${misc:Depends}\nDescription: "},
+			[]string{"Recommends:", "Suggests:"},
+		},
+		{
+			"cri-tools",
+			nil,
+			[]string{"\nDepends: ${shlibs:Depends}, ${misc:Depends}\nDescription: "},
+			[]string{"Recommends:", "Suggests:"},
+		},
+	}
+
+	for _, tc := range testcases {
+		overrides, err := parseRelationOverrides(tc.overrides)
+		if err != nil {
+			t.Fatalf("parseRelationOverrides(%v) returned unwanted error: %v", tc.overrides, err)
+		}
+		c := cfg{
+			version:           v,
+			Package:           tc.pkg,
+			PackageName:       tc.pkg,
+			DebArch:           "amd64",
+			relationOverrides: overrides[tc.pkg],
+		}
+		control := renderDefinition(t, filepath.Join("xenial", tc.pkg, "debian", "control"), c)
+		for _, want := range tc.expect {
+			if !strings.Contains(control, want) {
+				t.Errorf("%s control with %v doesn't contain %q:\n%s", tc.pkg, tc.overrides, want, control)
+			}
+		}
+		for _, unwanted := range tc.reject {
+			if strings.Contains(control, unwanted) {
+				t.Errorf("%s control with %v contains %q:\n%s", tc.pkg, tc.overrides, unwanted, control)
+			}
+		}
+	}
+
+	for _, spec := range []string{
+		"kubeadm:cri-tools",
+		"kubeadm=recommends",
+		":cri-tools=recommends",
+		"kubeadm:=recommends",
+		"kubeadm:cri-tools=breaks",
+		"kubeadm:socat=suggests",
+		"kubectl:kubelet=suggests",
+		"kubeproxy:iptables=suggests",
+	} {
+		if _, err := parseRelationOverrides([]string{spec}); err == nil {
+			t.Errorf("parseRelationOverrides(%q) expected an error", spec)
+		}
+	}
+}
+
+func TestBuildSchedulerPerArchLimit(t *testing.T) {
+	var tasks []buildTask
+	for i := 0; i < 12; i++ {
+		tasks = append(tasks, buildTask{build: build{Package: fmt.Sprintf("arm64-%d", i)}, os: "linux", arch: "arm64"})
+	}
+	for _, arch := range []string{"amd64", "s390x"} {
+		tasks = append(tasks, buildTask{build: build{Package: arch}, os: "linux", arch: arch})
+	}
+
+	var mu sync.Mutex
+	running := map[string]int{}
+	maxRunning := map[string]int{}
+	total, maxTotal := 0, 0
+	ran := map[string]bool{}
+	s := buildScheduler{jobs: 4, perArch: 2}
+	if err := s.run(tasks, func(task buildTask) error {
+		mu.Lock()
+		running[task.arch]++
+		total++
+		if running[task.arch] > maxRunning[task.arch] {
+			maxRunning[task.arch] = running[task.arch]
+		}
+		if total > maxTotal {
+			maxTotal = total
+		}
+		ran[task.build.Package] = true
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running[task.arch]--
+		total--
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatalf("run() returned unwanted error: %v", err)
+	}
+
+	if len(ran) != len(tasks) {
+		t.Errorf("ran %d tasks, wanted %d", len(ran), len(tasks))
+	}
+	if maxRunning["arm64"] > 2 {
+		t.Errorf("ran %d arm64 builds at once, wanted at most 2", maxRunning["arm64"])
+	}
+	if maxTotal > 4 {
+		t.Errorf("ran %d builds at once, wanted at most 4", maxTotal)
+	}
+	// The builds of the other architectures must not wait for all of the
+	// arm64 ones, which are first in line.
+	if maxTotal < 3 {
+		t.Errorf("ran at most %d builds at once, wanted the other architectures to run next to arm64", maxTotal)
+	}
+}
+
+func TestBuildSchedulerSequential(t *testing.T) {
+	var tasks []buildTask
+	for _, arch := range []string{"amd64", "arm64", "amd64", "s390x", "arm64"} {
+		tasks = append(tasks, buildTask{os: "linux", arch: arch})
+	}
+
+	var order []string
+	s := buildScheduler{jobs: 1, perArch: 1}
+	failure := errors.New("failed")
+	err := s.run(tasks, func(task buildTask) error {
+		order = append(order, task.arch)
+		if len(order) == 3 {
+			return failure
+		}
+		return nil
+	})
+	if err != failure {
+		t.Errorf("run() returned %v, wanted %v", err, failure)
+	}
+	// No build is started after the failure.
+	if want := []string{"amd64", "arm64", "amd64"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("ran %v, wanted %v", order, want)
+	}
+}
+
+func TestBinariesManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binaries-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sum := func(data string) string {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+	}
+	for name, data := range map[string]string{
+		"kubectl-1.11.0":  "kubectl 1.11.0",
+		"kubectl-any":     "kubectl",
+		"kubelet-arm64":   "kubelet arm64",
+		"kubeadm-corrupt": "kubeadm, modified",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := []binaryEntry{
+		{Package: "kubectl", OS: "linux", Arch: "amd64", Path: "kubectl-any", SHA256: sum("kubectl")},
+		{Package: "kubectl", Version: "1.11.0", OS: "linux", Arch: "amd64", Path: "kubectl-1.11.0", SHA256: strings.ToUpper(sum("kubectl 1.11.0"))},
+		{Package: "kubelet", OS: "linux", Arch: "arm64", Path: filepath.Join(dir, "kubelet-arm64"), SHA256: sum("kubelet arm64")},
+		{Package: "kubeadm", OS: "linux", Arch: "amd64", Path: "kubeadm-corrupt", SHA256: sum("kubeadm")},
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(dir, "binaries.json")
+	if err := ioutil.WriteFile(manifestPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadBinariesManifest(manifestPath)
+	if err != nil {
+		t.Fatalf("loadBinariesManifest() returned unwanted error: %v", err)
+	}
+
+	testcases := []struct {
+		pkg, version, os, arch string
+		expect                 string
+		expectErr              string
+	}{
+		{"kubectl", "1.11.0", "linux", "amd64", "kubectl-1.11.0", ""},
+		{"kubectl", "1.11.1", "linux", "amd64", "kubectl-any", ""},
+		{"kubelet", "1.11.0", "linux", "arm64", "kubelet-arm64", ""},
+		{"kubelet", "1.11.0", "linux", "amd64", "", "no entry for kubelet 1.11.0 on linux/amd64"},
+		{"kubectl", "1.11.0", "darwin", "amd64", "", "no entry for kubectl 1.11.0 on darwin/amd64"},
+		{"kubeadm", "1.11.0", "linux", "amd64", "", "checksum mismatch"},
+	}
+	for _, tc := range testcases {
+		got, err := m.lookup(tc.pkg, "", tc.version, tc.os, tc.arch)
+		if len(tc.expectErr) != 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+				t.Errorf("lookup(%s, %s, %s, %s) returned %q, %v; wanted an error containing %q", tc.pkg, tc.version, tc.os, tc.arch, got, err, tc.expectErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("lookup(%s, %s, %s, %s) returned unwanted error: %v", tc.pkg, tc.version, tc.os, tc.arch, err)
+			continue
+		}
+		if want := filepath.Join(dir, tc.expect); got != want {
+			t.Errorf("lookup(%s, %s, %s, %s) got %s, wanted %s", tc.pkg, tc.version, tc.os, tc.arch, got, want)
+		}
+	}
+
+	// The binary is staged where debian/rules skips downloading it.
+	dstdir := filepath.Join(dir, "kubectl")
+	c := cfg{version: version{Version: "1.11.0"}, Package: "kubectl", OS: "linux", Arch: "amd64"}
+	if err := c.stageManifestBinary(m, dstdir); err != nil {
+		t.Fatalf("stageManifestBinary() returned unwanted error: %v", err)
+	}
+	if staged, err := ioutil.ReadFile(filepath.Join(dstdir, "usr", "bin", "kubectl")); err != nil || string(staged) != "kubectl 1.11.0" {
+		t.Errorf("stageManifestBinary() staged %q, %v", staged, err)
+	}
+	c.Package = "kubernetes-cni"
+	if err := c.stageManifestBinary(m, dstdir); err == nil || !strings.Contains(err.Error(), "no entry for kubernetes-cni") {
+		t.Errorf("stageManifestBinary() of kubernetes-cni without an entry returned %v, wanted an error", err)
+	}
+
+	if err := ioutil.WriteFile(manifestPath, []byte(`[{"package": "kubectl", "os": "linux", "arch": "amd64"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBinariesManifest(manifestPath); err == nil {
+		t.Errorf("loadBinariesManifest() of an entry without a path expected an error")
+	}
+}
+
+func TestStageManifestArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binaries-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var entries []binaryEntry
+	for _, e := range []binaryEntry{
+		{Package: "kubernetes-cni", Path: "cni.tgz"},
+		{Package: "cri-tools", Binary: "crictl", Path: "crictl.tar.gz"},
+		{Package: "cri-tools", Binary: "critest", Path: "critest.tar.gz"},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, e.Path), []byte(e.Path), 0644); err != nil {
+			t.Fatal(err)
+		}
+		e.OS, e.Arch, e.SHA256 = "linux", "amd64", fmt.Sprintf("%x", sha256.Sum256([]byte(e.Path)))
+		entries = append(entries, e)
+	}
+	m := &binariesManifest{dir: dir, entries: entries}
+
+	testcases := []struct {
+		pkg, version string
+		expect       map[string]string
+	}{
+		{"kubernetes-cni", "0.6.0", map[string]string{"cni-plugins-amd64-v0.6.0.tgz": "cni.tgz"}},
+		{"cri-tools", "1.11.1", map[string]string{
+			"crictl-v1.11.1-linux-amd64.tar.gz":  "crictl.tar.gz",
+			"critest-v1.11.1-linux-amd64.tar.gz": "critest.tar.gz",
+		}},
+	}
+	for _, tc := range testcases {
+		dstdir := filepath.Join(dir, tc.pkg)
+		c := cfg{version: version{Version: tc.version}, Package: tc.pkg, OS: "linux", Arch: "amd64", Binaries: newBuild(tc.pkg, nil).binaries()}
+		if err := c.stageManifestBinary(m, dstdir); err != nil {
+			t.Fatalf("stageManifestBinary() of %s returned unwanted error: %v", tc.pkg, err)
+		}
+		for name, want := range tc.expect {
+			if got, err := ioutil.ReadFile(filepath.Join(dstdir, name)); err != nil || string(got) != want {
+				t.Errorf("stageManifestBinary() of %s staged %s as %q, %v; wanted %q", tc.pkg, name, got, err, want)
+			}
+		}
+	}
+
+	// Every program of cri-tools needs its entry.
+	m.entries = entries[:2]
+	c := cfg{version: version{Version: "1.11.1"}, Package: "cri-tools", OS: "linux", Arch: "amd64", Binaries: []string{"crictl", "critest"}}
+	if err := c.stageManifestBinary(m, filepath.Join(dir, "partial")); err == nil || !strings.Contains(err.Error(), "cri-tools critest") {
+		t.Errorf("stageManifestBinary() without an entry for critest returned %v, wanted an error", err)
+	}
+}
+
+func TestBinariesManifestSelection(t *testing.T) {
+	testcases := []struct {
+		name          string
+		entries       []binaryEntry
+		expectPkgs    []string
+		expectVersion string
+		expectErr     string
+	}{
+		{
+			name: "one version",
+			entries: []binaryEntry{
+				{Package: "kubeadm", Version: "1.11.0", OS: "linux", Arch: "amd64"},
+				{Package: "kubectl", Version: "1.11.0", OS: "linux", Arch: "amd64"},
+				{Package: "kubectl", Version: "1.11.0", OS: "linux", Arch: "arm64"},
+			},
+			expectPkgs:    []string{"kubectl", "kubeadm"},
+			expectVersion: "1.11.0",
+		},
+		{
+			name: "entries for all versions",
+			entries: []binaryEntry{
+				{Package: "kubectl", OS: "linux", Arch: "amd64"},
+				{Package: "kubelet", Version: "1.11.0", OS: "linux", Arch: "amd64"},
+			},
+			expectPkgs:    []string{"kubectl", "kubelet"},
+			expectVersion: "1.11.0",
+		},
+		{
+			name: "no version",
+			entries: []binaryEntry{
+				{Package: "kubectl", OS: "linux", Arch: "amd64"},
+			},
+			expectPkgs: []string{"kubectl"},
+			expectErr:  "lists no version of kubectl, kubelet, kubeadm",
+		},
+		{
+			name: "several versions",
+			entries: []binaryEntry{
+				{Package: "kubectl", Version: "1.11.0", OS: "linux", Arch: "amd64"},
+				{Package: "kubelet", Version: "1.11.1", OS: "linux", Arch: "amd64"},
+			},
+			expectPkgs: []string{"kubectl", "kubelet"},
+			expectErr:  "both versions 1.11.0 and 1.11.1",
+		},
+		{
+			name: "all packages",
+			entries: []binaryEntry{
+				{Package: "kubectl", Version: "1.11.0", OS: "linux", Arch: "amd64"},
+				{Package: "kubelet", Version: "1.11.0", OS: "linux", Arch: "amd64"},
+				{Package: "kubernetes-cni", Version: "0.6.0", OS: "linux", Arch: "amd64"},
+				{Package: "kubeadm", Version: "1.11.0", OS: "linux", Arch: "amd64"},
+				{Package: "cri-tools", Binary: "crictl", Version: "1.11.1", OS: "linux", Arch: "amd64"},
+			},
+			expectPkgs:    KnownPackages(),
+			expectVersion: "1.11.0",
+		},
+	}
+	for _, tc := range testcases {
+		m := &binariesManifest{entries: tc.entries}
+		if got := m.packages(); !reflect.DeepEqual(got, tc.expectPkgs) {
+			t.Errorf("%s: packages() got %v, wanted %v", tc.name, got, tc.expectPkgs)
+		}
+		got, err := m.version("kubectl", "kubelet", "kubeadm")
+		if len(tc.expectErr) != 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+				t.Errorf("%s: version() returned %q, %v; wanted an error containing %q", tc.name, got, err, tc.expectErr)
+			}
+			continue
+		}
+		if err != nil || got != tc.expectVersion {
+			t.Errorf("%s: version() returned %q, %v; wanted %q", tc.name, got, err, tc.expectVersion)
+		}
+	}
+}
+
+func TestRunCommandQuiet(t *testing.T) {
+	defer func(orig bool) { *quiet = orig }(*quiet)
+	origStdout, origStderr := os.Stdout, os.Stderr
+	defer func() { os.Stdout, os.Stderr = origStdout, origStderr }()
+
+	testcases := []struct {
+		quiet        bool
+		script       string
+		expectErr    bool
+		expectStdout string
+		expectStderr []string
+	}{
+		{false, "echo out; echo err >&2", false, "out\n", []string{"err\n"}},
+		{true, "echo out; echo err >&2", false, "", nil},
+		{true, "echo out; echo err >&2; exit 1", true, "", []string{"out\n", "err\n"}},
+	}
+
+	for _, tc := range testcases {
+		stdout, err := ioutil.TempFile("", "stdout")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(stdout.Name())
+		stderr, err := ioutil.TempFile("", "stderr")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(stderr.Name())
+
+		*quiet = tc.quiet
+		os.Stdout, os.Stderr = stdout, stderr
+		var out bytes.Buffer
+		err = runCommand(context.Background(), "", nil, &out, "sh", "-c", tc.script)
+		os.Stdout, os.Stderr = origStdout, origStderr
+		stdout.Close()
+		stderr.Close()
+
+		if (err != nil) != tc.expectErr {
+			t.Errorf("runCommand(%q) with quiet %v returned %v, expected error: %v", tc.script, tc.quiet, err, tc.expectErr)
+		}
+		// The output is always available to the caller.
+		if !strings.Contains(out.String(), "out\n") {
+			t.Errorf("runCommand(%q) with quiet %v copied %q to out", tc.script, tc.quiet, out.String())
+		}
+		if got, _ := ioutil.ReadFile(stdout.Name()); string(got) != tc.expectStdout {
+			t.Errorf("runCommand(%q) with quiet %v printed %q to stdout, wanted %q", tc.script, tc.quiet, got, tc.expectStdout)
+		}
+		// Stdout and stderr are copied concurrently, in any order.
+		got, _ := ioutil.ReadFile(stderr.Name())
+		lines := strings.SplitAfter(string(got), "\n")
+		sort.Strings(lines)
+		want := append([]string{""}, tc.expectStderr...)
+		sort.Strings(want)
+		if !reflect.DeepEqual(lines, want) {
+			t.Errorf("runCommand(%q) with quiet %v printed %q to stderr, wanted %q", tc.script, tc.quiet, got, tc.expectStderr)
+		}
+	}
+}
+
+func TestAffectedPackages(t *testing.T) {
+	testcases := []struct {
+		changed []string
+		expect  []string
+	}{
+		{[]string{"kubernetes-cni"}, []string{"kubelet", "kubernetes-cni", "kubeadm", "kubernetes"}},
+		{[]string{"cri-tools"}, []string{"kubeadm", "cri-tools", "kubernetes"}},
+		{[]string{"kubelet"}, []string{"kubelet", "kubeadm", "kubernetes"}},
+		{[]string{"kubectl"}, []string{"kubectl", "kubeadm", "kubernetes"}},
+		{[]string{"kubeadm"}, []string{"kubeadm", "kubernetes"}},
+		{[]string{"cri-tools", "kubectl"}, []string{"kubectl", "kubeadm", "cri-tools", "kubernetes"}},
+		{[]string{"kubernetes"}, []string{"kubernetes"}},
+		{nil, nil},
+	}
+
+	for _, tc := range testcases {
+		got := affectedPackages(tc.changed)
+		if !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("affectedPackages(%v) got %v, wanted %v", tc.changed, got, tc.expect)
+		}
+	}
+
+	var builds []build
+	for _, pkg := range KnownPackages() {
+		builds = append(builds, build{Package: pkg})
+	}
+	var selected []string
+	for _, b := range selectPackages(builds, affectedPackages([]string{"cri-tools"})) {
+		selected = append(selected, b.Package)
+	}
+	if want := []string{"kubeadm", "cri-tools", "kubernetes"}; !reflect.DeepEqual(selected, want) {
+		t.Errorf("builds affected by cri-tools got %v, wanted %v", selected, want)
+	}
+}
+
+func TestCfgNow(t *testing.T) {
+	// The build times come from the clock the changelog date does.
+	at := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+	c := cfg{clock: fakeClock{at}}
+	if got := c.now(); !got.Equal(at) {
+		t.Errorf("now() got %v, wanted the time of the clock %v", got, at)
+	}
+	c.clock = nil
+	if got := c.now(); got.Before(at) {
+		t.Errorf("now() without a clock got %v, wanted the system time", got)
+	}
+}
+
+func TestNewProvenance(t *testing.T) {
+	c := cfg{
+		version: version{
+			Version:          "1.11.0",
+			Revision:         "00",
+			Channel:          ChannelStable,
+			DownloadLinkBase: "https://dl.k8s.io/v1.11.0",
+		},
+		Package:     "kubectl",
+		PackageName: "kubectl",
+		DebVersion:  "1.11.0-00",
+		DistroName:  "xenial",
+		OS:          "linux",
+		Arch:        "arm64",
+		GitCommit:   "0123456789abcdef",
+	}
+
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	fs.String("revision", "00", "")
+	fs.String("github-token", "", "")
+	fs.String("version-auth-basic", "", "")
+	fs.Bool("sbom", false, "")
+	if err := fs.Parse([]string{"--revision=01", "--github-token=s3cr3t", "--version-auth-basic=builder:s3cr3t"}); err != nil {
+		t.Fatal(err)
+	}
+	flags := invocationFlags(fs)
+	if want := map[string]string{"revision": "01", "github-token": "<redacted>", "version-auth-basic": "<redacted>"}; !reflect.DeepEqual(flags, want) {
+		t.Errorf("invocationFlags() got %v, wanted %v", flags, want)
+	}
+
+	started := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+	finished := started.Add(90 * time.Second)
+	data, err := json.Marshal(newProvenance(c, "kubectl_1.11.0-00_arm64.deb", "abc123", flags, started, finished))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("s3cr3t")) {
+		t.Errorf("provenance reveals a secret flag: %s", data)
+	}
+
+	// Check the emitted document the way a verifier would read it.
+	var doc struct {
+		Type    string `json:"_type"`
+		Subject []struct {
+			Name   string            `json:"name"`
+			Digest map[string]string `json:"digest"`
+		} `json:"subject"`
+		PredicateType string `json:"predicateType"`
+		Predicate     struct {
+			Builder struct {
+				ID string `json:"id"`
+			} `json:"builder"`
+			BuildType  string `json:"buildType"`
+			Invocation struct {
+				ConfigSource struct {
+					URI        string            `json:"uri"`
+					Digest     map[string]string `json:"digest"`
+					EntryPoint string            `json:"entryPoint"`
+				} `json:"configSource"`
+				Parameters map[string]string `json:"parameters"`
+			} `json:"invocation"`
+			Metadata struct {
+				BuildStartedOn  string `json:"buildStartedOn"`
+				BuildFinishedOn string `json:"buildFinishedOn"`
+			} `json:"metadata"`
+			Materials []struct {
+				URI string `json:"uri"`
+			} `json:"materials"`
+		} `json:"predicate"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.Type != "https://in-toto.io/Statement/v0.1" || doc.PredicateType != "https://slsa.dev/provenance/v0.2" {
+		t.Errorf("got statement type %q with predicate type %q", doc.Type, doc.PredicateType)
+	}
+	if len(doc.Subject) != 1 || doc.Subject[0].Name != "kubectl_1.11.0-00_arm64.deb" || doc.Subject[0].Digest["sha256"] != "abc123" {
+		t.Errorf("got subject %+v, wanted the .deb and its sha256", doc.Subject)
+	}
+	p := doc.Predicate
+	if len(p.Builder.ID) == 0 || len(p.BuildType) == 0 {
+		t.Errorf("got builder %q and build type %q, wanted both", p.Builder.ID, p.BuildType)
+	}
+	if p.Invocation.ConfigSource.Digest["sha1"] != c.GitCommit || p.Invocation.ConfigSource.EntryPoint != "debian/xenial/kubectl" {
+		t.Errorf("got config source %+v", p.Invocation.ConfigSource)
+	}
+	for name, want := range map[string]string{
+		"version":          "1.11.0",
+		"debVersion":       "1.11.0-00",
+		"arch":             "arm64",
+		"downloadLinkBase": "https://dl.k8s.io/v1.11.0",
+		"flag:revision":    "01",
+	} {
+		if got := p.Invocation.Parameters[name]; got != want {
+			t.Errorf("got parameter %s %q, wanted %q", name, got, want)
+		}
+	}
+	if p.Metadata.BuildStartedOn != "2018-07-04T12:00:00Z" || p.Metadata.BuildFinishedOn != "2018-07-04T12:01:30Z" {
+		t.Errorf("got build times %+v", p.Metadata)
+	}
+	var materials []string
+	for _, m := range p.Materials {
+		materials = append(materials, m.URI)
+	}
+	if want := []string{"git+https://github.com/kubernetes/release", "https://dl.k8s.io/v1.11.0/bin/linux/arm64/kubectl"}; !reflect.DeepEqual(materials, want) {
+		t.Errorf("got materials %v, wanted %v", materials, want)
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	defer func(orig func(string) (uint64, error)) { statfs = orig }(statfs)
+
+	var tasks []buildTask
+	for _, pkg := range []string{"kubectl", "kubelet", "kubeadm"} {
+		for _, arch := range []string{"amd64", "arm64"} {
+			tasks = append(tasks, buildTask{build: build{Package: pkg}, os: "linux", arch: arch})
+		}
+	}
+	output, temp := estimateDiskSpace(tasks, 2)
+	if want := uint64(2 * (60 + 120 + 60) << 20); output != want {
+		t.Errorf("estimated %d bytes of output, wanted %d", output, want)
+	}
+	if want := uint64(2 * 3 * 120 << 20); temp != want {
+		t.Errorf("estimated %d bytes of temporary files, wanted %d", temp, want)
+	}
+
+	dir, err := ioutil.TempDir("", "disk-space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outputDir := filepath.Join(dir, "bin")
+	tempDir := filepath.Join(dir, "tmp")
+	if err := os.Mkdir(tempDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		free       map[string]uint64
+		minFree    string
+		expectErr  bool
+		expectWarn bool
+	}{
+		{map[string]uint64{dir: 10 << 30, tempDir: 10 << 30}, "", false, false},
+		{map[string]uint64{dir: 100 << 20, tempDir: 10 << 30}, "", true, false},
+		{map[string]uint64{dir: 10 << 30, tempDir: 100 << 20}, "", true, false},
+		{map[string]uint64{dir: 600 << 20, tempDir: 10 << 30}, "", false, true},
+		{map[string]uint64{dir: 100 << 20, tempDir: 100 << 20}, "50M", false, false},
+		{map[string]uint64{dir: 10 << 30, tempDir: 10 << 30}, "20G", true, false},
+		{map[string]uint64{dir: 0, tempDir: 0}, "0", false, false},
+		{map[string]uint64{dir: 10 << 30, tempDir: 10 << 30}, "lots", true, false},
+	}
+
+	for _, tc := range testcases {
+		statfs = func(path string) (uint64, error) {
+			free, ok := tc.free[path]
+			if !ok {
+				return 0, fmt.Errorf("unexpected statfs of %s", path)
+			}
+			return free, nil
+		}
+		var logged bytes.Buffer
+		log.SetOutput(&logged)
+		err := checkDiskSpace(tasks, 2, outputDir, tempDir, tc.minFree)
+		log.SetOutput(os.Stderr)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("checkDiskSpace() with %v free and minimum %q returned %v, expected error: %v", tc.free, tc.minFree, err, tc.expectErr)
+		}
+		if warned := strings.Contains(logged.String(), "tight"); warned != tc.expectWarn {
+			t.Errorf("checkDiskSpace() with %v free and minimum %q warned: %v, wanted: %v", tc.free, tc.minFree, warned, tc.expectWarn)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	testcases := []struct {
+		size      string
+		expect    uint64
+		expectErr bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"512M", 512 << 20, false},
+		{"10G", 10 << 30, false},
+		{"10gb", 10 << 30, false},
+		{"10GiB", 10 << 30, false},
+		{"1T", 1 << 40, false},
+		{"", 0, true},
+		{"G", 0, true},
+		{"-1G", 0, true},
+		{"1.5G", 0, true},
+	}
+	for _, tc := range testcases {
+		got, err := parseSize(tc.size)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("parseSize(%q) returned %v, expected error: %v", tc.size, err, tc.expectErr)
+		}
+		if got != tc.expect {
+			t.Errorf("parseSize(%q) got %d, wanted %d", tc.size, got, tc.expect)
+		}
+	}
+}
+
+func TestDescriptions(t *testing.T) {
+	descriptions, err := parseDescriptions([]string{"kubelet=The Kubelet"})
+	if err != nil {
+		t.Fatalf("parseDescriptions returned unwanted error: %v", err)
+	}
+	v := version{Version: "1.11.0", Revision: "00", Channel: ChannelStable, CNIVersion: "0.6.0", KubeletCNIVersion: "= 0.6.0"}
+	for _, pkg := range KnownPackages() {
+		d := descriptions[pkg]
+		c := cfg{
+			version:         v,
+			Package:         pkg,
+			PackageName:     pkg,
+			DebArch:         "amd64",
+			Arch:            "amd64",
+			Homepage:        "https://example.com/" + pkg,
+			Description:     d.Synopsis,
+			LongDescription: d.controlText(),
+		}
+		control := renderDefinition(t, filepath.Join("xenial", pkg, "debian", "control"), c)
+		for _, want := range []string{
+			"\nHomepage: https://example.com/" + pkg + "\n",
+			"\nDescription: " + d.Synopsis + "\n " + d.Long + "\n",
+		} {
+			if !strings.Contains(control, want) {
+				t.Errorf("%s control doesn't contain %q:\n%s", pkg, want, control)
+			}
+		}
+
+		apkbuild := filepath.Join("alpine", pkg, "APKBUILD")
+		if _, err := os.Stat(apkbuild); err != nil {
+			continue
+		}
+		c.ApkArch = "x86_64"
+		rendered := renderDefinition(t, apkbuild, c)
+		for _, want := range []string{
+			"\npkgdesc=\"" + d.Synopsis + "\"\n",
+			"\nurl=\"https://example.com/" + pkg + "\"\n",
+		} {
+			if !strings.Contains(rendered, want) {
+				t.Errorf("%s APKBUILD doesn't contain %q:\n%s", pkg, want, rendered)
+			}
+		}
+	}
+	if got := descriptions["kubelet"].Synopsis; got != "The Kubelet" {
+		t.Errorf("kubelet synopsis = %q, want %q", got, "The Kubelet")
+	}
+	if got := packageDescriptions["kubelet"].Synopsis; got != "Kubernetes Node Agent" {
+		t.Errorf("overriding a description changed the default to %q", got)
+	}
+
+	for _, spec := range []string{
+		"kubelet",
+		"=Kubelet",
+		"kubelet=",
+		"kubelet= ",
+		"kubelet=two\nlines",
+		"kubelet=" + strings.Repeat("x", 81),
+		"kubeproxy=Proxy",
+	} {
+		if _, err := parseDescriptions([]string{spec}); err == nil {
+			t.Errorf("parseDescriptions(%q) expected an error", spec)
+		}
+	}
+
+	if got, want := (packageDescription{Long: "First.\n\nSecond."}).controlText(), " First.\n .\n Second."; got != want {
+		t.Errorf("controlText() = %q, want %q", got, want)
+	}
+}
+
+func TestValidateHomepage(t *testing.T) {
+	for homepage, valid := range map[string]bool{
+		"https://kubernetes.io":      true,
+		"http://example.com/kubelet": true,
+		"":                           false,
+		"kubernetes.io":              false,
+		"ftp://kubernetes.io":        false,
+		"https://":                   false,
+		"https://kubernetes.io/%zz":  false,
+	} {
+		if err := validateHomepage(homepage); (err == nil) != valid {
+			t.Errorf("validateHomepage(%q) = %v, want valid %v", homepage, err, valid)
+		}
+	}
+}
+
+func TestMetaPackage(t *testing.T) {
+	defer func(orig stringList) { architectures = orig }(architectures)
+	architectures = stringList{"amd64", "arm64"}
+
+	fixed := func(v string) func() (string, error) {
+		return func() (string, error) { return v, nil }
+	}
+	var builds []build
+	for _, pkg := range KnownPackages() {
+		var versions []version
+		for _, channel := range []ChannelType{ChannelStable, ChannelUnstable} {
+			v := version{Revision: "00", Channel: channel, GetVersion: fixed("1.11.0")}
+			switch {
+			case pkg == "kubernetes-cni":
+				v.GetVersion = fixed("0.6.0")
+			case pkg == "cri-tools":
+				v.GetVersion = fixed("1.11.1")
+			case channel == ChannelUnstable:
+				v.GetVersion = fixed("1.12.0-beta.0")
+			}
+			versions = append(versions, v)
+		}
+		builds = append(builds, newBuild(pkg, versions))
+	}
+
+	type metaBuild struct {
+		distro, arch string
+		v            version
+	}
+	var metaBuilds []metaBuild
+	if err := walkBuilds(builds, func(b build, distro, _, arch string, v version) error {
+		if b.Package == metaPackage {
+			metaBuilds = append(metaBuilds, metaBuild{distro, arch, v})
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("walkBuilds() returned unwanted error: %v", err)
+	}
+	if len(metaBuilds) != len(serverDistros)*2 {
+		t.Fatalf("the meta-package was built %d times, wanted once per channel and distro", len(metaBuilds))
+	}
+
+	expect := map[ChannelType]string{
+		ChannelStable:   "\nDepends: kubectl (= 1:1.11.0+job-00), kubelet (= 1:1.11.0+job-00), kubernetes-cni (= 1:0.6.0+job-00), kubeadm (= 1:1.11.0+job-00), cri-tools (= 1:1.11.1+job-00), ${misc:Depends}\n",
+		ChannelUnstable: "\nDepends: kubectl (= 1:1.12.0~beta.0+job-00), kubelet (= 1:1.12.0~beta.0+job-00), kubernetes-cni (= 1:0.6.0+job-00), kubeadm (= 1:1.12.0~beta.0+job-00), cri-tools (= 1:1.11.1+job-00), ${misc:Depends}\n",
+	}
+	for _, m := range metaBuilds {
+		if m.arch != "amd64" {
+			t.Errorf("the meta-package was built for %s, wanted only the first architecture", m.arch)
+		}
+		versions, err := debVersionsFor(builds, m.v.Channel, 1, "job")
+		if err != nil {
+			t.Fatalf("debVersionsFor(%s) returned unwanted error: %v", m.v.Channel, err)
+		}
+		c := cfg{
+			version:         m.v,
+			Package:         metaPackage,
+			PackageName:     packageName(metaPackage, m.v.Channel),
+			DistroName:      m.distro,
+			DebArch:         "all",
+			packageVersions: versions,
+		}
+		control := renderDefinition(t, filepath.Join("xenial", metaPackage, "debian", "control"), c)
+		for _, want := range []string{expect[m.v.Channel], "\nArchitecture: all\n"} {
+			if !strings.Contains(control, want) {
+				t.Errorf("%s control doesn't contain %q:\n%s", c.PackageName, want, control)
+			}
+		}
+	}
+
+	// A package built at two versions in a channel can't be pinned.
+	kubectl := builds[0]
+	kubectl.Versions = append(kubectl.Versions, version{Revision: "00", Channel: ChannelStable, GetVersion: fixed("1.11.1")})
+	if _, err := debVersionsFor([]build{kubectl}, ChannelStable, 1, "job"); err == nil || !strings.Contains(err.Error(), "several versions") {
+		t.Errorf("debVersionsFor() of kubectl at two versions returned %v, wanted an error", err)
+	}
+}
+
+func TestBuildDebArchIndependent(t *testing.T) {
+	defer func(orig func(context.Context, string, []string, io.Writer, string, ...string) error) {
+		runCommand = orig
+	}(runCommand)
+
+	var args []string
+	runCommand = func(_ context.Context, _ string, _ []string, _ io.Writer, command string, a ...string) error {
+		if command == "dpkg-buildpackage" {
+			args = a
+		}
+		return nil
+	}
+
+	c := cfg{
+		version:     version{Version: "1.11.0", Revision: "00", Channel: ChannelStable},
+		Package:     metaPackage,
+		PackageName: metaPackage,
+		DebVersion:  "1.11.0-00",
+		DistroName:  "xenial",
+		OS:          "linux",
+		Arch:        "amd64",
+		DebArch:     "all",
+	}
+	if err := c.buildDeb(context.Background(), ""); err != nil {
+		t.Fatalf("buildDeb() returned unwanted error: %v", err)
+	}
+	if want := []string{"-us", "-uc", "-b"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("dpkg-buildpackage was run with %v, wanted %v", args, want)
+	}
+	if got, want := c.debFileName(), "kubernetes_1.11.0-00_all.deb"; got != want {
+		t.Errorf("debFileName() = %q, want %q", got, want)
+	}
+}
+
+func TestBuildDebArchIndependentPerArchDirs(t *testing.T) {
+	defer func(orig func(context.Context, string, []string, io.Writer, string, ...string) error) {
+		runCommand = orig
+	}(runCommand)
+	defer func(orig bool) { *perArchDirs = orig }(*perArchDirs)
+	defer func(orig stringList) { architectures = orig }(architectures)
+	*perArchDirs = true
+	architectures = stringList{"amd64", "arm"}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "per-arch-dirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	const fileName = "kubernetes_1.11.0-00_all.deb"
+	runCommand = func(_ context.Context, _ string, _ []string, _ io.Writer, command string, a ...string) error {
+		switch command {
+		case "dpkg-buildpackage":
+			return ioutil.WriteFile(fileName, []byte("package"), 0644)
+		case "mv":
+			return os.Rename(a[0], filepath.Join(a[1], filepath.Base(a[0])))
+		}
+		return nil
+	}
+
+	c := cfg{
+		version:     version{Version: "1.11.0", Revision: "00", Channel: ChannelStable},
+		Package:     metaPackage,
+		PackageName: metaPackage,
+		DebVersion:  "1.11.0-00",
+		DistroName:  "xenial",
+		OS:          "linux",
+		Arch:        "amd64",
+		DebArch:     "all",
+	}
+	expectDirs := []string{
+		filepath.Join("bin", "stable", "xenial", "amd64"),
+		filepath.Join("bin", "stable", "xenial", "armhf"),
+	}
+	if got := c.publishedDirs(); !reflect.DeepEqual(got, expectDirs) {
+		t.Errorf("publishedDirs() got %v, wanted %v", got, expectDirs)
+	}
+	if err := c.buildDeb(context.Background(), filepath.Join(dir, "kubernetes")); err != nil {
+		t.Fatalf("buildDeb() returned unwanted error: %v", err)
+	}
+	// The package is in the directory of every architecture.
+	for _, d := range expectDirs {
+		if data, err := ioutil.ReadFile(filepath.Join(d, fileName)); err != nil || string(data) != "package" {
+			t.Errorf("%s in %s: got %q, %v", fileName, d, data, err)
+		}
+	}
+}
+
+func TestDiskVersionCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const url = "https://dl.k8s.io/release/stable.txt"
+	now := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+	var published string
+	fetches := 0
+	cache := func(path string, at time.Time, refresh bool) *diskVersionCache {
+		return &diskVersionCache{
+			path:    path,
+			ttl:     time.Hour,
+			refresh: refresh,
+			clock:   fakeClock{at},
+			fetch: func(string) (string, error) {
+				fetches++
+				return published, nil
+			},
+		}
+	}
+
+	testcases := []struct {
+		name      string
+		at        time.Time
+		refresh   bool
+		published string
+		expect    string
+		fetched   bool
+	}{
+		{"empty cache", now, false, "1.11.0", "1.11.0", true},
+		{"fresh cache", now.Add(59 * time.Minute), false, "1.11.1", "1.11.0", false},
+		{"expired cache", now.Add(61 * time.Minute), false, "1.11.1", "1.11.1", true},
+		{"cached by the expired fetch", now.Add(90 * time.Minute), false, "1.11.2", "1.11.1", false},
+		{"forced refresh", now.Add(91 * time.Minute), true, "1.11.2", "1.11.2", true},
+		{"fetched in the future", now, false, "1.11.3", "1.11.3", true},
+	}
+
+	path := filepath.Join(dir, "versions.json")
+	for _, tc := range testcases {
+		published = tc.published
+		before := fetches
+		got, err := cache(path, tc.at, tc.refresh).get(url)
+		if err != nil {
+			t.Fatalf("%s: get() returned unwanted error: %v", tc.name, err)
+		}
+		if got != tc.expect {
+			t.Errorf("%s: get() = %q, want %q", tc.name, got, tc.expect)
+		}
+		if fetched := fetches != before; fetched != tc.fetched {
+			t.Errorf("%s: fetched %v, want %v", tc.name, fetched, tc.fetched)
+		}
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := ioutil.WriteFile(corrupt, []byte("{\"https://dl.k8s.io"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := fetches
+	if got, err := cache(corrupt, now, false).get(url); err != nil || got != published || fetches == before {
+		t.Errorf("get() with a corrupt cache = %q, %v, wanted a fetched %q", got, err, published)
+	}
+	var entries map[string]cachedVersion
+	data, err := ioutil.ReadFile(corrupt)
+	if err == nil {
+		err = json.Unmarshal(data, &entries)
+	}
+	if err != nil || entries[url].Version != published || !entries[url].Fetched.Equal(now) {
+		t.Errorf("the corrupt cache was rewritten to %s (%v), wanted version %s fetched at %s", data, err, published, now)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0644 {
+		t.Errorf("the cache has mode %v, wanted 0644", info.Mode().Perm())
+	}
+
+	// The latest CI build is fetched every time.
+	uncached := cache(path, now, false)
+	uncached.uncached = []string{ciVersionURL}
+	for i, want := range []string{"1.12.0-alpha.0.1", "1.12.0-alpha.0.2"} {
+		published = want
+		before := fetches
+		if got, err := uncached.get(ciVersionURL); err != nil || got != want || fetches == before {
+			t.Errorf("get() of the CI version #%d = %q, %v, wanted a fetched %q", i, got, err, want)
+		}
+	}
+}
+
+func TestDiffManifests(t *testing.T) {
+	entry := func(pkg, version, channel, arch string) manifestEntry {
+		name := pkg
+		if strings.HasSuffix(pkg, "-dbgsym") {
+			name = strings.TrimSuffix(pkg, "-dbgsym")
+		}
+		return manifestEntry{
+			Package: name,
+			Version: version,
+			Distro:  "xenial",
+			Channel: channel,
+			Arch:    arch,
+			Path:    fmt.Sprintf("bin/%s/xenial/%s_%s_%s.deb", channel, pkg, version, arch),
+		}
+	}
+	prev := manifest{Packages: []manifestEntry{
+		entry("kubectl", "1.11.0-00", "stable", "amd64"),
+		entry("kubectl", "1.11.0-00", "stable", "arm64"),
+		entry("kubelet", "1.11.0-00", "stable", "amd64"),
+		entry("kubelet-dbgsym", "1.11.0-00", "stable", "amd64"),
+		entry("kubeadm", "1.11.0-00", "stable", "amd64"),
+		entry("cri-tools", "1.11.1-00", "stable", "amd64"),
+		entry("kubectl", "1.12.0~beta.0-00", "unstable", "amd64"),
+	}}
+	cur := manifest{Packages: []manifestEntry{
+		entry("kubernetes", "1.11.1-00", "stable", "all"),
+		entry("kubectl", "1.11.1-00", "stable", "amd64"),
+		entry("kubectl", "1:1.11.0-00", "stable", "arm64"),
+		entry("kubelet", "1.11.0-01", "stable", "amd64"),
+		entry("kubelet-dbgsym", "1.11.0-01", "stable", "amd64"),
+		entry("cri-tools", "1.11.1-00", "stable", "amd64"),
+		entry("kubectl", "1.12.0~beta.1-00", "unstable", "amd64"),
+	}}
+
+	d := diffManifests(prev, cur)
+	var buf bytes.Buffer
+	if err := d.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `added:
+  kubernetes 1.11.1-00 (stable/xenial/all)
+removed:
+  kubeadm 1.11.0-00 (stable/xenial/amd64)
+version changes:
+  kubectl 1.11.0-00 -> 1.11.1-00 (stable/xenial/amd64)
+  kubectl 1.11.0-00 -> 1:1.11.0-00 (stable/xenial/arm64)
+  kubectl 1.12.0~beta.0-00 -> 1.12.0~beta.1-00 (unstable/xenial/amd64)
+revision bumps:
+  kubelet-dbgsym 1.11.0-00 -> 1.11.0-01 (stable/xenial/amd64)
+  kubelet 1.11.0-00 -> 1.11.0-01 (stable/xenial/amd64)
+`
+	if got := buf.String(); got != want {
+		t.Errorf("diffManifests() wrote\n%s\nwanted\n%s", got, want)
+	}
+	if d.empty() {
+		t.Errorf("diff of different manifests is empty")
+	}
+
+	same := diffManifests(cur, cur)
+	if !same.empty() {
+		t.Errorf("diff of a manifest with itself is %+v, wanted empty", same)
+	}
+	buf.Reset()
+	if err := same.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "no changes\n" {
+		t.Errorf("empty diff wrote %q", got)
+	}
+
+	if d := diffManifests(manifest{}, prev); len(d.Added) != len(prev.Packages) || len(d.Removed) != 0 {
+		t.Errorf("diff against an empty manifest got %+v, wanted all packages added", d)
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	f, err := ioutil.TempFile("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	m := manifest{GitCommit: "abc", Packages: []manifestEntry{{Package: "kubectl", Version: "1.11.0-00", Path: "bin/stable/xenial/kubectl_1.11.0-00_amd64.deb"}}}
+	if err := m.write(f, "json"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	got, err := loadManifest(f.Name())
+	if err != nil {
+		t.Fatalf("loadManifest() returned unwanted error: %v", err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("loadManifest() got %+v, wanted %+v", got, m)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("bin/stable/xenial/kubectl_1.11.0-00_amd64.deb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadManifest(f.Name()); err == nil {
+		t.Errorf("loadManifest() of a list manifest expected an error")
+	}
+}
+
+func TestRunCompatLevelWithInstalledSize(t *testing.T) {
+	defer func(orig func(context.Context, string, []string, io.Writer, string, ...string) error) {
+		runCommand = orig
+	}(runCommand)
+	defer func(level int, size bool) { *compatLevel, *installedSize = level, size }(*compatLevel, *installedSize)
+	*compatLevel, *installedSize = 11, true
+
+	var compat string
+	repacked := false
+	runCommand = func(_ context.Context, dir string, _ []string, _ io.Writer, command string, args ...string) error {
+		switch {
+		case command == "dpkg-buildpackage":
+			data, err := ioutil.ReadFile(filepath.Join(dir, "debian", "compat"))
+			compat = string(data)
+			return err
+		case command == "dpkg-deb" && args[0] == "--raw-extract":
+			if err := os.MkdirAll(filepath.Join(args[2], "DEBIAN"), 0755); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(args[2], "DEBIAN", "control"), []byte("Package: kubectl\n"), 0644)
+		case command == "dpkg-deb":
+			repacked = true
+		}
+		return nil
+	}
+
+	c := cfg{
+		version:     version{Version: "1.11.0", Revision: "00", Channel: ChannelStable},
+		Package:     "kubectl",
+		PackageName: "kubectl",
+		DebVersion:  "1.11.0-00",
+		DistroName:  "xenial",
+		OS:          "linux",
+		Arch:        "amd64",
+		DebArch:     "amd64",
+		Binaries:    []string{"kubectl"},
+		clock:       fakeClock{time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)},
+	}
+	if err := c.run(context.Background()); err != nil {
+		t.Fatalf("run() returned unwanted error: %v", err)
+	}
+	if compat != "11\n" {
+		t.Errorf("dpkg-buildpackage saw compat level %q, wanted the override 11", compat)
+	}
+	if !repacked {
+		t.Errorf("the Installed-Size of the package wasn't set")
+	}
+}
+
+func TestRunCleansTemplatedLeftovers(t *testing.T) {
+	defer func(orig func(context.Context, string, []string, io.Writer, string, ...string) error) {
+		runCommand = orig
+	}(runCommand)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "leftovers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// A definition that carries leftovers of a build, templated or not.
+	definition := map[string]string{
+		"control":           "Source: {{ .PackageName }}\n\nPackage: {{ .PackageName }}\n",
+		"files":             "{{ .PackageName }}_{{ .DebVersion }}_{{ .DebArch }}.deb misc optional\n",
+		"kubectl.substvars": "misc:Depends=\n",
+	}
+	for name, content := range definition {
+		file := filepath.Join(dir, "xenial", "kubectl", "debian", name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var seen []string
+	runCommand = func(_ context.Context, dir string, _ []string, _ io.Writer, command string, _ ...string) error {
+		if command != "dpkg-buildpackage" {
+			return nil
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, "debian"))
+		for _, f := range files {
+			seen = append(seen, f.Name())
+		}
+		return err
+	}
+
+	c := cfg{
+		version:     version{Version: "1.11.0", Revision: "00", Channel: ChannelStable},
+		Package:     "kubectl",
+		PackageName: "kubectl",
+		DebVersion:  "1.11.0-00",
+		DistroName:  "xenial",
+		OS:          "linux",
+		Arch:        "amd64",
+		DebArch:     "amd64",
+		clock:       fakeClock{time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)},
+	}
+	if err := c.run(context.Background()); err != nil {
+		t.Fatalf("run() returned unwanted error: %v", err)
+	}
+	if want := []string{"control"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("dpkg-buildpackage saw debian/ with %v, wanted %v", seen, want)
+	}
+}
+
+func TestApkDepends(t *testing.T) {
+	v := version{Version: "1.11.0", Revision: "0", Channel: ChannelStable, CNIVersion: "0.6.0", KubeletCNIVersion: "= 0.6.0"}
+	testcases := []struct {
+		pkg       string
+		overrides []string
+		expect    string
+	}{
+		{
+			"kubelet",
+			nil,
+			`depends="iptables>=1.4.21 ip6tables>=1.4.21 cni-plugins=0.6.0 iproute2 socat util-linux ebtables ethtool"`,
+		},
+		{
+			"kubeadm",
+			nil,
+			`depends="kubelet>=1.6.0 kubectl>=1.6.0 cni-plugins>=0.6.0 cri-tools>=1.11.0"`,
+		},
+		{
+			"kubeadm",
+			[]string{"kubeadm:cri-tools=recommends"},
+			`depends="kubelet>=1.6.0 kubectl>=1.6.0 cni-plugins>=0.6.0"`,
+		},
+	}
+	for _, tc := range testcases {
+		overrides, err := parseRelationOverrides(tc.overrides)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := cfg{
+			version:           v,
+			Package:           tc.pkg,
+			PackageName:       tc.pkg,
+			Arch:              "amd64",
+			ApkArch:           "x86_64",
+			relationOverrides: overrides[tc.pkg],
+		}
+		apkbuild := renderDefinition(t, filepath.Join("alpine", tc.pkg, "APKBUILD"), c)
+		if !strings.Contains(apkbuild, "\n"+tc.expect+"\n") {
+			t.Errorf("%s APKBUILD with %v doesn't contain %s:\n%s", tc.pkg, tc.overrides, tc.expect, apkbuild)
+		}
+	}
+
+	for constraint, want := range map[string]string{
+		"":                 "",
+		">= 1.6.0":         ">=1.6.0",
+		">=1.11.0":         ">=1.11.0",
+		"= 0.5.1":          "=0.5.1",
+		"<< 1.12.0-rc.1":   "<1.12.0_rc1",
+		">> 1.11.0":        ">1.11.0",
+		"<= 1.11.0-beta.2": "<=1.11.0_beta2",
+	} {
+		got, err := apkConstraint(constraint)
+		if err != nil || got != want {
+			t.Errorf("apkConstraint(%q) = %q, %v, want %q", constraint, got, err, want)
+		}
+	}
+	for _, constraint := range []string{"~ 1.11.0", "= 1:1.11.0-00"} {
+		if _, err := apkConstraint(constraint); err == nil {
+			t.Errorf("apkConstraint(%q) expected an error", constraint)
+		}
+	}
+}
+
+func TestUsesCNIVersion(t *testing.T) {
+	// Only the builds whose dependencies refer to the kubernetes-cni version
+	// get it resolved.
+	for _, pkg := range KnownPackages() {
+		c := cfg{Package: pkg, version: version{CNIVersion: "0.6.0", KubeletCNIVersion: "= 0.6.0"}}
+		refers := false
+		for _, d := range c.dependencies() {
+			if strings.Contains(d.Constraint, "0.6.0") {
+				refers = true
+			}
+		}
+		if got := usesCNIVersion(pkg); got != refers {
+			t.Errorf("usesCNIVersion(%s) = %v, but its dependencies refer to the CNI version: %v", pkg, got, refers)
+		}
+	}
+}